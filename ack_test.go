@@ -0,0 +1,46 @@
+package o3
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestManualAck(t *testing.T) {
+	sc := NewSessionContext(ThreemaID{ID: NewIDString("ECHOECHO")})
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	sc.connection = client
+
+	pkt := messagePacket{Sender: NewIDString("ABCDEFGH"), ID: 42}
+	rmsg := ReceivedMsg{ack: sc.deferAck(client, pkt)}
+
+	written := make(chan int)
+	go func() {
+		var size uint16
+		binary.Read(server, binary.LittleEndian, &size)
+		buf := make([]byte, size)
+		n, _ := server.Read(buf)
+		written <- n
+	}()
+	if err := rmsg.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	if n := <-written; n != len(serializeClientAck(pkt))+16 {
+		t.Errorf("ack of %d bytes written", n)
+	}
+	// acknowledged once only, a second write would block on the pipe
+	if err := rmsg.Ack(); err != nil {
+		t.Error(err)
+	}
+
+	// messages of a previous connection are redelivered instead
+	stale := ReceivedMsg{ack: sc.deferAck(server, pkt)}
+	if err := stale.Ack(); err != ErrAckExpired {
+		t.Errorf("got %v, want ErrAckExpired", err)
+	}
+	if err := (ReceivedMsg{}).Ack(); err != nil {
+		t.Errorf("automatically acknowledged message: %v", err)
+	}
+}
@@ -3,86 +3,192 @@ package o3
 import (
 	"bytes"
 	"encoding/csv"
-	"encoding/hex"
-	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 import "os"
 
+// VerificationLevel describes how far the long-term public key of a contact is trusted
+type VerificationLevel uint8
+
+// VerificationLevel mock enum, values match the levels used by the Threema apps
+const (
+	UNVERIFIED     VerificationLevel = 0x0 //indicates the key was fetched from the directory
+	SERVERVERIFIED VerificationLevel = 0x1 //indicates the key was matched by the directory using a linked email or phone number
+	FULLYVERIFIED  VerificationLevel = 0x2 //indicates the key was verified in person, e.g. by scanning a QR code
+)
+
 // ThreemaContact is the  core contact type, comprising of
 // an ID, a long-term public key, and an optional Name
 type ThreemaContact struct {
 	ID   [8]byte
 	Name string
 	LPK  [32]byte
+	// Verification is the level of trust in LPK
+	Verification VerificationLevel
+	// KeyChanged is set if the directory reported a key differing from the pinned LPK.
+	// The reported key is kept in ChangedLPK until the change is accepted.
+	KeyChanged bool
+	ChangedLPK [32]byte
+	// Blocked contacts are screened by the session's InboundFilter
+	Blocked bool
+	// FirstName and LastName are set locally, Nickname is the public nickname
+	// the contact announces with its messages
+	FirstName string
+	LastName  string
+	Nickname  string
+	// Features is the set of features the contact's client supports
+	Features FeatureMask
+	// KeyFetched is the time LPK was last fetched from the directory
+	KeyFetched time.Time
+}
+
+// FeatureMask is the bit mask of protocol features a Threema client announces
+// to the directory
+type FeatureMask uint64
+
+// hasKey reports whether the public key of the contact is known. Blocked IDs may be
+// stored without one.
+func (tc ThreemaContact) hasKey() bool {
+	return tc.LPK != [32]byte{}
 }
 
 func (tc ThreemaContact) String() string {
 	return string(tc.ID[:])
 }
 
-// AddressBook is the register of ThreemaContacts
+// DisplayName returns the name to show for the contact: the locally set Name or
+// first and last name, otherwise the contact's public nickname and finally its ID
+func (tc ThreemaContact) DisplayName() string {
+	switch {
+	case tc.Name != "":
+		return tc.Name
+	case tc.FirstName != "" || tc.LastName != "":
+		return strings.TrimSpace(tc.FirstName + " " + tc.LastName)
+	case tc.Nickname != "":
+		return tc.Nickname
+	}
+	return tc.String()
+}
+
+// AddressBook is the register of ThreemaContacts. It is safe for concurrent use.
+// Copies of an AddressBook share the same register once it has been initialized,
+// either by NewAddressBook or by the first call to one of its modifying methods.
 type AddressBook struct {
+	book *contactBook
+}
+
+type contactBook struct {
+	sync.RWMutex
 	contacts map[string]ThreemaContact
+	watchers contactWatchers
 }
 
-func (a AddressBook) slice() [][]string {
-	buf := make([][]string, len(a.contacts))
-	i := 0
-	for _, contact := range a.contacts {
-		buf[i] = make([]string, 3)
-		buf[i][0] = string(contact.ID[:])
-		buf[i][1] = contact.Name
-		buf[i][2] = hex.EncodeToString(contact.LPK[:])
-		i++
-	}
-	return buf
+// NewAddressBook returns an empty, initialized AddressBook
+func NewAddressBook() AddressBook {
+	var a AddressBook
+	a.initializeMap(0)
+	return a
 }
 
 func (a *AddressBook) initializeMap(c int) {
-	a.contacts = make(map[string]ThreemaContact, c)
+	if a.book == nil {
+		a.book = &contactBook{}
+	}
+	a.book.Lock()
+	a.book.contacts = make(map[string]ThreemaContact, c)
+	a.book.Unlock()
 }
 
 // Import takes a two-dimensional slice of strings and imports it
-// field by field into the address book.
-// Fields have to be in the order "ID, Name, LPK" or the function will
-// return an error
+// field by field into the address book, replacing its previous content.
+// If the first row is a header starting with "id", fields are matched by the
+// column names listed at AddressBookColumns. Otherwise the legacy format
+// "ID, Name, LPK" is expected.
+// Invalid rows are skipped and reported in an *ImportError; all valid rows
+// are imported regardless. Watchers are notified of every contact the import
+// added, changed or removed.
 func (a *AddressBook) Import(contacts [][]string) error {
-	a.contacts = make(map[string]ThreemaContact, len(contacts))
+	records, rowErrs := recordsFromRows(contacts)
+	return a.importRecords(records, rowErrs)
+}
 
-	if a.contacts == nil {
-		a.initializeMap(len(contacts))
-	}
+// importRecords validates records and replaces the address book's content with the valid ones
+func (a *AddressBook) importRecords(records []contactRecord, rowErrs []RowError) error {
+	imported := make(map[string]ThreemaContact, len(records))
 
-	for l, c := range contacts {
-		// log.Printf("%#v\n", c)
-		id := c[0]
-		contact := ThreemaContact{Name: c[1]}
-		n := copy(contact.ID[:], id[:])
-		if n != 8 {
-			return fmt.Errorf("line %d: invalid ID length: %d", l, n)
-		}
-		lpk, err := hex.DecodeString(c[2])
+	for _, rec := range records {
+		contact, err := rec.contact()
 		if err != nil {
-			return err
+			rowErrs = append(rowErrs, RowError{Line: rec.line, ID: rec.ID, Err: err})
+			continue
 		}
-		n = copy(contact.LPK[0:32], lpk[0:32])
-		if n != 32 {
-			return fmt.Errorf("line %d: invalid pubKey length: %d", l, n)
+		imported[contact.String()] = contact
+	}
+
+	if a.book == nil {
+		a.initializeMap(len(imported))
+	}
+	a.book.Lock()
+	previous := a.book.contacts
+	a.book.contacts = imported
+	a.book.Unlock()
+
+	// tell watchers what the import changed
+	for id, prev := range previous {
+		if _, kept := imported[id]; !kept {
+			a.book.watchers.notify(ContactEvent{Type: CONTACTDELETED, Contact: prev, Previous: prev})
 		}
-		a.contacts[id] = contact
+	}
+	for id, c := range imported {
+		prev, known := previous[id]
+		if !known || prev != c {
+			a.book.watchers.notify(changeEvent(prev, known, c))
+		}
+	}
+
+	if len(rowErrs) > 0 {
+		sort.Slice(rowErrs, func(i, j int) bool { return rowErrs[i].Line < rowErrs[j].Line })
+		return &ImportError{Rows: rowErrs}
 	}
 	return nil
 }
 
-// ImportFrom imports an address book stored in a CSV file
+// ImportFrom imports an address book stored in a file. Files ending in ".json"
+// are read as JSON, files ending in ".vcf" or ".vcard" as vCards with missing keys
+// fetched from the default directory, and all others as CSV. Use
+// SessionContext.ImportContacts to fetch missing keys from the session's Directory.
 func (a *AddressBook) ImportFrom(filename string) error {
+	var tr ThreemaRest
+	return a.importFrom(filename, tr.GetContactByID)
+}
+
+// importFrom is ImportFrom fetching missing vCard keys using lookup
+func (a *AddressBook) importFrom(filename string, lookup KeyLookup) error {
 	file, err := os.Open(filename)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	rdr := csv.NewReader(file)
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		return a.ImportJSON(file)
+	case ".vcf", ".vcard":
+		return a.ImportVCard(file, lookup)
+	}
+	return a.ImportCSV(file)
+}
+
+// ImportCSV imports an address book in CSV format, see Import
+func (a *AddressBook) ImportCSV(r io.Reader) error {
+	rdr := csv.NewReader(r)
+	// Rows of wrong length are reported by Import
+	rdr.FieldsPerRecord = -1
 	lines, err := rdr.ReadAll()
 	// log.Printf("Read lines: %#v\n", lines)
 	if err != nil {
@@ -91,8 +197,9 @@ func (a *AddressBook) ImportFrom(filename string) error {
 	return a.Import(lines)
 }
 
-// SaveTo stores the AddressBook in the file with the given name
-// in CSV format
+// SaveTo stores the AddressBook in the file with the given name.
+// Files ending in ".json" are written as JSON, files ending in ".vcf" or ".vcard"
+// as vCards and all others in CSV format.
 func (a AddressBook) SaveTo(filename string) error {
 	file, err := os.Create(filename)
 	if err != nil {
@@ -100,25 +207,90 @@ func (a AddressBook) SaveTo(filename string) error {
 	}
 	defer file.Close()
 
-	wrtr := csv.NewWriter(file)
-	slice := a.slice()
-	return wrtr.WriteAll(slice)
+	return a.writeFor(file, filename)
+}
+
+// writeFor writes the AddressBook to w in the format matching filename's extension
+func (a AddressBook) writeFor(w io.Writer, filename string) error {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		return a.WriteJSON(w)
+	case ".vcf", ".vcard":
+		return a.WriteVCard(w)
+	}
+	return a.WriteCSV(w)
+}
+
+// WriteCSV writes the AddressBook in the current CSV format, a header row
+// followed by one row per contact
+func (a AddressBook) WriteCSV(w io.Writer) error {
+	wrtr := csv.NewWriter(w)
+	return wrtr.WriteAll(a.slice())
 }
 
 // Add takes a ThreemaContact and adds it to the AddressBook
 func (a *AddressBook) Add(c ThreemaContact) {
 	id := string(c.ID[:])
-	if a.contacts == nil {
+	if a.book == nil {
 		a.initializeMap(1)
 	}
-	a.contacts[id] = c
+
+	a.book.Lock()
+	prev, known := a.book.contacts[id]
+	a.book.contacts[id] = c
+	a.book.Unlock()
+
+	a.book.watchers.notify(changeEvent(prev, known, c))
+}
+
+// changeEvent returns the ContactEvent describing that c replaced prev, or was added if
+// it was not known before
+func changeEvent(prev ThreemaContact, known bool, c ThreemaContact) ContactEvent {
+	if known && (prev.LPK != c.LPK || (c.KeyChanged && !prev.KeyChanged)) {
+		return ContactEvent{Type: CONTACTKEYCHANGED, Contact: c, Previous: prev}
+	} else if known && prev.Nickname != c.Nickname {
+		return ContactEvent{Type: CONTACTNICKCHANGED, Contact: c, Previous: prev}
+	} else if known {
+		return ContactEvent{Type: CONTACTUPDATED, Contact: c, Previous: prev}
+	}
+	return ContactEvent{Type: CONTACTADDED, Contact: c}
+}
+
+// Put adds or replaces a ThreemaContact. It is the ContactStore equivalent
+// of Add and never fails.
+func (a *AddressBook) Put(c ThreemaContact) error {
+	a.Add(c)
+	return nil
+}
+
+// Delete removes the contact with the given ID from the AddressBook.
+// Deleting an unknown ID is not an error.
+func (a *AddressBook) Delete(id string) error {
+	if a.book == nil {
+		return nil
+	}
+
+	a.book.Lock()
+	prev, known := a.book.contacts[id]
+	delete(a.book.contacts, id)
+	a.book.Unlock()
+
+	if known {
+		a.book.watchers.notify(ContactEvent{Type: CONTACTDELETED, Contact: prev, Previous: prev})
+	}
+	return nil
 }
 
 // Get returns a ThreemaContact to a given ID. It returns an empty ThreemaContact
 // if no entry is found. The second parameter can be used to check if
 // retrieval was successful
 func (a AddressBook) Get(id string) (ThreemaContact, bool) {
-	contact := a.contacts[id]
+	if a.book == nil {
+		return ThreemaContact{}, false
+	}
+	a.book.RLock()
+	contact := a.book.contacts[id]
+	a.book.RUnlock()
 	//checking if an empty ThreemaContact was returned
 	if bytes.Equal(contact.ID[:], []byte{0, 0, 0, 0, 0, 0, 0, 0}) {
 		return contact, false
@@ -126,7 +298,45 @@ func (a AddressBook) Get(id string) (ThreemaContact, bool) {
 	return contact, true
 }
 
-// Contacts returns the map of id strings to contact structs of all contacts in the address book
+// List returns all contacts in the address book ordered by ID
+func (a AddressBook) List() []ThreemaContact {
+	if a.book == nil {
+		return []ThreemaContact{}
+	}
+	a.book.RLock()
+	contacts := make([]ThreemaContact, 0, len(a.book.contacts))
+	for _, contact := range a.book.contacts {
+		contacts = append(contacts, contact)
+	}
+	a.book.RUnlock()
+
+	sort.Slice(contacts, func(i, j int) bool {
+		return bytes.Compare(contacts[i].ID[:], contacts[j].ID[:]) < 0
+	})
+	return contacts
+}
+
+// Watch returns a channel receiving an event for every change made to the
+// AddressBook, and a function to stop watching.
+func (a *AddressBook) Watch() (<-chan ContactEvent, func()) {
+	if a.book == nil {
+		a.initializeMap(0)
+	}
+	return a.book.watchers.add()
+}
+
+// Contacts returns a map of id strings to contact structs of all contacts in the address book.
+// The map is a snapshot; changing it does not affect the address book.
 func (a AddressBook) Contacts() map[string]ThreemaContact {
-	return a.contacts
+	if a.book == nil {
+		return map[string]ThreemaContact{}
+	}
+	a.book.RLock()
+	defer a.book.RUnlock()
+
+	contacts := make(map[string]ThreemaContact, len(a.book.contacts))
+	for id, contact := range a.book.contacts {
+		contacts[id] = contact
+	}
+	return contacts
 }
@@ -0,0 +1,90 @@
+package o3
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAddressBookImportLegacy(t *testing.T) {
+	var ab AddressBook
+	if err := ab.ImportFrom("test/idAlice.ab"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ab.Get("FUA2U3N8"); !ok {
+		t.Error("contact from legacy address book missing")
+	}
+}
+
+func TestAddressBookImportRowErrors(t *testing.T) {
+	key := strings.Repeat("ab", 32)
+	in := "ECHOECHO,Echo," + key + "\n" +
+		"SHORTROW\n" +
+		"BADKEY01,Bad,1234\n" +
+		"OSCAR123,Oscar," + key + "\n"
+
+	var ab AddressBook
+	err := ab.ImportCSV(strings.NewReader(in))
+
+	var importErr *ImportError
+	if !errors.As(err, &importErr) {
+		t.Fatalf("expected *ImportError, got %v", err)
+	}
+	if len(importErr.Rows) != 2 || importErr.Rows[0].Line != 2 || importErr.Rows[1].Line != 3 {
+		t.Errorf("unexpected row errors: %v", importErr)
+	}
+	if n := len(ab.List()); n != 2 {
+		t.Errorf("expected valid rows to be imported, got %d contacts", n)
+	}
+}
+
+func TestAddressBookRoundTrip(t *testing.T) {
+	full := testContact("ECHOECHO", 0x01)
+	full.FirstName = "Echo"
+	full.LastName = "Echoson"
+	full.Nickname = "echo"
+	full.Verification = FULLYVERIFIED
+	full.Features = 0x0f
+	full.KeyFetched = time.Date(2019, 3, 4, 5, 6, 7, 0, time.UTC)
+	full.KeyChanged = true
+	full.ChangedLPK = testContact("ECHOECHO", 0x02).LPK
+
+	blocked := ThreemaContact{ID: NewIDString("SPAMMER1"), Blocked: true}
+
+	ab := NewAddressBook()
+	ab.Add(full)
+	ab.Add(blocked)
+
+	for _, format := range []struct {
+		name  string
+		write func(AddressBook, *bytes.Buffer) error
+		read  func(*AddressBook, *bytes.Buffer) error
+	}{
+		{"csv", func(a AddressBook, b *bytes.Buffer) error { return a.WriteCSV(b) },
+			func(a *AddressBook, b *bytes.Buffer) error { return a.ImportCSV(b) }},
+		{"json", func(a AddressBook, b *bytes.Buffer) error { return a.WriteJSON(b) },
+			func(a *AddressBook, b *bytes.Buffer) error { return a.ImportJSON(b) }},
+	} {
+		var buf bytes.Buffer
+		if err := format.write(ab, &buf); err != nil {
+			t.Fatalf("%s: %s", format.name, err)
+		}
+		var imported AddressBook
+		if err := format.read(&imported, &buf); err != nil {
+			t.Fatalf("%s: %s", format.name, err)
+		}
+		for _, want := range []ThreemaContact{full, blocked} {
+			got, ok := imported.Get(want.String())
+			if !ok || !got.KeyFetched.Equal(want.KeyFetched) {
+				t.Errorf("%s: contact %s not restored: %#v", format.name, want, got)
+				continue
+			}
+			got.KeyFetched = want.KeyFetched
+			if got != want {
+				t.Errorf("%s: contact %s differs:\n got %#v\nwant %#v", format.name, want, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package o3
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AddressBookVersion is the version of the address book format written by WriteCSV
+// and WriteJSON. Version 1 is the legacy headerless CSV format "ID, Name, LPK".
+const AddressBookVersion = 2
+
+// AddressBookColumns are the CSV header names of the current address book format.
+// When importing, columns may appear in any order, unknown columns are ignored
+// and only "id" and "public_key" are required.
+var AddressBookColumns = []string{
+	"id", "name", "public_key", "first_name", "last_name", "nickname",
+	"verification", "feature_mask", "key_fetched", "blocked", "changed_public_key",
+}
+
+// RowError describes an invalid entry found while importing an address book.
+// Line is the 1-based line or, for JSON, the 1-based index of the entry.
+type RowError struct {
+	Line int
+	ID   string
+	Err  error
+}
+
+func (e RowError) Error() string {
+	if e.ID == "" {
+		return fmt.Sprintf("line %d: %s", e.Line, e.Err)
+	}
+	return fmt.Sprintf("line %d (%s): %s", e.Line, e.ID, e.Err)
+}
+
+// ImportError is returned if some entries of an imported address book were invalid.
+// All valid entries have been imported nevertheless.
+type ImportError struct {
+	Rows []RowError
+}
+
+func (e *ImportError) Error() string {
+	msgs := make([]string, len(e.Rows))
+	for i, row := range e.Rows {
+		msgs[i] = row.Error()
+	}
+	return fmt.Sprintf("o3: %d invalid address book entries: %s", len(e.Rows), strings.Join(msgs, "; "))
+}
+
+// contactRecord is the serialized form of a ThreemaContact shared by all formats
+type contactRecord struct {
+	ID               string            `json:"id"`
+	Name             string            `json:"name,omitempty"`
+	PublicKey        string            `json:"public_key,omitempty"`
+	FirstName        string            `json:"first_name,omitempty"`
+	LastName         string            `json:"last_name,omitempty"`
+	Nickname         string            `json:"nickname,omitempty"`
+	Verification     VerificationLevel `json:"verification"`
+	FeatureMask      FeatureMask       `json:"feature_mask,omitempty"`
+	KeyFetched       *time.Time        `json:"key_fetched,omitempty"`
+	Blocked          bool              `json:"blocked,omitempty"`
+	ChangedPublicKey string            `json:"changed_public_key,omitempty"`
+
+	line int
+}
+
+type addressBookJSON struct {
+	Version  int             `json:"version"`
+	Contacts []contactRecord `json:"contacts"`
+}
+
+func newContactRecord(c ThreemaContact) contactRecord {
+	rec := contactRecord{
+		ID:           c.String(),
+		Name:         c.Name,
+		FirstName:    c.FirstName,
+		LastName:     c.LastName,
+		Nickname:     c.Nickname,
+		Verification: c.Verification,
+		FeatureMask:  c.Features,
+		Blocked:      c.Blocked,
+	}
+	if c.hasKey() {
+		rec.PublicKey = hex.EncodeToString(c.LPK[:])
+	}
+	if !c.KeyFetched.IsZero() {
+		t := c.KeyFetched.UTC()
+		rec.KeyFetched = &t
+	}
+	if c.KeyChanged {
+		rec.ChangedPublicKey = hex.EncodeToString(c.ChangedLPK[:])
+	}
+	return rec
+}
+
+// contact validates the record and converts it to a ThreemaContact
+func (rec contactRecord) contact() (ThreemaContact, error) {
+	if !validIDString(rec.ID) {
+		return ThreemaContact{}, fmt.Errorf("invalid ID: %q", rec.ID)
+	}
+	if rec.Verification > FULLYVERIFIED {
+		return ThreemaContact{}, fmt.Errorf("invalid verification level: %d", rec.Verification)
+	}
+
+	contact := ThreemaContact{
+		ID:           NewIDString(rec.ID),
+		Name:         rec.Name,
+		FirstName:    rec.FirstName,
+		LastName:     rec.LastName,
+		Nickname:     rec.Nickname,
+		Verification: rec.Verification,
+		Features:     rec.FeatureMask,
+		Blocked:      rec.Blocked,
+	}
+
+	if rec.PublicKey == "" && !rec.Blocked {
+		return ThreemaContact{}, errors.New("missing public key")
+	} else if rec.PublicKey != "" {
+		if err := decodeKey(rec.PublicKey, &contact.LPK); err != nil {
+			return ThreemaContact{}, fmt.Errorf("invalid public key: %s", err)
+		}
+	}
+	if rec.ChangedPublicKey != "" {
+		if err := decodeKey(rec.ChangedPublicKey, &contact.ChangedLPK); err != nil {
+			return ThreemaContact{}, fmt.Errorf("invalid changed public key: %s", err)
+		}
+		contact.KeyChanged = true
+	}
+	if rec.KeyFetched != nil {
+		contact.KeyFetched = *rec.KeyFetched
+	}
+	return contact, nil
+}
+
+func decodeKey(s string, key *[32]byte) error {
+	raw, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return err
+	}
+	if len(raw) != 32 {
+		return fmt.Errorf("length %d instead of 32 bytes", len(raw))
+	}
+	copy(key[:], raw)
+	return nil
+}
+
+// recordsFromRows converts CSV rows to contactRecords. Rows that cannot even be
+// converted are returned as RowErrors.
+func recordsFromRows(rows [][]string) ([]contactRecord, []RowError) {
+	if len(rows) > 0 && len(rows[0]) > 0 && strings.EqualFold(strings.TrimSpace(rows[0][0]), "id") {
+		return recordsFromHeaderRows(rows[0], rows[1:])
+	}
+
+	// legacy format version 1
+	records := make([]contactRecord, 0, len(rows))
+	var rowErrs []RowError
+	for l, row := range rows {
+		if len(row) < 3 {
+			rowErrs = append(rowErrs, RowError{Line: l + 1, Err: fmt.Errorf("expected 3 fields, got %d", len(row))})
+			continue
+		}
+		records = append(records, contactRecord{ID: row[0], Name: row[1], PublicKey: row[2], line: l + 1})
+	}
+	return records, rowErrs
+}
+
+func recordsFromHeaderRows(header []string, rows [][]string) ([]contactRecord, []RowError) {
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+
+	records := make([]contactRecord, 0, len(rows))
+	var rowErrs []RowError
+	for l, row := range rows {
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(row) {
+				return strings.TrimSpace(row[i])
+			}
+			return ""
+		}
+
+		rec := contactRecord{
+			ID:               field("id"),
+			Name:             field("name"),
+			PublicKey:        field("public_key"),
+			FirstName:        field("first_name"),
+			LastName:         field("last_name"),
+			Nickname:         field("nickname"),
+			ChangedPublicKey: field("changed_public_key"),
+			// the header is line 1
+			line: l + 2,
+		}
+
+		err := parseRecordFields(&rec, field("verification"), field("feature_mask"), field("key_fetched"), field("blocked"))
+		if err != nil {
+			rowErrs = append(rowErrs, RowError{Line: rec.line, ID: rec.ID, Err: err})
+			continue
+		}
+		records = append(records, rec)
+	}
+	return records, rowErrs
+}
+
+// parseRecordFields parses the non-string CSV fields of a record; empty fields keep their zero value
+func parseRecordFields(rec *contactRecord, verification, featureMask, keyFetched, blocked string) error {
+	if verification != "" {
+		v, err := strconv.ParseUint(verification, 10, 8)
+		if err != nil {
+			return fmt.Errorf("invalid verification level: %q", verification)
+		}
+		rec.Verification = VerificationLevel(v)
+	}
+	if featureMask != "" {
+		f, err := strconv.ParseUint(featureMask, 0, 64)
+		if err != nil {
+			return fmt.Errorf("invalid feature mask: %q", featureMask)
+		}
+		rec.FeatureMask = FeatureMask(f)
+	}
+	if keyFetched != "" {
+		t, err := time.Parse(time.RFC3339, keyFetched)
+		if err != nil {
+			return fmt.Errorf("invalid key fetch time: %q", keyFetched)
+		}
+		rec.KeyFetched = &t
+	}
+	if blocked != "" {
+		b, err := strconv.ParseBool(blocked)
+		if err != nil {
+			return fmt.Errorf("invalid blocked state: %q", blocked)
+		}
+		rec.Blocked = b
+	}
+	return nil
+}
+
+// slice returns the address book as CSV rows including the header
+func (a AddressBook) slice() [][]string {
+	contacts := a.List()
+	buf := make([][]string, 0, len(contacts)+1)
+	buf = append(buf, AddressBookColumns)
+	for _, contact := range contacts {
+		rec := newContactRecord(contact)
+		keyFetched := ""
+		if rec.KeyFetched != nil {
+			keyFetched = rec.KeyFetched.Format(time.RFC3339)
+		}
+		buf = append(buf, []string{
+			rec.ID,
+			rec.Name,
+			rec.PublicKey,
+			rec.FirstName,
+			rec.LastName,
+			rec.Nickname,
+			strconv.Itoa(int(rec.Verification)),
+			strconv.FormatUint(uint64(rec.FeatureMask), 10),
+			keyFetched,
+			strconv.FormatBool(rec.Blocked),
+			rec.ChangedPublicKey,
+		})
+	}
+	return buf
+}
+
+// ImportJSON imports an address book in JSON format, replacing its previous content.
+// Invalid entries are skipped and reported in an *ImportError.
+func (a *AddressBook) ImportJSON(r io.Reader) error {
+	var doc addressBookJSON
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return err
+	}
+	if doc.Version > AddressBookVersion {
+		return fmt.Errorf("o3: unsupported address book version %d", doc.Version)
+	}
+	for i := range doc.Contacts {
+		doc.Contacts[i].line = i + 1
+	}
+	return a.importRecords(doc.Contacts, nil)
+}
+
+// WriteJSON writes the AddressBook in JSON format
+func (a AddressBook) WriteJSON(w io.Writer) error {
+	contacts := a.List()
+	doc := addressBookJSON{
+		Version:  AddressBookVersion,
+		Contacts: make([]contactRecord, len(contacts)),
+	}
+	for i, contact := range contacts {
+		doc.Contacts[i] = newContactRecord(contact)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
@@ -0,0 +1,395 @@
+package o3
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Default URLs of Threema's blob servers. {blobId} is replaced by the hex encoded blob ID
+// and {blobIdPrefix} by its first byte.
+const (
+	DefaultBlobUploadURL   = "https://upload.blob.threema.ch/upload"
+	DefaultBlobDownloadURL = "https://{blobIdPrefix}.blob.threema.ch/{blobId}"
+	DefaultBlobDoneURL     = "https://{blobIdPrefix}.blob.threema.ch/{blobId}/done"
+)
+
+// DefaultMaxBlobSize is the largest blob accepted by an HTTPBlobStore without MaxBlobSize
+const DefaultMaxBlobSize = 100 << 20
+
+// ErrBlobNotFound is returned if a blob does not exist (anymore)
+var ErrBlobNotFound = errors.New("o3: blob not found")
+
+// ErrBlobTooLarge is returned if a blob exceeds the maximum size of a BlobStore
+var ErrBlobTooLarge = errors.New("o3: blob exceeds maximum size")
+
+// BlobStore stores the encrypted blobs media messages refer to. Implementations report
+// progress to the callback attached to ctx with WithBlobProgress.
+type BlobStore interface {
+	// Upload stores the size bytes read from blob and returns the ID assigned to them
+	Upload(ctx context.Context, blob io.Reader, size int64) ([16]byte, error)
+	// Download writes the blob with the given ID to w and returns the number of bytes
+	// written
+	Download(ctx context.Context, blobID [16]byte, w io.Writer) (int64, error)
+	// MarkDone tells the store that the blob has been downloaded by its recipient and
+	// may be deleted
+	MarkDone(ctx context.Context, blobID [16]byte) error
+}
+
+// BlobProgress is called while a blob is transferred with the number of bytes done so
+// far and the total size, which is -1 if unknown
+type BlobProgress func(done, total int64)
+
+type blobProgressKey struct{}
+
+// WithBlobProgress returns a context reporting the progress of blob transfers made with
+// it to progress
+func WithBlobProgress(ctx context.Context, progress BlobProgress) context.Context {
+	return context.WithValue(ctx, blobProgressKey{}, progress)
+}
+
+// blobProgressFrom returns the progress callback of ctx or a no-op
+func blobProgressFrom(ctx context.Context) BlobProgress {
+	if progress, ok := ctx.Value(blobProgressKey{}).(BlobProgress); ok && progress != nil {
+		return progress
+	}
+	return func(done, total int64) {}
+}
+
+// progressReader reports the bytes read from r
+type progressReader struct {
+	r        io.Reader
+	done     int64
+	total    int64
+	progress BlobProgress
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	if n > 0 {
+		pr.done += int64(n)
+		pr.progress(pr.done, pr.total)
+	}
+	return n, err
+}
+
+// progressWriter reports the bytes written to w. err keeps the first write error so
+// it can be told apart from network errors.
+type progressWriter struct {
+	w        io.Writer
+	done     int64
+	total    int64
+	progress BlobProgress
+	err      error
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	n, err := pw.w.Write(p)
+	if err != nil && pw.err == nil {
+		pw.err = err
+	}
+	if n > 0 {
+		pw.done += int64(n)
+		pw.progress(pw.done, pw.total)
+	}
+	return n, err
+}
+
+// maxBlobSize returns the maximum blob size of store
+func maxBlobSize(store BlobStore) int64 {
+	if limited, ok := store.(interface{ MaxSize() int64 }); ok {
+		return limited.MaxSize()
+	}
+	return DefaultMaxBlobSize
+}
+
+// BlobError is returned if a blob server rejects a request
+type BlobError struct {
+	Op         string
+	BlobID     [16]byte
+	StatusCode int
+}
+
+func (e *BlobError) Error() string {
+	if e.Op == "upload" {
+		return fmt.Sprintf("o3: blob upload failed (HTTP %d)", e.StatusCode)
+	}
+	return fmt.Sprintf("o3: blob %s of %x failed (HTTP %d)", e.Op, e.BlobID, e.StatusCode)
+}
+
+// Is makes errors.Is report a BlobError with status 404 as ErrBlobNotFound
+func (e *BlobError) Is(target error) bool {
+	return target == ErrBlobNotFound && e.StatusCode == http.StatusNotFound
+}
+
+// HTTPBlobStore is a BlobStore talking to blob servers over HTTPS. The zero value uses
+// Threema's servers and a client trusting the system roots; use NewHTTPBlobStore to
+// trust Threema's CA.
+type HTTPBlobStore struct {
+	// UploadURL, DownloadURL and DoneURL are the endpoints of the blob server, see
+	// DefaultBlobUploadURL, DefaultBlobDownloadURL and DefaultBlobDoneURL which are
+	// used if they are empty
+	UploadURL   string
+	DownloadURL string
+	DoneURL     string
+	// Client is used for all requests. Share one client between stores so connections
+	// are pooled; see NewHTTPClient for custom TLS roots. A client with a total timeout
+	// aborts transfers of large blobs, limit them with the context instead.
+	Client *http.Client
+	// UserAgent is sent with all requests, "Threema/2.8" if empty
+	UserAgent string
+	// MaxBlobSize limits the size of uploaded and downloaded blobs, DefaultMaxBlobSize
+	// if zero
+	MaxBlobSize int64
+	// Retries is how often an interrupted download is resumed before giving up
+	Retries int
+	// RetryDelay is the pause before the first retry, doubled for every further one.
+	// One second if zero.
+	RetryDelay time.Duration
+}
+
+var threemaCert = []byte{0x2d, 0x2d, 0x2d, 0x2d, 0x2d, 0x42, 0x45, 0x47, 0x49, 0x4e, 0x20, 0x43, 0x45, 0x52, 0x54, 0x49, 0x46, 0x49, 0x43, 0x41, 0x54, 0x45, 0x2d, 0x2d, 0x2d, 0x2d, 0x2d, 0xa, 0x4d, 0x49, 0x49, 0x45, 0x59, 0x54, 0x43, 0x43, 0x41, 0x30, 0x6d, 0x67, 0x41, 0x77, 0x49, 0x42, 0x41, 0x67, 0x49, 0x4a, 0x41, 0x4d, 0x31, 0x44, 0x52, 0x2f, 0x44, 0x42, 0x52, 0x46, 0x70, 0x51, 0x4d, 0x41, 0x30, 0x47, 0x43, 0x53, 0x71, 0x47, 0x53, 0x49, 0x62, 0x33, 0x44, 0x51, 0x45, 0x42, 0x42, 0x51, 0x55, 0x41, 0x4d, 0x48, 0x30, 0x78, 0x43, 0x7a, 0x41, 0x4a, 0x42, 0x67, 0x4e, 0x56, 0xa, 0x42, 0x41, 0x59, 0x54, 0x41, 0x6b, 0x4e, 0x49, 0x4d, 0x51, 0x73, 0x77, 0x43, 0x51, 0x59, 0x44, 0x56, 0x51, 0x51, 0x49, 0x45, 0x77, 0x4a, 0x61, 0x53, 0x44, 0x45, 0x50, 0x4d, 0x41, 0x30, 0x47, 0x41, 0x31, 0x55, 0x45, 0x42, 0x78, 0x4d, 0x47, 0x57, 0x6e, 0x56, 0x79, 0x61, 0x57, 0x4e, 0x6f, 0x4d, 0x52, 0x41, 0x77, 0x44, 0x67, 0x59, 0x44, 0x56, 0x51, 0x51, 0x4b, 0x45, 0x77, 0x64, 0x55, 0xa, 0x61, 0x48, 0x4a, 0x6c, 0x5a, 0x57, 0x31, 0x68, 0x4d, 0x51, 0x73, 0x77, 0x43, 0x51, 0x59, 0x44, 0x56, 0x51, 0x51, 0x4c, 0x45, 0x77, 0x4a, 0x44, 0x51, 0x54, 0x45, 0x54, 0x4d, 0x42, 0x45, 0x47, 0x41, 0x31, 0x55, 0x45, 0x41, 0x78, 0x4d, 0x4b, 0x56, 0x47, 0x68, 0x79, 0x5a, 0x57, 0x56, 0x74, 0x59, 0x53, 0x42, 0x44, 0x51, 0x54, 0x45, 0x63, 0x4d, 0x42, 0x6f, 0x47, 0x43, 0x53, 0x71, 0x47, 0xa, 0x53, 0x49, 0x62, 0x33, 0x44, 0x51, 0x45, 0x4a, 0x41, 0x52, 0x59, 0x4e, 0x59, 0x32, 0x46, 0x41, 0x64, 0x47, 0x68, 0x79, 0x5a, 0x57, 0x56, 0x74, 0x59, 0x53, 0x35, 0x6a, 0x61, 0x44, 0x41, 0x65, 0x46, 0x77, 0x30, 0x78, 0x4d, 0x6a, 0x45, 0x78, 0x4d, 0x54, 0x4d, 0x78, 0x4d, 0x54, 0x55, 0x34, 0x4e, 0x54, 0x68, 0x61, 0x46, 0x77, 0x30, 0x7a, 0x4d, 0x6a, 0x45, 0x78, 0x4d, 0x44, 0x67, 0x78, 0xa, 0x4d, 0x54, 0x55, 0x34, 0x4e, 0x54, 0x68, 0x61, 0x4d, 0x48, 0x30, 0x78, 0x43, 0x7a, 0x41, 0x4a, 0x42, 0x67, 0x4e, 0x56, 0x42, 0x41, 0x59, 0x54, 0x41, 0x6b, 0x4e, 0x49, 0x4d, 0x51, 0x73, 0x77, 0x43, 0x51, 0x59, 0x44, 0x56, 0x51, 0x51, 0x49, 0x45, 0x77, 0x4a, 0x61, 0x53, 0x44, 0x45, 0x50, 0x4d, 0x41, 0x30, 0x47, 0x41, 0x31, 0x55, 0x45, 0x42, 0x78, 0x4d, 0x47, 0x57, 0x6e, 0x56, 0x79, 0xa, 0x61, 0x57, 0x4e, 0x6f, 0x4d, 0x52, 0x41, 0x77, 0x44, 0x67, 0x59, 0x44, 0x56, 0x51, 0x51, 0x4b, 0x45, 0x77, 0x64, 0x55, 0x61, 0x48, 0x4a, 0x6c, 0x5a, 0x57, 0x31, 0x68, 0x4d, 0x51, 0x73, 0x77, 0x43, 0x51, 0x59, 0x44, 0x56, 0x51, 0x51, 0x4c, 0x45, 0x77, 0x4a, 0x44, 0x51, 0x54, 0x45, 0x54, 0x4d, 0x42, 0x45, 0x47, 0x41, 0x31, 0x55, 0x45, 0x41, 0x78, 0x4d, 0x4b, 0x56, 0x47, 0x68, 0x79, 0xa, 0x5a, 0x57, 0x56, 0x74, 0x59, 0x53, 0x42, 0x44, 0x51, 0x54, 0x45, 0x63, 0x4d, 0x42, 0x6f, 0x47, 0x43, 0x53, 0x71, 0x47, 0x53, 0x49, 0x62, 0x33, 0x44, 0x51, 0x45, 0x4a, 0x41, 0x52, 0x59, 0x4e, 0x59, 0x32, 0x46, 0x41, 0x64, 0x47, 0x68, 0x79, 0x5a, 0x57, 0x56, 0x74, 0x59, 0x53, 0x35, 0x6a, 0x61, 0x44, 0x43, 0x43, 0x41, 0x53, 0x49, 0x77, 0x44, 0x51, 0x59, 0x4a, 0x4b, 0x6f, 0x5a, 0x49, 0xa, 0x68, 0x76, 0x63, 0x4e, 0x41, 0x51, 0x45, 0x42, 0x42, 0x51, 0x41, 0x44, 0x67, 0x67, 0x45, 0x50, 0x41, 0x44, 0x43, 0x43, 0x41, 0x51, 0x6f, 0x43, 0x67, 0x67, 0x45, 0x42, 0x41, 0x4b, 0x38, 0x47, 0x64, 0x6f, 0x54, 0x37, 0x49, 0x70, 0x4e, 0x43, 0x33, 0x44, 0x7a, 0x37, 0x49, 0x55, 0x47, 0x59, 0x57, 0x39, 0x70, 0x4f, 0x42, 0x77, 0x78, 0x2b, 0x39, 0x45, 0x6e, 0x44, 0x5a, 0x72, 0x6b, 0x4e, 0xa, 0x56, 0x44, 0x38, 0x6c, 0x33, 0x4b, 0x66, 0x42, 0x48, 0x6a, 0x47, 0x54, 0x64, 0x69, 0x39, 0x67, 0x51, 0x36, 0x4e, 0x68, 0x2b, 0x6d, 0x51, 0x39, 0x2f, 0x79, 0x51, 0x38, 0x32, 0x35, 0x34, 0x54, 0x32, 0x62, 0x69, 0x67, 0x39, 0x70, 0x30, 0x68, 0x63, 0x6e, 0x38, 0x6b, 0x6a, 0x67, 0x45, 0x51, 0x67, 0x4a, 0x57, 0x48, 0x70, 0x4e, 0x68, 0x59, 0x6e, 0x4f, 0x68, 0x79, 0x33, 0x69, 0x30, 0x6a, 0xa, 0x63, 0x6d, 0x6c, 0x7a, 0x62, 0x31, 0x4d, 0x46, 0x2f, 0x64, 0x65, 0x46, 0x6a, 0x4a, 0x56, 0x74, 0x75, 0x4d, 0x50, 0x33, 0x74, 0x71, 0x54, 0x77, 0x69, 0x4d, 0x61, 0x76, 0x70, 0x77, 0x65, 0x6f, 0x61, 0x32, 0x30, 0x6c, 0x47, 0x44, 0x6e, 0x2f, 0x43, 0x4c, 0x5a, 0x6f, 0x64, 0x75, 0x30, 0x52, 0x61, 0x38, 0x6f, 0x4c, 0x37, 0x38, 0x62, 0x36, 0x46, 0x56, 0x7a, 0x74, 0x4e, 0x6b, 0x57, 0x67, 0xa, 0x50, 0x64, 0x69, 0x57, 0x43, 0x6c, 0x4d, 0x6b, 0x30, 0x4a, 0x50, 0x50, 0x4d, 0x6c, 0x66, 0x4c, 0x45, 0x69, 0x4b, 0x38, 0x68, 0x66, 0x48, 0x45, 0x2b, 0x36, 0x6d, 0x52, 0x56, 0x58, 0x6d, 0x69, 0x31, 0x32, 0x69, 0x74, 0x4b, 0x31, 0x73, 0x65, 0x6d, 0x6d, 0x77, 0x79, 0x48, 0x4b, 0x64, 0x6a, 0x39, 0x66, 0x47, 0x34, 0x58, 0x39, 0x2b, 0x72, 0x51, 0x32, 0x73, 0x4b, 0x75, 0x4c, 0x66, 0x65, 0xa, 0x6a, 0x78, 0x37, 0x75, 0x46, 0x78, 0x6e, 0x41, 0x46, 0x2b, 0x47, 0x69, 0x76, 0x43, 0x75, 0x43, 0x6f, 0x38, 0x78, 0x66, 0x4f, 0x65, 0x73, 0x4c, 0x77, 0x37, 0x32, 0x76, 0x78, 0x2b, 0x57, 0x37, 0x6d, 0x6d, 0x64, 0x59, 0x73, 0x68, 0x67, 0x2f, 0x6c, 0x58, 0x4f, 0x63, 0x71, 0x76, 0x73, 0x7a, 0x51, 0x51, 0x2f, 0x4c, 0x6d, 0x46, 0x45, 0x56, 0x51, 0x59, 0x78, 0x4e, 0x61, 0x65, 0x65, 0x56, 0xa, 0x6e, 0x50, 0x53, 0x41, 0x73, 0x2b, 0x68, 0x74, 0x38, 0x76, 0x55, 0x50, 0x57, 0x34, 0x73, 0x58, 0x39, 0x49, 0x6b, 0x58, 0x4b, 0x56, 0x67, 0x42, 0x4a, 0x64, 0x31, 0x52, 0x31, 0x69, 0x73, 0x55, 0x70, 0x6f, 0x46, 0x36, 0x64, 0x4b, 0x6c, 0x55, 0x65, 0x78, 0x6d, 0x76, 0x4c, 0x78, 0x45, 0x79, 0x66, 0x35, 0x63, 0x43, 0x41, 0x77, 0x45, 0x41, 0x41, 0x61, 0x4f, 0x42, 0x34, 0x7a, 0x43, 0x42, 0xa, 0x34, 0x44, 0x41, 0x64, 0x42, 0x67, 0x4e, 0x56, 0x48, 0x51, 0x34, 0x45, 0x46, 0x67, 0x51, 0x55, 0x77, 0x36, 0x4c, 0x61, 0x43, 0x37, 0x2b, 0x4a, 0x36, 0x32, 0x72, 0x4b, 0x64, 0x61, 0x54, 0x41, 0x33, 0x37, 0x6b, 0x41, 0x59, 0x59, 0x55, 0x62, 0x72, 0x6b, 0x67, 0x77, 0x67, 0x62, 0x41, 0x47, 0x41, 0x31, 0x55, 0x64, 0x49, 0x77, 0x53, 0x42, 0x71, 0x44, 0x43, 0x42, 0x70, 0x59, 0x41, 0x55, 0xa, 0x77, 0x36, 0x4c, 0x61, 0x43, 0x37, 0x2b, 0x4a, 0x36, 0x32, 0x72, 0x4b, 0x64, 0x61, 0x54, 0x41, 0x33, 0x37, 0x6b, 0x41, 0x59, 0x59, 0x55, 0x62, 0x72, 0x6b, 0x69, 0x68, 0x67, 0x59, 0x47, 0x6b, 0x66, 0x7a, 0x42, 0x39, 0x4d, 0x51, 0x73, 0x77, 0x43, 0x51, 0x59, 0x44, 0x56, 0x51, 0x51, 0x47, 0x45, 0x77, 0x4a, 0x44, 0x53, 0x44, 0x45, 0x4c, 0x4d, 0x41, 0x6b, 0x47, 0x41, 0x31, 0x55, 0x45, 0xa, 0x43, 0x42, 0x4d, 0x43, 0x57, 0x6b, 0x67, 0x78, 0x44, 0x7a, 0x41, 0x4e, 0x42, 0x67, 0x4e, 0x56, 0x42, 0x41, 0x63, 0x54, 0x42, 0x6c, 0x70, 0x31, 0x63, 0x6d, 0x6c, 0x6a, 0x61, 0x44, 0x45, 0x51, 0x4d, 0x41, 0x34, 0x47, 0x41, 0x31, 0x55, 0x45, 0x43, 0x68, 0x4d, 0x48, 0x56, 0x47, 0x68, 0x79, 0x5a, 0x57, 0x56, 0x74, 0x59, 0x54, 0x45, 0x4c, 0x4d, 0x41, 0x6b, 0x47, 0x41, 0x31, 0x55, 0x45, 0xa, 0x43, 0x78, 0x4d, 0x43, 0x51, 0x30, 0x45, 0x78, 0x45, 0x7a, 0x41, 0x52, 0x42, 0x67, 0x4e, 0x56, 0x42, 0x41, 0x4d, 0x54, 0x43, 0x6c, 0x52, 0x6f, 0x63, 0x6d, 0x56, 0x6c, 0x62, 0x57, 0x45, 0x67, 0x51, 0x30, 0x45, 0x78, 0x48, 0x44, 0x41, 0x61, 0x42, 0x67, 0x6b, 0x71, 0x68, 0x6b, 0x69, 0x47, 0x39, 0x77, 0x30, 0x42, 0x43, 0x51, 0x45, 0x57, 0x44, 0x57, 0x4e, 0x68, 0x51, 0x48, 0x52, 0x6f, 0xa, 0x63, 0x6d, 0x56, 0x6c, 0x62, 0x57, 0x45, 0x75, 0x59, 0x32, 0x69, 0x43, 0x43, 0x51, 0x44, 0x4e, 0x51, 0x30, 0x66, 0x77, 0x77, 0x55, 0x52, 0x61, 0x55, 0x44, 0x41, 0x4d, 0x42, 0x67, 0x4e, 0x56, 0x48, 0x52, 0x4d, 0x45, 0x42, 0x54, 0x41, 0x44, 0x41, 0x51, 0x48, 0x2f, 0x4d, 0x41, 0x30, 0x47, 0x43, 0x53, 0x71, 0x47, 0x53, 0x49, 0x62, 0x33, 0x44, 0x51, 0x45, 0x42, 0x42, 0x51, 0x55, 0x41, 0xa, 0x41, 0x34, 0x49, 0x42, 0x41, 0x51, 0x41, 0x52, 0x48, 0x4d, 0x79, 0x49, 0x48, 0x42, 0x44, 0x46, 0x75, 0x6c, 0x2b, 0x68, 0x76, 0x6a, 0x41, 0x43, 0x74, 0x36, 0x72, 0x30, 0x45, 0x41, 0x48, 0x59, 0x77, 0x52, 0x39, 0x47, 0x51, 0x53, 0x67, 0x68, 0x49, 0x51, 0x73, 0x66, 0x48, 0x74, 0x38, 0x63, 0x79, 0x56, 0x63, 0x7a, 0x6d, 0x45, 0x6e, 0x4a, 0x48, 0x39, 0x68, 0x72, 0x76, 0x68, 0x39, 0x51, 0xa, 0x56, 0x69, 0x76, 0x6d, 0x37, 0x6d, 0x72, 0x66, 0x76, 0x65, 0x69, 0x68, 0x6d, 0x4e, 0x58, 0x41, 0x6e, 0x34, 0x57, 0x6c, 0x47, 0x77, 0x51, 0x2b, 0x41, 0x43, 0x75, 0x56, 0x74, 0x54, 0x4c, 0x78, 0x77, 0x38, 0x45, 0x72, 0x62, 0x53, 0x54, 0x37, 0x49, 0x4d, 0x41, 0x4f, 0x78, 0x39, 0x6e, 0x70, 0x48, 0x66, 0x2f, 0x6b, 0x6e, 0x67, 0x6e, 0x5a, 0x34, 0x6e, 0x53, 0x77, 0x55, 0x52, 0x46, 0x39, 0xa, 0x72, 0x43, 0x45, 0x79, 0x48, 0x71, 0x31, 0x37, 0x39, 0x70, 0x4e, 0x58, 0x70, 0x4f, 0x7a, 0x5a, 0x32, 0x35, 0x37, 0x45, 0x35, 0x72, 0x30, 0x61, 0x76, 0x4d, 0x4e, 0x4e, 0x58, 0x58, 0x44, 0x77, 0x75, 0x6c, 0x77, 0x30, 0x33, 0x69, 0x42, 0x45, 0x32, 0x31, 0x65, 0x62, 0x64, 0x30, 0x30, 0x70, 0x47, 0x31, 0x31, 0x47, 0x56, 0x71, 0x2f, 0x49, 0x32, 0x36, 0x73, 0x2b, 0x38, 0x42, 0x6a, 0x6e, 0xa, 0x44, 0x4b, 0x52, 0x50, 0x71, 0x75, 0x4b, 0x72, 0x53, 0x4f, 0x34, 0x2f, 0x6c, 0x75, 0x45, 0x44, 0x76, 0x4c, 0x34, 0x6e, 0x67, 0x69, 0x51, 0x6a, 0x5a, 0x70, 0x33, 0x32, 0x53, 0x39, 0x5a, 0x31, 0x4b, 0x39, 0x73, 0x56, 0x4f, 0x7a, 0x71, 0x74, 0x51, 0x37, 0x49, 0x39, 0x7a, 0x7a, 0x65, 0x55, 0x41, 0x44, 0x6d, 0x33, 0x61, 0x56, 0x61, 0x2f, 0x42, 0x70, 0x61, 0x77, 0x34, 0x69, 0x4d, 0x52, 0xa, 0x31, 0x53, 0x49, 0x37, 0x6f, 0x39, 0x61, 0x4a, 0x59, 0x69, 0x52, 0x69, 0x31, 0x67, 0x78, 0x59, 0x50, 0x32, 0x42, 0x55, 0x41, 0x31, 0x49, 0x46, 0x71, 0x72, 0x38, 0x4e, 0x7a, 0x79, 0x66, 0x47, 0x44, 0x37, 0x74, 0x52, 0x48, 0x64, 0x71, 0x37, 0x62, 0x5a, 0x4f, 0x78, 0x58, 0x41, 0x6c, 0x75, 0x76, 0x38, 0x31, 0x64, 0x63, 0x62, 0x7a, 0x30, 0x53, 0x42, 0x58, 0x38, 0x53, 0x67, 0x56, 0x31, 0xa, 0x34, 0x48, 0x45, 0x4b, 0x63, 0x36, 0x78, 0x4d, 0x41, 0x4e, 0x6e, 0x59, 0x73, 0x2f, 0x61, 0x59, 0x4b, 0x6a, 0x76, 0x6d, 0x50, 0x30, 0x56, 0x70, 0x4f, 0x76, 0x52, 0x55, 0xa, 0x2d, 0x2d, 0x2d, 0x2d, 0x2d, 0x45, 0x4e, 0x44, 0x20, 0x43, 0x45, 0x52, 0x54, 0x49, 0x46, 0x49, 0x43, 0x41, 0x54, 0x45, 0x2d, 0x2d, 0x2d, 0x2d, 0x2d, 0xa}
+
+// threemaCertPool returns a pool containing only Threema's CA certificate
+func threemaCertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(threemaCert)
+	return pool
+}
+
+// threemaBlobClient is the client shared by all blob stores trusting Threema's CA
+var threemaBlobClient = NewHTTPClient(threemaCertPool(), 0)
+
+// systemBlobClient is used by blob stores without a Client. Like threemaBlobClient it
+// has no total timeout so large blobs are not cut off; use the context to limit transfers.
+var systemBlobClient = NewHTTPClient(nil, 0)
+
+// defaultBlobStore is used by sessions without a BlobStore
+var defaultBlobStore BlobStore = NewHTTPBlobStore(nil)
+
+// NewHTTPBlobStore returns an HTTPBlobStore for Threema's blob servers resuming
+// interrupted downloads three times. Its client trusts the certificates in roots, or
+// only Threema's CA if roots is nil. Stores created with nil roots share one client.
+func NewHTTPBlobStore(roots *x509.CertPool) *HTTPBlobStore {
+	client := threemaBlobClient
+	if roots != nil {
+		client = NewHTTPClient(roots, 0)
+	}
+	return &HTTPBlobStore{Client: client, Retries: 3}
+}
+
+// blobs returns the BlobStore used by the session
+func (sc *SessionContext) blobs() BlobStore {
+	if sc.Blobs != nil {
+		return sc.Blobs
+	}
+	return defaultBlobStore
+}
+
+func (hs *HTTPBlobStore) client() *http.Client {
+	if hs.Client != nil {
+		return hs.Client
+	}
+	return systemBlobClient
+}
+
+// blobURL fills in the placeholders of an URL template
+func blobURL(template, fallback string, blobID [16]byte) string {
+	if template == "" {
+		template = fallback
+	}
+	return strings.NewReplacer(
+		"{blobIdPrefix}", hex.EncodeToString(blobID[:1]),
+		"{blobId}", hex.EncodeToString(blobID[:])).Replace(template)
+}
+
+func (hs *HTTPBlobStore) newRequest(ctx context.Context, method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	userAgent := hs.UserAgent
+	if userAgent == "" {
+		userAgent = "Threema/2.8"
+	}
+	req.Header.Set("User-Agent", userAgent)
+	return req, nil
+}
+
+// MaxSize returns the maximum size of a blob in the store
+func (hs *HTTPBlobStore) MaxSize() int64 {
+	if hs.MaxBlobSize > 0 {
+		return hs.MaxBlobSize
+	}
+	return DefaultMaxBlobSize
+}
+
+// Upload streams a blob to the server as multipart form and returns the ID assigned by
+// the server
+func (hs *HTTPBlobStore) Upload(ctx context.Context, blob io.Reader, size int64) ([16]byte, error) {
+	if size > hs.MaxSize() {
+		return [16]byte{}, ErrBlobTooLarge
+	}
+
+	// the form is assembled around blob so the upload does not have to be buffered and
+	// the server learns its length in advance
+	var head, tail bytes.Buffer
+	multipartWriter := multipart.NewWriter(&head)
+	if _, err := multipartWriter.CreateFormFile("blob", "blob.bin"); err != nil {
+		return [16]byte{}, err
+	}
+	headLen := head.Len()
+	if err := multipartWriter.Close(); err != nil {
+		return [16]byte{}, err
+	}
+	tail.Write(head.Bytes()[headLen:])
+	head.Truncate(headLen)
+
+	body := &progressReader{
+		r:        io.LimitReader(blob, size),
+		total:    size,
+		progress: blobProgressFrom(ctx)}
+
+	url := hs.UploadURL
+	if url == "" {
+		url = DefaultBlobUploadURL
+	}
+	req, err := hs.newRequest(ctx, http.MethodPost, url, io.MultiReader(&head, body, &tail))
+	if err != nil {
+		return [16]byte{}, err
+	}
+	req.ContentLength = int64(head.Len()) + size + int64(tail.Len())
+	req.Header.Set("Content-Type", multipartWriter.FormDataContentType())
+
+	resp, err := hs.client().Do(req)
+	if err != nil {
+		return [16]byte{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return [16]byte{}, &BlobError{Op: "upload", StatusCode: resp.StatusCode}
+	}
+
+	blobIDraw, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64))
+	if err != nil {
+		return [16]byte{}, err
+	}
+	blobIDbytes, err := hex.DecodeString(strings.TrimSpace(string(blobIDraw)))
+	if err != nil || len(blobIDbytes) != 16 {
+		return [16]byte{}, fmt.Errorf("o3: blob server returned invalid blob ID %q", blobIDraw)
+	}
+
+	var blobID [16]byte
+	copy(blobID[:], blobIDbytes)
+	return blobID, nil
+}
+
+// Download streams the blob with the given ID to w. Blobs larger than MaxSize are
+// rejected. If the connection breaks the download is resumed where it stopped, up to
+// Retries times.
+func (hs *HTTPBlobStore) Download(ctx context.Context, blobID [16]byte, w io.Writer) (int64, error) {
+	pw := &progressWriter{w: w, total: -1, progress: blobProgressFrom(ctx)}
+	delay := hs.RetryDelay
+	if delay <= 0 {
+		delay = time.Second
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := hs.download(ctx, blobID, pw)
+		if err == nil {
+			return pw.done, nil
+		}
+		var blobErr *BlobError
+		if attempt >= hs.Retries || ctx.Err() != nil || pw.err != nil || errors.Is(err, ErrBlobTooLarge) ||
+			(errors.As(err, &blobErr) && blobErr.StatusCode < 500) {
+			return pw.done, err
+		}
+
+		select {
+		case <-time.After(delay):
+			delay *= 2
+		case <-ctx.Done():
+			return pw.done, ctx.Err()
+		}
+	}
+}
+
+// download makes a single attempt to fetch the rest of a blob, continuing after the
+// bytes already written to pw
+func (hs *HTTPBlobStore) download(ctx context.Context, blobID [16]byte, pw *progressWriter) error {
+	req, err := hs.newRequest(ctx, http.MethodGet, blobURL(hs.DownloadURL, DefaultBlobDownloadURL, blobID), nil)
+	if err != nil {
+		return err
+	}
+	if pw.done > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", pw.done))
+	}
+
+	resp, err := hs.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body := io.Reader(resp.Body)
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && pw.done > 0:
+		if resp.ContentLength >= 0 {
+			pw.total = pw.done + resp.ContentLength
+		}
+	case resp.StatusCode == http.StatusOK:
+		pw.total = resp.ContentLength
+		// the server ignored the range, skip what we already have
+		if pw.done > 0 {
+			if _, err := io.CopyN(ioutil.Discard, body, pw.done); err != nil {
+				return err
+			}
+		}
+	default:
+		return &BlobError{Op: "download", BlobID: blobID, StatusCode: resp.StatusCode}
+	}
+
+	limit := hs.MaxSize()
+	if pw.total > limit {
+		return ErrBlobTooLarge
+	}
+	n, err := io.Copy(pw, io.LimitReader(body, limit-pw.done+1))
+	if err != nil {
+		return err
+	}
+	if pw.done > limit {
+		return ErrBlobTooLarge
+	}
+	if pw.total >= 0 && pw.done < pw.total {
+		return fmt.Errorf("o3: download of blob %x interrupted after %d bytes: %w", blobID, n, io.ErrUnexpectedEOF)
+	}
+	return nil
+}
+
+// MarkDone tells the server that the blob has been downloaded and can be deleted
+func (hs *HTTPBlobStore) MarkDone(ctx context.Context, blobID [16]byte) error {
+	req, err := hs.newRequest(ctx, http.MethodPost, blobURL(hs.DoneURL, DefaultBlobDoneURL, blobID), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := hs.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return &BlobError{Op: "done", BlobID: blobID, StatusCode: resp.StatusCode}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package o3
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/o3ma/o3/o3test"
+)
+
+func TestBlobStoreRoundTrip(t *testing.T) {
+	fb := o3test.NewFakeBlobServer()
+	defer fb.Close()
+	store := fakeBlobStore(fb)
+
+	plain := []byte("not really a JPEG")
+	key, serverID, size, blobID, err := encryptAndUploadSym(context.Background(), store, plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, ok := fb.Blob(blobID)
+	if !ok || serverID != blobID[0] || int(size) != len(stored) {
+		t.Fatalf("blob not stored as reported: ok=%v size=%d stored=%d", ok, size, len(stored))
+	}
+	if bytes.Contains(stored, plain) {
+		t.Error("blob stored unencrypted")
+	}
+
+	sc := NewSessionContext(ThreemaID{ID: NewIDString("ECHOECHO")})
+	sc.Blobs = store
+	sc.MediaCache = nil
+	decrypted, err := downloadAndDecryptSym(context.Background(), sc, InboundMedia{Type: GROUPIMAGEMESSAGE, BlobID: blobID}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, plain) {
+		t.Errorf("got %q, want %q", decrypted, plain)
+	}
+
+	if err := store.MarkDone(context.Background(), blobID); err != nil {
+		t.Fatal(err)
+	}
+	if !fb.Done(blobID) {
+		t.Error("blob not marked as done")
+	}
+
+	_, err = store.Download(context.Background(), [16]byte{0x42}, ioutil.Discard)
+	if !errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("expected ErrBlobNotFound, got %v", err)
+	}
+}
+
+func TestBlobStoreResumeAndLimit(t *testing.T) {
+	fb := o3test.NewFakeBlobServer()
+	defer fb.Close()
+	store := fakeBlobStore(fb)
+	store.Retries = 2
+	store.RetryDelay = time.Millisecond
+
+	blob := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	blobID, err := store.Upload(context.Background(), bytes.NewReader(blob), int64(len(blob)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fb.InterruptDownloads(1)
+	var lastDone, lastTotal int64
+	ctx := WithBlobProgress(context.Background(), func(done, total int64) {
+		lastDone, lastTotal = done, total
+	})
+	var buf bytes.Buffer
+	n, err := store.Download(ctx, blobID, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(blob)) || !bytes.Equal(buf.Bytes(), blob) {
+		t.Fatalf("resumed download returned %d bytes, want %d", n, len(blob))
+	}
+	if lastDone != n || lastTotal != n {
+		t.Errorf("last progress %d/%d, want %d/%d", lastDone, lastTotal, n, n)
+	}
+
+	fb.InterruptDownloads(1)
+	whole, err := downloadBlob(context.Background(), store, blobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(whole, blob) || cap(whole) != len(blob) {
+		t.Errorf("downloadBlob returned %d bytes in a buffer of %d, want %d", len(whole), cap(whole), len(blob))
+	}
+
+	fb.InterruptDownloads(3)
+	if _, err := store.Download(context.Background(), blobID, ioutil.Discard); err == nil {
+		t.Error("download succeeded although retries were exhausted")
+	}
+	fb.InterruptDownloads(0)
+
+	store.MaxBlobSize = int64(len(blob)) - 1
+	if _, err := store.Download(context.Background(), blobID, ioutil.Discard); !errors.Is(err, ErrBlobTooLarge) {
+		t.Errorf("expected ErrBlobTooLarge on download, got %v", err)
+	}
+	if _, err := store.Upload(context.Background(), bytes.NewReader(blob), int64(len(blob))); !errors.Is(err, ErrBlobTooLarge) {
+		t.Errorf("expected ErrBlobTooLarge on upload, got %v", err)
+	}
+}
+
+func TestBlobStoreClientTimeouts(t *testing.T) {
+	stores := map[string]*HTTPBlobStore{
+		"zero value":   {},
+		"Threema CA":   NewHTTPBlobStore(nil),
+		"custom roots": NewHTTPBlobStore(x509.NewCertPool()),
+	}
+	for name, store := range stores {
+		client := store.client()
+		if client.Timeout != 0 {
+			t.Errorf("%s: client aborts transfers after %v", name, client.Timeout)
+		}
+		tr, ok := client.Transport.(*http.Transport)
+		if !ok || tr.ResponseHeaderTimeout == 0 || tr.TLSHandshakeTimeout == 0 || tr.DialContext == nil {
+			t.Errorf("%s: transport does not limit connecting and waiting for responses", name)
+		}
+	}
+}
+
+// fakeBlobStore returns an HTTPBlobStore talking to fb
+func fakeBlobStore(fb *o3test.FakeBlobServer) *HTTPBlobStore {
+	return &HTTPBlobStore{
+		UploadURL:   fb.URL + "/upload",
+		DownloadURL: fb.URL + "/{blobId}",
+		DoneURL:     fb.URL + "/{blobId}/done",
+		Client:      fb.Client(),
+	}
+}
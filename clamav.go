@@ -0,0 +1,95 @@
+package o3
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+// clamAVChunkSize is the size of the chunks media is streamed to clamd in
+const clamAVChunkSize = 64 << 10
+
+// ClamAV is a MediaInspector scanning media with a clamd daemon using its INSTREAM
+// command. Infected media is rejected, or quarantined if Quarantine is set. If clamd
+// cannot be reached the access to the media fails.
+type ClamAV struct {
+	// Network and Address of clamd, e.g. "unix" and "/run/clamav/clamd.ctl" or "tcp" and
+	// "127.0.0.1:3310"
+	Network string
+	Address string
+	// Timeout limits a whole scan, 30 seconds if zero
+	Timeout time.Duration
+	// Quarantine makes infected media be quarantined instead of rejected
+	Quarantine bool
+}
+
+// Inspect streams media to clamd and evaluates its answer
+func (cav ClamAV) Inspect(ctx context.Context, media *InboundMedia) (MediaVerdict, string, error) {
+	timeout := cav.Timeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, cav.Network, cav.Address)
+	if err != nil {
+		return MEDIAREJECT, "", fmt.Errorf("o3: clamd unreachable: %w", err)
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return MEDIAREJECT, "", fmt.Errorf("o3: clamd: %w", err)
+	}
+	var size [4]byte
+	for data := media.Data; len(data) > 0; {
+		chunk := data
+		if len(chunk) > clamAVChunkSize {
+			chunk = chunk[:clamAVChunkSize]
+		}
+		data = data[len(chunk):]
+		binary.BigEndian.PutUint32(size[:], uint32(len(chunk)))
+		if _, err := conn.Write(size[:]); err != nil {
+			return MEDIAREJECT, "", fmt.Errorf("o3: clamd: %w", err)
+		}
+		if _, err := conn.Write(chunk); err != nil {
+			return MEDIAREJECT, "", fmt.Errorf("o3: clamd: %w", err)
+		}
+	}
+	// a chunk of length zero ends the stream
+	binary.BigEndian.PutUint32(size[:], 0)
+	if _, err := conn.Write(size[:]); err != nil {
+		return MEDIAREJECT, "", fmt.Errorf("o3: clamd: %w", err)
+	}
+
+	reply, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return MEDIAREJECT, "", fmt.Errorf("o3: clamd: %w", err)
+	}
+	return cav.verdict(string(bytes.TrimRight(reply, "\x00\n")))
+}
+
+// verdict evaluates a reply of clamd such as "stream: OK" or
+// "stream: Eicar-Signature FOUND"
+func (cav ClamAV) verdict(reply string) (MediaVerdict, string, error) {
+	result := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case result == "OK":
+		return MEDIAACCEPT, "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		reason := "infected with " + strings.TrimSuffix(result, " FOUND")
+		if cav.Quarantine {
+			return MEDIAQUARANTINE, reason, nil
+		}
+		return MEDIAREJECT, reason, nil
+	}
+	return MEDIAREJECT, "", fmt.Errorf("o3: clamd failed: %s", reply)
+}
@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -27,10 +28,57 @@ func receiveHelper(reader io.Reader, n int) *bytes.Buffer {
 	return bytes.NewBuffer(buf)
 }
 
+// ErrAckExpired is returned by ReceivedMsg.Ack if the connection the message was
+// received on is gone. The server delivers the message again on the next connection.
+var ErrAckExpired = errors.New("o3: connection of the message is gone, it will be redelivered")
+
 // ReceivedMsg is a type used to transmit messages via a channel
 type ReceivedMsg struct {
 	Msg Message
 	Err error
+
+	ack *deferredAck
+}
+
+// deferredAck acknowledges a message to the server once
+type deferredAck struct {
+	once sync.Once
+	send func() error
+	err  error
+}
+
+// Ack acknowledges the message to the server if the session runs with ManualAck, so it
+// is not delivered again. Messages that could not be decoded (Err is set) have to be
+// acknowledged as well. Further calls return the result of the first one. Without
+// ManualAck messages are acknowledged on receipt and Ack does nothing.
+func (rm ReceivedMsg) Ack() error {
+	if rm.ack == nil {
+		return nil
+	}
+	rm.ack.once.Do(func() {
+		rm.ack.err = rm.ack.send()
+	})
+	return rm.ack.err
+}
+
+// deferAck returns the acknowledgement of pkt for ReceivedMsg.Ack. It is only sent if
+// conn is still the session's connection.
+func (sc *SessionContext) deferAck(conn net.Conn, pkt messagePacket) *deferredAck {
+	return &deferredAck{send: func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("o3: cannot acknowledge message: %v", r)
+			}
+		}()
+
+		sc.writeMu.Lock()
+		defer sc.writeMu.Unlock()
+		if conn != sc.connection {
+			return ErrAckExpired
+		}
+		sc.writePacketLocked(conn, serializeClientAck(pkt))
+		return nil
+	}}
 }
 
 // preflightCheck quickly tests the ID and returns an error if it's empty
@@ -76,28 +124,47 @@ func (sc *SessionContext) Run() (chan<- Message, <-chan ReceivedMsg, error) {
 		return nil, nil, err
 	}
 
-	var err error
-	sc.connection, err = net.Dial("tcp", "g-33.0.threema.ch:5222")
+	conn, err := net.Dial("tcp", "g-33.0.threema.ch:5222")
 	if err != nil {
 		return nil, nil, err
 	}
+	sc.handshake(conn)
+
+	sc.setupQueues()
+
+	// receiveLoop calls sendLoop when ready
+	go sc.receiveLoop()
+
+	return sc.sendMsgChan.In, sc.receiveMsgChan.Out, nil
+}
+
+// handshake makes conn the session's connection and authenticates on it. Late acks of
+// messages received on a previous connection are held off until it is done.
+func (sc *SessionContext) handshake(conn net.Conn) {
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+	sc.connection = conn
 
-	//handshake
 	//Info.Println("Initiating Handshake")
 	sc.dispatchClientHello(sc.connection)
 	sc.handleServerHello(receiveHelper(sc.connection, 80))
 	sc.dispatchAuthMsg(sc.connection)
 	sc.handleHandshakeAck(receiveHelper(sc.connection, 32))
 	//Info.Println("Handshake Completed")
+}
 
-	//TODO: find better way to handle large amounts of offline messages
-	//sc.sendMsgChan = make(chan Message, 1000)
-	//sc.receiveMsgChan = make(chan ReceivedMsg, 1000)
-
-	// receiveLoop calls sendLoop when ready
-	go sc.receiveLoop()
-
-	return sc.sendMsgChan.In, sc.receiveMsgChan.Out, nil
+// setupQueues applies the queue limits and starts resending what the last run left in
+// the Outbox. The replay runs in the background as sendLoop only drains the send queue
+// once the connection is established.
+func (sc *SessionContext) setupQueues() {
+	// large amounts of offline messages are bounded by the queue limits
+	sc.sendMsgChan.setLimit(sc.SendQueue)
+	sc.receiveMsgChan.setLimit(sc.ReceiveQueue)
+	sc.receiveMsgChan.setDropHook(sc.droppedIncoming)
+
+	// persist what is enqueued from now on and resend what was left by the last run
+	sc.sendMsgChan.setHooks(sc.enqueueOutgoing, sc.droppedOutgoing)
+	go sc.replayOutbox()
 }
 
 func (sc *SessionContext) receiveLoop() {
@@ -117,15 +184,36 @@ func (sc *SessionContext) receiveLoop() {
 		}
 		switch pkt := pktIntf.(type) {
 		case messagePacket:
-			// Acknowledge message packet
-			sc.dispatchAckMsg(sc.connection, pkt)
+			if pkt.Err != nil {
+				// Leave the message unacknowledged, so the server delivers it again once
+				// the sender can be resolved, e.g. after a key change was accepted
+				sc.reportError(pkt.Err)
+				continue
+			}
+			dropped := pkt.Rejected && (sc.Inbound.Quarantine == nil || pkt.Plaintext == nil)
 
-			// Get the actual message
+			// Acknowledge message packet, unless the application does so in manual mode
 			var rmsg ReceivedMsg
+			if sc.ManualAck && !dropped {
+				rmsg.ack = sc.deferAck(sc.connection, pkt)
+			} else {
+				sc.dispatchAckMsg(sc.connection, pkt)
+			}
+
+			if dropped {
+				continue
+			}
+
+			// Get the actual message
 			rmsg.Msg, rmsg.Err = sc.handleMessagePacket(pkt)
+			if pkt.Rejected {
+				sc.Inbound.Quarantine <- rmsg
+				continue
+			}
 			sc.receiveMsgChan.In <- rmsg
 		case ackPacket:
-			// ok cool. nothing to do.
+			// the server took the message, it need not be resent
+			sc.discardOutgoing(pkt.SenderID, pkt.MsgID)
 		case echoPacket:
 			sc.echoCounter = pkt.Counter
 		case connEstPacket:
@@ -167,7 +255,16 @@ func (sc *SessionContext) sendLoop() {
 	for {
 		select {
 		case msg := <-sc.sendMsgChan.Out:
-			sc.dispatchMessage(sc.connection, msg)
+			if err := sc.checkCapabilities(msg); err != nil {
+				sc.reportError(err)
+				mh := msg.header()
+				sc.discardOutgoing(mh.recipient, mh.id)
+				continue
+			}
+			// Only this message is lost if its recipient cannot be resolved
+			if err := sc.dispatchMessage(sc.connection, msg); err != nil {
+				sc.failOutgoing(msg, err)
+			}
 		// Read from echo channel and dispatch (happens every 3 min)
 		case echoPkt := <-echoPktChan:
 			sc.dispatchEchoMsg(sc.connection, echoPkt)
@@ -209,7 +306,12 @@ func (sc *SessionContext) SendImageMessage(recipient string, filename string, se
 // SendAudioMessage sends a Audio Message to the specified ID
 // Enqueued messages will be received, not acknowledged and discarded
 // Works with various audio formats threema uses some kind of mp4 but mp3 works fine
+// Returns an *UnsupportedFeatureError if the recipient's client cannot play audio messages
 func (sc *SessionContext) SendAudioMessage(recipient string, filename string, sendMsgChan chan<- Message) error {
+	if err := sc.requireFeatures(NewIDString(recipient), AUDIOMESSAGE); err != nil {
+		return err
+	}
+
 	// build a message
 	am, err := NewAudioMessage(sc, recipient, filename)
 
@@ -222,6 +324,23 @@ func (sc *SessionContext) SendAudioMessage(recipient string, filename string, se
 	return nil
 }
 
+// SendFileMessage sends a File Message to the specified ID
+// Enqueued messages will be received, not acknowledged and discarded
+// Clients without file support are sent images as Image Messages and audio as Audio Messages
+// instead; for other files an *UnsupportedFeatureError is returned
+func (sc *SessionContext) SendFileMessage(recipient string, filename string, sendMsgChan chan<- Message) error {
+	// build a message
+	msg, err := sc.newFileOrMediaMessage(recipient, filename)
+
+	if err != nil {
+		return err
+	}
+
+	sendMsgChan <- msg
+
+	return nil
+}
+
 // SendGroupTextMessage Sends a text message to all members
 func (sc *SessionContext) SendGroupTextMessage(group Group, text string, sendMsgChan chan<- Message) (err error) {
 
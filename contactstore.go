@@ -0,0 +1,277 @@
+package o3
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ContactStore is the interface used by a SessionContext to look up and record contacts.
+// Implementations have to be safe for concurrent use. AddressBook is the in-memory
+// implementation, FileContactStore additionally persists every change to disk.
+type ContactStore interface {
+	// Get returns the contact with the given ID and whether it was found
+	Get(id string) (ThreemaContact, bool)
+	// Put adds a contact or replaces the contact with the same ID
+	Put(c ThreemaContact) error
+	// Delete removes the contact with the given ID
+	Delete(id string) error
+	// List returns all stored contacts
+	List() []ThreemaContact
+	// Watch returns a channel receiving all subsequent changes and a function to stop watching
+	Watch() (<-chan ContactEvent, func())
+}
+
+// ContactEventType describes the kind of change a ContactEvent reports
+type ContactEventType uint8
+
+// ContactEventType mock enum
+const (
+	CONTACTADDED   ContactEventType = 0x1 //indicates a contact was added to the store
+	CONTACTUPDATED ContactEventType = 0x2 //indicates a stored contact was replaced
+	CONTACTDELETED ContactEventType = 0x3 //indicates a contact was removed from the store
+	//indicates a stored contact's public key was replaced or a key change was detected
+	CONTACTKEYCHANGED ContactEventType = 0x4
+	//indicates a stored contact's public nickname changed
+	CONTACTNICKCHANGED ContactEventType = 0x5
+)
+
+// ContactEvent is emitted by a ContactStore whenever a contact changes. Previous
+// holds the contact as it was before an update or deletion.
+type ContactEvent struct {
+	Type     ContactEventType
+	Contact  ThreemaContact
+	Previous ThreemaContact
+}
+
+// watcherBufferSize is the number of events a watcher may fall behind before
+// further events are dropped for that watcher. CONTACTKEYCHANGED events are never
+// dropped, see contactWatchers.
+const watcherBufferSize = 32
+
+// contactWatchers fans out ContactEvents to all registered watchers. Events are never
+// sent blocking so a slow watcher cannot stall the store. Key changes that do not fit
+// into a watcher's buffer are queued and delivered in order as the watcher catches up;
+// other events are dropped while a watcher has queued key changes.
+type contactWatchers struct {
+	mu       sync.Mutex
+	watchers map[*contactWatcher]struct{}
+}
+
+// contactWatcher is a single watcher of a contactWatchers
+type contactWatcher struct {
+	ch   chan ContactEvent
+	stop chan struct{}
+	wg   sync.WaitGroup
+
+	mu         sync.Mutex
+	keyChanges []ContactEvent
+}
+
+func (cw *contactWatchers) add() (<-chan ContactEvent, func()) {
+	w := &contactWatcher{
+		ch:   make(chan ContactEvent, watcherBufferSize),
+		stop: make(chan struct{}),
+	}
+
+	cw.mu.Lock()
+	if cw.watchers == nil {
+		cw.watchers = make(map[*contactWatcher]struct{})
+	}
+	cw.watchers[w] = struct{}{}
+	cw.mu.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			cw.mu.Lock()
+			delete(cw.watchers, w)
+			cw.mu.Unlock()
+			close(w.stop)
+			w.wg.Wait()
+			close(w.ch)
+		})
+	}
+	return w.ch, cancel
+}
+
+func (cw *contactWatchers) notify(ev ContactEvent) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	for w := range cw.watchers {
+		w.send(ev)
+	}
+}
+
+// send delivers ev without blocking, queueing it if it is a key change and the
+// buffer is full
+func (w *contactWatcher) send(ev ContactEvent) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.keyChanges) == 0 {
+		select {
+		case w.ch <- ev:
+			return
+		default:
+		}
+	}
+	if ev.Type != CONTACTKEYCHANGED {
+		return
+	}
+	w.keyChanges = append(w.keyChanges, ev)
+	if len(w.keyChanges) == 1 {
+		w.wg.Add(1)
+		go w.deliverKeyChanges()
+	}
+}
+
+// deliverKeyChanges sends the queued key changes until the queue is empty or the
+// watcher is cancelled
+func (w *contactWatcher) deliverKeyChanges() {
+	defer w.wg.Done()
+	for {
+		w.mu.Lock()
+		if len(w.keyChanges) == 0 {
+			w.mu.Unlock()
+			return
+		}
+		ev := w.keyChanges[0]
+		w.mu.Unlock()
+
+		select {
+		case w.ch <- ev:
+		case <-w.stop:
+			return
+		}
+
+		w.mu.Lock()
+		w.keyChanges = w.keyChanges[1:]
+		w.mu.Unlock()
+	}
+}
+
+// FileContactStore is a ContactStore that keeps its contacts in memory and writes
+// the complete address book to a file after every change. The format is chosen
+// by the file extension as for AddressBook.SaveTo; vCards cannot be used as they
+// do not hold all fields of a contact.
+type FileContactStore struct {
+	mu       sync.Mutex
+	book     AddressBook
+	filename string
+	// invalid is set if the file has entries that could not be loaded
+	invalid *ImportError
+}
+
+// NewFileContactStore returns a FileContactStore backed by filename. Contacts
+// already stored in the file are loaded; a missing file is created on the first change.
+// If some entries of the file are invalid, the store is returned with the valid ones
+// together with an *ImportError. Such a store refuses all changes, so the invalid
+// entries are not lost, until the file is fixed and the store is opened again.
+func NewFileContactStore(filename string) (*FileContactStore, error) {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".vcf", ".vcard":
+		return nil, fmt.Errorf("o3: cannot store contacts in vCard file %s, use CSV or JSON", filename)
+	}
+	fs := &FileContactStore{
+		book:     NewAddressBook(),
+		filename: filename,
+	}
+	err := fs.book.ImportFrom(filename)
+	if errors.As(err, &fs.invalid) {
+		return fs, err
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// Get returns the contact with the given ID and whether it was found
+func (fs *FileContactStore) Get(id string) (ThreemaContact, bool) {
+	return fs.book.Get(id)
+}
+
+// Put adds or replaces a contact and saves the store
+func (fs *FileContactStore) Put(c ThreemaContact) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.writable(); err != nil {
+		return err
+	}
+	fs.book.Add(c)
+	return fs.save()
+}
+
+// Delete removes the contact with the given ID and saves the store
+func (fs *FileContactStore) Delete(id string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.writable(); err != nil {
+		return err
+	}
+	fs.book.Delete(id)
+	return fs.save()
+}
+
+// List returns all stored contacts ordered by ID
+func (fs *FileContactStore) List() []ThreemaContact {
+	return fs.book.List()
+}
+
+// Watch returns a channel receiving all subsequent changes and a function to stop watching
+func (fs *FileContactStore) Watch() (<-chan ContactEvent, func()) {
+	return fs.book.Watch()
+}
+
+// writable returns an error if saving the store would drop invalid entries of its file
+func (fs *FileContactStore) writable() error {
+	if fs.invalid == nil {
+		return nil
+	}
+	return fmt.Errorf("o3: contact store %s is read-only until its invalid entries are fixed: %w", fs.filename, fs.invalid)
+}
+
+// ImportContacts adds the contacts of an address book file to the session's ContactStore,
+// replacing contacts with the same ID. The file is read as by AddressBook.ImportFrom, but
+// missing vCard keys are fetched from the session's Directory. Valid entries are stored
+// even if an *ImportError is returned.
+func (sc *SessionContext) ImportContacts(filename string) error {
+	var ab AddressBook
+	importErr := ab.importFrom(filename, sc.Directory.GetContactByID)
+	var rowErrs *ImportError
+	if importErr != nil && !errors.As(importErr, &rowErrs) {
+		return importErr
+	}
+	store := sc.contacts()
+	for _, c := range ab.List() {
+		if err := store.Put(c); err != nil {
+			return err
+		}
+	}
+	return importErr
+}
+
+// save writes the address book to a temporary file first and renames it so a crash
+// never leaves a truncated store behind
+func (fs *FileContactStore) save() error {
+	tmp, err := ioutil.TempFile(filepath.Dir(fs.filename), filepath.Base(fs.filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := fs.book.writeFor(tmp, fs.filename); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fs.filename)
+}
@@ -0,0 +1,243 @@
+package o3
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/o3ma/o3/o3test"
+)
+
+func testContact(id string, keyByte byte) ThreemaContact {
+	c := ThreemaContact{ID: NewIDString(id), Name: "contact " + id}
+	for i := range c.LPK {
+		c.LPK[i] = keyByte
+	}
+	return c
+}
+
+func TestAddressBookSharedAndConcurrent(t *testing.T) {
+	ab := NewAddressBook()
+	cp := ab
+
+	events, cancel := ab.Watch()
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := string([]byte{'A', 'B', 'C', 'D', 'E', 'F', 'G', '0' + byte(i)})
+			cp.Put(testContact(id, byte(i)))
+			ab.Get(id)
+			ab.List()
+		}(i)
+	}
+	wg.Wait()
+
+	if n := len(ab.List()); n != 8 {
+		t.Fatalf("expected 8 contacts in shared address book, got %d", n)
+	}
+
+	for i := 0; i < 8; i++ {
+		if ev := <-events; ev.Type != CONTACTADDED {
+			t.Errorf("expected CONTACTADDED event, got %#v", ev.Type)
+		}
+	}
+
+	ab.Delete("ABCDEFG0")
+	if ev := <-events; ev.Type != CONTACTDELETED || ev.Contact.String() != "ABCDEFG0" {
+		t.Errorf("unexpected delete event: %#v", ev)
+	}
+	if _, ok := cp.Get("ABCDEFG0"); ok {
+		t.Error("deleted contact still visible in copy")
+	}
+}
+
+func TestFileContactStorePersists(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "contacts.csv")
+
+	fs, err := NewFileContactStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Put(testContact("ECHOECHO", 0x42)); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Put(testContact("OSCAR123", 0x23)); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Delete("OSCAR123"); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewFileContactStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contacts := reopened.List()
+	if len(contacts) != 1 {
+		t.Fatalf("expected 1 persisted contact, got %d", len(contacts))
+	}
+	if contacts[0] != testContact("ECHOECHO", 0x42) {
+		t.Errorf("persisted contact differs: %#v", contacts[0])
+	}
+}
+
+func TestRecordNickname(t *testing.T) {
+	sc := NewSessionContext(ThreemaID{ID: NewIDString("ECHOECHO")})
+	sc.ID.Contacts.Add(testContact("FRIEND01", 0x01))
+	events, cancel := sc.contacts().Watch()
+	defer cancel()
+
+	friend := NewIDString("FRIEND01")
+	sc.recordNickname(friend, NewPubNick("FRIEND01"))
+	sc.recordNickname(NewIDString("STRANGER"), NewPubNick("stranger"))
+	if got := sc.DisplayName(friend); got != "contact FRIEND01" {
+		t.Errorf("expected local name, got %q", got)
+	}
+
+	contact, _ := sc.ID.Contacts.Get("FRIEND01")
+	contact.Name = ""
+	sc.ID.Contacts.Add(contact)
+	<-events
+
+	sc.recordNickname(friend, NewPubNick("Friendly"))
+	if ev := <-events; ev.Type != CONTACTNICKCHANGED || ev.Contact.Nickname != "Friendly" {
+		t.Errorf("expected nickname change event, got %#v", ev)
+	}
+	if got := sc.DisplayName(friend); got != "Friendly" {
+		t.Errorf("expected nickname, got %q", got)
+	}
+	if got := sc.DisplayName(NewIDString("STRANGER")); got != "STRANGER" {
+		t.Errorf("expected ID for unknown contact, got %q", got)
+	}
+	if _, ok := sc.ID.Contacts.Get("STRANGER"); ok {
+		t.Error("nickname of unknown sender added a contact")
+	}
+}
+
+func TestFileContactStoreInvalidRow(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "contacts.csv")
+	key := strings.Repeat("ab", 32)
+	if err := ioutil.WriteFile(filename, []byte("ECHOECHO,Echo,"+key+"\nBADKEY01,Bad,1234\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	fs, err := NewFileContactStore(filename)
+	var importErr *ImportError
+	if !errors.As(err, &importErr) || fs == nil {
+		t.Fatalf("expected store and *ImportError, got %v, %v", fs, err)
+	}
+	if _, ok := fs.Get("ECHOECHO"); !ok {
+		t.Error("valid contact not loaded")
+	}
+
+	// saving would drop the invalid row
+	if err := fs.Put(testContact("OSCAR123", 0x01)); !errors.As(err, &importErr) {
+		t.Errorf("change of store with invalid rows not refused: %v", err)
+	}
+	if data, _ := ioutil.ReadFile(filename); !strings.Contains(string(data), "BADKEY01") {
+		t.Error("invalid row dropped from file")
+	}
+	if _, ok := fs.Get("OSCAR123"); ok {
+		t.Error("refused contact kept in memory")
+	}
+}
+
+func TestFileContactStoreNoVCard(t *testing.T) {
+	if _, err := NewFileContactStore(filepath.Join(t.TempDir(), "contacts.vcf")); err == nil {
+		t.Error("vCard file accepted as contact store")
+	}
+}
+
+func TestImportContactsUsesDirectory(t *testing.T) {
+	fd := o3test.NewFakeDirectory()
+	defer fd.Close()
+	addFakeContact(fd, testContact("OSCAR123", 0x23))
+
+	filename := filepath.Join(t.TempDir(), "contacts.vcf")
+	card := "BEGIN:VCARD\r\nVERSION:3.0\r\nFN:Oscar\r\nX-THREEMA-ID:OSCAR123\r\nEND:VCARD\r\n"
+	if err := ioutil.WriteFile(filename, []byte(card), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	sc := NewSessionContext(ThreemaID{ID: NewIDString("ECHOECHO")})
+	sc.Directory = fakeRest(fd)
+	if err := sc.ImportContacts(filename); err != nil {
+		t.Fatal(err)
+	}
+	if oscar, ok := sc.ID.Contacts.Get("OSCAR123"); !ok || oscar.LPK != testContact("OSCAR123", 0x23).LPK {
+		t.Errorf("key not fetched from the session's directory: %#v", oscar)
+	}
+}
+
+func TestWatcherKeepsKeyChanges(t *testing.T) {
+	ab := NewAddressBook()
+	events, cancel := ab.Watch()
+	defer cancel()
+
+	// fill the watcher's buffer, then change keys while nobody reads
+	for i := 0; i < watcherBufferSize; i++ {
+		ab.Put(testContact("ABCDEFGH", 1))
+	}
+	for i := 2; i < 7; i++ {
+		ab.Put(testContact("ABCDEFGH", byte(i)))
+	}
+	ab.Put(testContact("ZYXWVUTS", 1))
+
+	for i := 0; i < watcherBufferSize; i++ {
+		<-events
+	}
+	for i := 2; i < 7; i++ {
+		var ev ContactEvent
+		select {
+		case ev = <-events:
+		case <-time.After(time.Second):
+			t.Fatalf("key change to key %d was dropped", i)
+		}
+		if ev.Type != CONTACTKEYCHANGED || ev.Contact.LPK[0] != byte(i) {
+			t.Fatalf("expected key change to key %d, got %#v with key %d", i, ev.Type, ev.Contact.LPK[0])
+		}
+	}
+	select {
+	case ev := <-events:
+		t.Errorf("unexpected event %#v for %s", ev.Type, ev.Contact)
+	default:
+	}
+
+	// a cancelled watcher with queued key changes closes its channel
+	other, cancelOther := ab.Watch()
+	for i := 0; i < watcherBufferSize+2; i++ {
+		ab.Put(testContact("ABCDEFGH", byte(10+i%2)))
+	}
+	cancelOther()
+	for range other {
+	}
+}
+
+func TestImportNotifiesWatchers(t *testing.T) {
+	ab := NewAddressBook()
+	ab.Add(testContact("ECHOECHO", 0x01))
+	ab.Add(testContact("OSCAR123", 0x01))
+	events, cancel := ab.Watch()
+	defer cancel()
+
+	key := strings.Repeat("02", 32)
+	if err := ab.Import([][]string{{"ECHOECHO", "contact ECHOECHO", key}, {"FRIEND01", "Friend", key}}); err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[ContactEventType]string)
+	for i := 0; i < 3; i++ {
+		ev := <-events
+		got[ev.Type] = ev.Contact.String()
+	}
+	if got[CONTACTKEYCHANGED] != "ECHOECHO" || got[CONTACTADDED] != "FRIEND01" || got[CONTACTDELETED] != "OSCAR123" {
+		t.Errorf("unexpected events %v", got)
+	}
+}
@@ -0,0 +1,299 @@
+package o3
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Names of the entries of a Threema data backup
+const (
+	dataBackupIdentity      = "identity"
+	dataBackupSettings      = "settings.csv"
+	dataBackupContacts      = "contacts.csv"
+	dataBackupGroups        = "groups.csv"
+	dataBackupMessagePrefix = "message_"
+	dataBackupGroupPrefix   = "group_message_"
+)
+
+// DataBackupOptions controls what ImportDataBackup does besides restoring the identity,
+// contacts and groups
+type DataBackupOptions struct {
+	// Messages is called for every message of the backup's conversations, ordered by
+	// conversation and time. If it returns an error the import is aborted. If nil, the
+	// message history is skipped.
+	Messages func(BackupMessage) error
+}
+
+// BackupMessage is a message from the history of a data backup
+type BackupMessage struct {
+	// Peer is the contact of a 1:1 conversation or the sender of a group message. It
+	// is empty for outgoing group messages.
+	Peer IDString
+	// GroupCreator and GroupID identify the group of a group message
+	GroupCreator IDString
+	GroupID      [8]byte
+	IsGroup      bool
+	// ID is the hex encoded message ID
+	ID       string
+	Outgoing bool
+	// Type is the message type as stored by the app, e.g. "TEXT" or "IMAGE"
+	Type   string
+	Body   string
+	Posted time.Time
+}
+
+// ImportDataBackupFile imports a data backup archive exported by the Threema app, see
+// ImportDataBackup
+func ImportDataBackupFile(filename string, password []byte, opts DataBackupOptions) (ThreemaID, error) {
+	zr, err := zip.OpenReader(filename)
+	if err != nil {
+		return ThreemaID{}, err
+	}
+	defer zr.Close()
+	return importDataBackup(&zr.Reader, password, opts)
+}
+
+// ImportDataBackup imports a data backup archive exported by the Threema app. The
+// archive and the identity backup it contains are decrypted with password. The returned
+// ThreemaID holds the identity, the contacts from contacts.csv with their verification
+// levels and the groups from groups.csv. Nick is read from settings.csv if the archive
+// contains one and is the ID otherwise. Invalid contact rows are reported in an
+// *ImportError after everything else has been imported.
+func ImportDataBackup(r io.ReaderAt, size int64, password []byte, opts DataBackupOptions) (ThreemaID, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return ThreemaID{}, err
+	}
+	return importDataBackup(zr, password, opts)
+}
+
+func importDataBackup(zr *zip.Reader, password []byte, opts DataBackupOptions) (ThreemaID, error) {
+	entries := make(map[string]*zip.File, len(zr.File))
+	for _, f := range zr.File {
+		entries[f.Name] = f
+	}
+
+	identity, ok := entries[dataBackupIdentity]
+	if !ok {
+		return ThreemaID{}, fmt.Errorf("o3: data backup contains no %s", dataBackupIdentity)
+	}
+	idstr, err := readZipEntry(identity, password)
+	if err != nil {
+		return ThreemaID{}, err
+	}
+	parsed, err := ParseIDBackupString(strings.TrimSpace(string(idstr)), password)
+	if err != nil {
+		return ThreemaID{}, err
+	}
+	thid, err := NewThreemaID(parsed.String(), parsed.LSK, NewAddressBook())
+	if err != nil {
+		return ThreemaID{}, err
+	}
+	thid.Nick = NewPubNick(thid.String())
+
+	if f, ok := entries[dataBackupSettings]; ok {
+		rows, err := readZipCSV(f, password)
+		if err != nil {
+			return ThreemaID{}, err
+		}
+		for _, row := range rows {
+			if nick := row["nickname"]; nick != "" {
+				thid.Nick = NewPubNick(nick)
+			}
+		}
+	}
+
+	var contactsErr error
+	if f, ok := entries[dataBackupContacts]; ok {
+		rows, err := readZipCSV(f, password)
+		if err != nil {
+			return ThreemaID{}, err
+		}
+		contactsErr = thid.Contacts.importRecords(dataBackupContactRecords(rows), nil)
+	}
+
+	if f, ok := entries[dataBackupGroups]; ok {
+		rows, err := readZipCSV(f, password)
+		if err != nil {
+			return ThreemaID{}, err
+		}
+		if err := addDataBackupGroups(&thid, rows); err != nil {
+			return ThreemaID{}, err
+		}
+	}
+
+	if opts.Messages != nil {
+		if err := replayDataBackupMessages(zr, password, opts.Messages); err != nil {
+			return ThreemaID{}, err
+		}
+	}
+	return thid, contactsErr
+}
+
+// dataBackupContactRecords converts the rows of contacts.csv to contactRecords
+func dataBackupContactRecords(rows []map[string]string) []contactRecord {
+	records := make([]contactRecord, 0, len(rows))
+	for i, row := range rows {
+		rec := contactRecord{
+			ID:        strings.ToUpper(row["identity"]),
+			PublicKey: row["publickey"],
+			FirstName: row["firstname"],
+			LastName:  row["lastname"],
+			Nickname:  row["nick_name"],
+			// the header is line 1
+			line: i + 2}
+		switch strings.ToUpper(row["verification"]) {
+		case "SERVER_VERIFIED", "1":
+			rec.Verification = SERVERVERIFIED
+		case "FULLY_VERIFIED", "2":
+			rec.Verification = FULLYVERIFIED
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+// addDataBackupGroups adds the groups from the rows of groups.csv to thid
+func addDataBackupGroups(thid *ThreemaID, rows []map[string]string) error {
+	for i, row := range rows {
+		if row["deleted"] == "1" || strings.EqualFold(row["deleted"], "true") {
+			continue
+		}
+		rawID, err := hex.DecodeString(row["id"])
+		if err != nil || len(rawID) != 8 || !validIDString(row["creator"]) {
+			return fmt.Errorf("o3: invalid group in line %d of %s", i+2, dataBackupGroups)
+		}
+		group := Group{
+			CreatorID: NewIDString(row["creator"]),
+			Name:      row["groupname"]}
+		copy(group.GroupID[:], rawID)
+		for _, member := range strings.Split(row["members"], ";") {
+			if member = strings.TrimSpace(member); member != "" {
+				group.Members = append(group.Members, NewIDString(member))
+			}
+		}
+		if thid.Groups[group.CreatorID] == nil {
+			thid.Groups[group.CreatorID] = make(map[[8]byte]Group)
+		}
+		thid.Groups[group.CreatorID][group.GroupID] = group
+	}
+	return nil
+}
+
+// replayDataBackupMessages passes the messages of all conversations in the archive to handle
+func replayDataBackupMessages(zr *zip.Reader, password []byte, handle func(BackupMessage) error) error {
+	var files []*zip.File
+	for _, f := range zr.File {
+		if strings.HasSuffix(f.Name, ".csv") &&
+			(strings.HasPrefix(f.Name, dataBackupMessagePrefix) || strings.HasPrefix(f.Name, dataBackupGroupPrefix)) {
+			files = append(files, f)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+
+	for _, f := range files {
+		conversation := BackupMessage{}
+		name := strings.TrimSuffix(f.Name, ".csv")
+		if strings.HasPrefix(name, dataBackupGroupPrefix) {
+			// group_message_<group ID>-<creator>
+			parts := strings.SplitN(strings.TrimPrefix(name, dataBackupGroupPrefix), "-", 2)
+			rawID, err := hex.DecodeString(parts[0])
+			if len(parts) != 2 || err != nil || len(rawID) != 8 || !validIDString(parts[1]) {
+				return fmt.Errorf("o3: invalid group conversation %s in data backup", f.Name)
+			}
+			conversation.IsGroup = true
+			conversation.GroupCreator = NewIDString(parts[1])
+			copy(conversation.GroupID[:], rawID)
+		} else {
+			peer := strings.TrimPrefix(name, dataBackupMessagePrefix)
+			if !validIDString(peer) {
+				return fmt.Errorf("o3: invalid conversation %s in data backup", f.Name)
+			}
+			conversation.Peer = NewIDString(peer)
+		}
+
+		rows, err := readZipCSV(f, password)
+		if err != nil {
+			return err
+		}
+		messages := make([]BackupMessage, 0, len(rows))
+		for _, row := range rows {
+			msg := conversation
+			msg.ID = row["apiid"]
+			msg.Outgoing = row["isoutbox"] == "1" || strings.EqualFold(row["isoutbox"], "true")
+			msg.Type = row["type"]
+			msg.Body = row["body"]
+			if ms, err := strconv.ParseInt(row["posted_at"], 10, 64); err == nil {
+				msg.Posted = time.Unix(0, ms*int64(time.Millisecond))
+			}
+			if msg.IsGroup {
+				msg.Peer = IDString{}
+				if !msg.Outgoing && validIDString(row["identity"]) {
+					msg.Peer = NewIDString(row["identity"])
+				}
+			}
+			messages = append(messages, msg)
+		}
+		sort.SliceStable(messages, func(i, j int) bool { return messages[i].Posted.Before(messages[j].Posted) })
+
+		for _, msg := range messages {
+			if err := handle(msg); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func readZipEntry(f *zip.File, password []byte) ([]byte, error) {
+	rc, err := openZipEntry(f, password)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// readZipCSV reads a CSV entry with a header row and returns its rows keyed by the
+// lower case column names
+func readZipCSV(f *zip.File, password []byte) ([]map[string]string, error) {
+	rc, err := openZipEntry(f, password)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	cr := csv.NewReader(rc)
+	cr.FieldsPerRecord = -1
+	rows, err := cr.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("o3: %s: %w", f.Name, err)
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	header := rows[0]
+	for i := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(header[i]))
+	}
+	records := make([]map[string]string, 0, len(rows)-1)
+	for _, row := range rows[1:] {
+		record := make(map[string]string, len(header))
+		for i, value := range row {
+			if i < len(header) {
+				record[header[i]] = value
+			}
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
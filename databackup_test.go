@@ -0,0 +1,145 @@
+package o3
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// writeAESEntry adds a deflated entry encrypted with WinZip AES-256 (AE-2) to zw
+func writeAESEntry(t *testing.T, zw *zip.Writer, name string, content, password []byte) {
+	var deflated bytes.Buffer
+	fw, _ := flate.NewWriter(&deflated, flate.DefaultCompression)
+	fw.Write(content)
+	fw.Close()
+
+	salt := bytes.Repeat([]byte{0x5a}, 16)
+	keys := pbkdf2.Key(password, salt, 1000, 66, sha1.New)
+	ciphertext, err := zipAESCrypt(keys[:32], deflated.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac := hmac.New(sha1.New, keys[32:64])
+	mac.Write(ciphertext)
+
+	data := append(append(append(salt, keys[64:]...), ciphertext...), mac.Sum(nil)[:10]...)
+	w, err := zw.CreateRaw(&zip.FileHeader{
+		Name:               name,
+		Method:             zipMethodAES,
+		Flags:              0x1,
+		CompressedSize64:   uint64(len(data)),
+		UncompressedSize64: uint64(len(content)),
+		Extra:              []byte{0x01, 0x99, 7, 0, 2, 0, 'A', 'E', 3, 8, 0},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(data)
+}
+
+func TestImportDataBackup(t *testing.T) {
+	password := []byte("backup password")
+	var lsk [32]byte
+	lsk[31] = 0x17
+	idstr, err := encryptID([]byte("ECHOECHO"), lsk[:], password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	friendKey := testContact("FRIEND01", 0x01).LPK
+
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	writeAESEntry(t, zw, "identity", []byte(idstr), password)
+	writeAESEntry(t, zw, "settings.csv", []byte("nickname\nEcho Bot\n"), password)
+	writeAESEntry(t, zw, "contacts.csv", []byte(
+		"identity,publickey,verification,firstname,lastname,nick_name\n"+
+			"FRIEND01,"+hex.EncodeToString(friendKey[:])+",FULLY_VERIFIED,Jane,Doe,jd\n"+
+			"BROKEN01,nothex,UNVERIFIED,,,\n"), password)
+	writeAESEntry(t, zw, "groups.csv", []byte(
+		"id,creator,groupname,members,deleted\n"+
+			"0102030405060708,FRIEND01,Ops,ECHOECHO;FRIEND01,0\n"), password)
+	writeAESEntry(t, zw, "message_FRIEND01.csv", []byte(
+		"apiid,isoutbox,type,body,posted_at\n"+
+			"bb,1,TEXT,second,2000\n"+
+			"aa,0,TEXT,first,1000\n"), password)
+	writeAESEntry(t, zw, "group_message_0102030405060708-FRIEND01.csv", []byte(
+		"apiid,identity,isoutbox,type,body,posted_at\n"+
+			"cc,FRIEND01,0,TEXT,hello group,3000\n"), password)
+	zw.Close()
+
+	r := bytes.NewReader(archive.Bytes())
+	if _, err := ImportDataBackup(r, r.Size(), []byte("wrong"), DataBackupOptions{}); !errors.Is(err, ErrDataBackupPassword) {
+		t.Errorf("expected ErrDataBackupPassword, got %v", err)
+	}
+
+	var messages []BackupMessage
+	thid, err := ImportDataBackup(r, r.Size(), password, DataBackupOptions{
+		Messages: func(m BackupMessage) error {
+			messages = append(messages, m)
+			return nil
+		}})
+	var importErr *ImportError
+	if !errors.As(err, &importErr) || len(importErr.Rows) != 1 || importErr.Rows[0].Line != 3 {
+		t.Fatalf("expected row error for BROKEN01, got %v", err)
+	}
+
+	if thid.String() != "ECHOECHO" || thid.LSK != lsk || thid.Nick.Trimmed() != "Echo Bot" {
+		t.Errorf("identity not imported: %s %q", thid, thid.Nick.Trimmed())
+	}
+	friend, ok := thid.Contacts.Get("FRIEND01")
+	if !ok || friend.LPK != friendKey || friend.Verification != FULLYVERIFIED || friend.Nickname != "jd" {
+		t.Errorf("contact not imported: %#v", friend)
+	}
+	group := thid.Groups[NewIDString("FRIEND01")][[8]byte{1, 2, 3, 4, 5, 6, 7, 8}]
+	if group.Name != "Ops" || len(group.Members) != 2 {
+		t.Errorf("group not imported: %#v", group)
+	}
+
+	if len(messages) != 3 {
+		t.Fatalf("expected 3 messages, got %d", len(messages))
+	}
+	if messages[0].ID != "cc" || !messages[0].IsGroup || messages[0].Peer != NewIDString("FRIEND01") {
+		t.Errorf("unexpected group message %#v", messages[0])
+	}
+	if messages[1].Body != "first" || messages[2].Body != "second" || !messages[2].Outgoing {
+		t.Errorf("1:1 messages not replayed in order: %#v", messages[1:])
+	}
+}
+
+func TestDataBackupEntryLimit(t *testing.T) {
+	defer func(limit int64) { maxZipEntrySize = limit }(maxZipEntrySize)
+	maxZipEntrySize = 1024
+	password := []byte("backup password")
+	bomb := make([]byte, 4096)
+
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	writeAESEntry(t, zw, "contacts.csv", bomb, password)
+	zw.Close()
+	zr, err := zip.NewReader(bytes.NewReader(archive.Bytes()), int64(archive.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readZipEntry(zr.File[0], password); !errors.Is(err, ErrZipEntryTooLarge) {
+		t.Errorf("oversized entry read: %v", err)
+	}
+
+	// entries lying about their size are cut off while inflating
+	var deflated bytes.Buffer
+	fw, _ := flate.NewWriter(&deflated, flate.BestCompression)
+	fw.Write(bomb)
+	fw.Close()
+	if _, err := readAllLimited(flate.NewReader(&deflated), "bomb"); !errors.Is(err, ErrZipEntryTooLarge) {
+		t.Errorf("inflation not limited: %v", err)
+	}
+	if data, err := readAllLimited(bytes.NewReader(bomb[:1024]), "fits"); err != nil || len(data) != 1024 {
+		t.Errorf("entry at the limit refused: %v", err)
+	}
+}
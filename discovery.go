@@ -0,0 +1,175 @@
+package o3
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// HMAC keys used by Threema to hash email addresses and phone numbers for contact discovery
+var (
+	emailHashKey = [32]byte{0x30, 0xa5, 0x50, 0x0f, 0xed, 0x97, 0x01, 0xfa, 0x6d, 0xef, 0xdb, 0x61, 0x08, 0x41, 0x90, 0x0f,
+		0xeb, 0xb8, 0xe4, 0x30, 0x88, 0x1f, 0x7a, 0xd8, 0x16, 0x82, 0x62, 0x64, 0xec, 0x09, 0xba, 0xd7}
+	phoneHashKey = [32]byte{0x85, 0xad, 0xf8, 0x22, 0x69, 0x53, 0xf3, 0xd9, 0x6c, 0xfd, 0x5d, 0x09, 0xbf, 0x29, 0x55, 0x5e,
+		0xb9, 0x55, 0xfc, 0xd8, 0xaa, 0x5e, 0xc4, 0xf9, 0xfc, 0xd8, 0x69, 0xe2, 0x58, 0x37, 0x07, 0x23}
+)
+
+// ContactMatch is a contact found by contact discovery together with the email address
+// or phone number, as passed to MatchContacts, it was found by
+type ContactMatch struct {
+	Contact ThreemaContact
+	Email   string
+	Phone   string
+}
+
+// NormalizeEmail returns the form of an email address that is hashed for contact discovery
+func NormalizeEmail(email string) (string, error) {
+	normalized := strings.ToLower(strings.TrimSpace(email))
+	at := strings.LastIndexByte(normalized, '@')
+	if at < 1 || at == len(normalized)-1 || strings.ContainsAny(normalized, " \t\r\n") {
+		return "", fmt.Errorf("o3: invalid email address %q", email)
+	}
+	return normalized, nil
+}
+
+// NormalizePhoneNumber returns the form of a phone number in international format that is
+// hashed for contact discovery, i.e. its E.164 digits without the leading plus sign.
+// Spaces, dashes, dots and parentheses are ignored; the number has to start with + or 00.
+func NormalizePhoneNumber(phone string) (string, error) {
+	cleaned := strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '-', '.', '(', ')', '/':
+			return -1
+		}
+		return r
+	}, phone)
+
+	var digits string
+	switch {
+	case strings.HasPrefix(cleaned, "+"):
+		digits = cleaned[1:]
+	case strings.HasPrefix(cleaned, "00"):
+		digits = cleaned[2:]
+	default:
+		return "", fmt.Errorf("o3: phone number %q is not in international format", phone)
+	}
+	if len(digits) < 3 || len(digits) > 15 || digits[0] == '0' {
+		return "", fmt.Errorf("o3: invalid phone number %q", phone)
+	}
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return "", fmt.Errorf("o3: invalid phone number %q", phone)
+		}
+	}
+	return digits, nil
+}
+
+// HashEmail returns the discovery hash of an email address
+func HashEmail(email string) ([32]byte, error) {
+	normalized, err := NormalizeEmail(email)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return discoveryHash(&emailHashKey, normalized), nil
+}
+
+// HashPhoneNumber returns the discovery hash of a phone number in international format
+func HashPhoneNumber(phone string) ([32]byte, error) {
+	normalized, err := NormalizePhoneNumber(phone)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return discoveryHash(&phoneHashKey, normalized), nil
+}
+
+func discoveryHash(key *[32]byte, normalized string) [32]byte {
+	var sum [32]byte
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write([]byte(normalized))
+	copy(sum[:], mac.Sum(nil))
+	return sum
+}
+
+// MatchContacts looks up the Threema IDs linked to the given email addresses and phone
+// numbers. Only hashes of the normalized identifiers are sent to the directory. Matched
+// contacts are returned at SERVERVERIFIED level; identifiers without a linked ID are
+// missing from the result.
+func (tr ThreemaRest) MatchContacts(emails, phones []string) ([]ContactMatch, error) {
+	return tr.MatchContactsContext(context.Background(), emails, phones)
+}
+
+// MatchContactsContext is MatchContacts with a context controlling the request
+func (tr ThreemaRest) MatchContactsContext(ctx context.Context, emails, phones []string) ([]ContactMatch, error) {
+	byEmailHash := make(map[string]string, len(emails))
+	emailHashes := make([]string, 0, len(emails))
+	for _, email := range emails {
+		hash, err := HashEmail(email)
+		if err != nil {
+			return nil, err
+		}
+		encoded := base64.StdEncoding.EncodeToString(hash[:])
+		if _, dup := byEmailHash[encoded]; !dup {
+			byEmailHash[encoded] = email
+			emailHashes = append(emailHashes, encoded)
+		}
+	}
+
+	byPhoneHash := make(map[string]string, len(phones))
+	phoneHashes := make([]string, 0, len(phones))
+	for _, phone := range phones {
+		hash, err := HashPhoneNumber(phone)
+		if err != nil {
+			return nil, err
+		}
+		encoded := base64.StdEncoding.EncodeToString(hash[:])
+		if _, dup := byPhoneHash[encoded]; !dup {
+			byPhoneHash[encoded] = phone
+			phoneHashes = append(phoneHashes, encoded)
+		}
+	}
+
+	if len(emailHashes) == 0 && len(phoneHashes) == 0 {
+		return nil, nil
+	}
+
+	var response struct {
+		Identities []struct {
+			Identity     string `json:"identity"`
+			PublicKey    string `json:"publicKey"`
+			EmailHash    string `json:"emailHash"`
+			MobileNoHash string `json:"mobileNoHash"`
+		} `json:"identities"`
+	}
+	err := tr.do(ctx, "identity/match", map[string]interface{}{
+		"emailHashes":    emailHashes,
+		"mobileNoHashes": phoneHashes,
+	}, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	matches := make([]ContactMatch, 0, len(response.Identities))
+	for _, ident := range response.Identities {
+		if !validIDString(ident.Identity) {
+			return nil, fmt.Errorf("o3: directory sent invalid ID %q", ident.Identity)
+		}
+		pubKey, err := decodeDirectoryKey(ident.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		matches = append(matches, ContactMatch{
+			Contact: ThreemaContact{
+				ID:           NewIDString(ident.Identity),
+				LPK:          pubKey,
+				Verification: SERVERVERIFIED,
+				KeyFetched:   now},
+			Email: byEmailHash[ident.EmailHash],
+			Phone: byPhoneHash[ident.MobileNoHash]})
+	}
+	return matches, nil
+}
@@ -0,0 +1,87 @@
+package o3
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/o3ma/o3/o3test"
+)
+
+func TestDiscoveryHashes(t *testing.T) {
+	email, err := HashEmail("  Alice@Example.COM ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	same, _ := HashEmail("alice@example.com")
+	if email != same {
+		t.Error("email not normalized before hashing")
+	}
+
+	for _, phone := range []string{"+41 79 123 45 67", "0041791234567", "+41 (79) 123-45-67"} {
+		normalized, err := NormalizePhoneNumber(phone)
+		if err != nil || normalized != "41791234567" {
+			t.Errorf("NormalizePhoneNumber(%q) = %q, %v", phone, normalized, err)
+		}
+	}
+	for _, phone := range []string{"079 123 45 67", "+41 79 CALL ME", "+0123"} {
+		if _, err := NormalizePhoneNumber(phone); err == nil {
+			t.Errorf("accepted invalid phone number %q", phone)
+		}
+	}
+
+	hash, _ := HashPhoneNumber("+41791234567")
+	if hex.EncodeToString(hash[:]) == hex.EncodeToString(email[:]) {
+		t.Error("phone and email hashes collide")
+	}
+
+	// known answers published by Threema
+	if hash, _ := HashEmail("test@threema.ch"); hex.EncodeToString(hash[:]) != "1ea093239cc5f0e1b6ec81b866265b921f26dc4033025410063309f4d1a8ee2c" {
+		t.Errorf("wrong email hash %x", hash)
+	}
+	if hex.EncodeToString(hash[:]) != "ad398f4d7ebe63c6550a486cc6e07f9baa09bd9d8b3d8cb9d9be106d35a7fdbc" {
+		t.Errorf("wrong phone number hash %x", hash)
+	}
+}
+
+func TestMatchContacts(t *testing.T) {
+	fd := o3test.NewFakeDirectory()
+	defer fd.Close()
+
+	addFakeContact(fd, testContact("EMPLOYE1", 0x01))
+	addFakeContact(fd, testContact("EMPLOYE2", 0x02))
+	fd.LinkEmail("EMPLOYE1", "jane.doe@example.com")
+	fd.LinkPhoneNumber("EMPLOYE2", "41791234567")
+
+	matches, err := fakeRest(fd).MatchContacts(
+		[]string{"Jane.Doe@example.com", "nobody@example.com"},
+		[]string{"0041 79 123 45 67"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 2 {
+		t.Fatalf("expected 2 matches, got %#v", matches)
+	}
+
+	ab := NewAddressBook()
+	for _, m := range matches {
+		if m.Contact.Verification != SERVERVERIFIED {
+			t.Errorf("match %s not server verified", m.Contact)
+		}
+		switch m.Contact.String() {
+		case "EMPLOYE1":
+			if m.Email != "Jane.Doe@example.com" || m.Contact.LPK != testContact("EMPLOYE1", 0x01).LPK {
+				t.Errorf("unexpected email match %#v", m)
+			}
+		case "EMPLOYE2":
+			if m.Phone != "0041 79 123 45 67" {
+				t.Errorf("unexpected phone match %#v", m)
+			}
+		default:
+			t.Errorf("unexpected match %s", m.Contact)
+		}
+		ab.Add(m.Contact)
+	}
+	if len(ab.List()) != 2 {
+		t.Error("matched contacts could not be added to address book")
+	}
+}
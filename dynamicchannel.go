@@ -1,11 +1,16 @@
 package o3
 
 //dynSendChan implements a buffered channel for sending messages with dynamic size. It will
-//immediately consume input and store it in a growing FIFO buffer that can be read from using Out.
+//immediately consume input and store it in a FIFO buffer that can be read from using Out.
+//The buffer grows without bound unless a limit is set, see QueueOptions.
 type dynSendChan struct {
 	In  chan Message
 	Out chan Message
 	buf []Message
+
+	queueState
+	onEnqueue func(Message)
+	onDrop    func(Message, QueuePolicy)
 }
 
 //newDynSendChan returns a new dynamic sending channel that need not be further initialized to
@@ -20,28 +25,77 @@ func newDynSendChan() *dynSendChan {
 	return d
 }
 
+//setHooks sets functions that are called with every message before it is buffered and with
+//every message dropped because the buffer is full
+func (d *dynSendChan) setHooks(onEnqueue func(Message), onDrop func(Message, QueuePolicy)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.onEnqueue = onEnqueue
+	d.onDrop = onDrop
+}
+
+func (d *dynSendChan) enqueue(v Message) {
+	d.mu.Lock()
+	onEnqueue, onDrop, opts := d.onEnqueue, d.onDrop, d.opts
+	d.mu.Unlock()
+	if onEnqueue != nil {
+		onEnqueue(v)
+	}
+
+	var (
+		dropped     Message
+		droppedSome bool
+	)
+	if opts.Capacity > 0 && len(d.buf) >= opts.Capacity {
+		if opts.Policy == QUEUEFAIL {
+			d.record(len(d.buf), false, true)
+			if onDrop != nil {
+				onDrop(v, opts.Policy)
+			}
+			return
+		}
+		// QUEUEDROPOLDEST, QUEUEBLOCK only gets here if the limit was lowered
+		dropped, d.buf, droppedSome = d.buf[0], d.buf[1:], true
+	}
+	d.buf = append(d.buf, v)
+	d.record(len(d.buf), droppedSome, false)
+	if droppedSome && onDrop != nil {
+		onDrop(dropped, opts.Policy)
+	}
+}
+
 func (d *dynSendChan) run() {
 	for {
+		// stop taking messages while full, so senders block
+		in := d.In
+		if opts := d.limit(); opts.Policy == QUEUEBLOCK && opts.Capacity > 0 && len(d.buf) >= opts.Capacity {
+			in = nil
+		}
 		if len(d.buf) > 0 {
 			select {
 			case d.Out <- d.buf[0]:
 				d.buf = d.buf[1:]
-			case v := <-d.In:
-				d.buf = append(d.buf, v)
+				d.dequeued(len(d.buf))
+			case v := <-in:
+				d.enqueue(v)
 			}
 		} else {
 			v := <-d.In
-			d.buf = append(d.buf, v)
+			d.enqueue(v)
 		}
 	}
 }
 
 //dynRecvChan implements a buffered channel for receiving messages with dynamic size. It will
-//immediately consume input and store it in a growing FIFO buffer that can be read from using Out.
+//immediately consume input and store it in a FIFO buffer that can be read from using Out.
+//The buffer grows without bound unless a limit is set, see QueueOptions.
 type dynRecvChan struct {
 	In  chan ReceivedMsg
 	Out chan ReceivedMsg
 	buf []ReceivedMsg
+
+	queueState
+	onDrop func(ReceivedMsg, QueuePolicy)
 }
 
 //newDynRecvChan returns a new dynamic receiving channel that need not be further initialized to
@@ -56,18 +110,59 @@ func newDynRecvChan() *dynRecvChan {
 	return d
 }
 
+//setDropHook sets a function that is called with every message dropped because the buffer
+//is full
+func (d *dynRecvChan) setDropHook(onDrop func(ReceivedMsg, QueuePolicy)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.onDrop = onDrop
+}
+
+func (d *dynRecvChan) enqueue(v ReceivedMsg) {
+	d.mu.Lock()
+	onDrop, opts := d.onDrop, d.opts
+	d.mu.Unlock()
+
+	var (
+		dropped     ReceivedMsg
+		droppedSome bool
+	)
+	if opts.Capacity > 0 && len(d.buf) >= opts.Capacity {
+		if opts.Policy == QUEUEFAIL {
+			d.record(len(d.buf), false, true)
+			if onDrop != nil {
+				onDrop(v, opts.Policy)
+			}
+			return
+		}
+		// QUEUEDROPOLDEST, QUEUEBLOCK only gets here if the limit was lowered
+		dropped, d.buf, droppedSome = d.buf[0], d.buf[1:], true
+	}
+	d.buf = append(d.buf, v)
+	d.record(len(d.buf), droppedSome, false)
+	if droppedSome && onDrop != nil {
+		onDrop(dropped, opts.Policy)
+	}
+}
+
 func (d *dynRecvChan) run() {
 	for {
+		// stop taking messages while full, so the receive loop blocks
+		in := d.In
+		if opts := d.limit(); opts.Policy == QUEUEBLOCK && opts.Capacity > 0 && len(d.buf) >= opts.Capacity {
+			in = nil
+		}
 		if len(d.buf) > 0 {
 			select {
 			case d.Out <- d.buf[0]:
 				d.buf = d.buf[1:]
-			case v := <-d.In:
-				d.buf = append(d.buf, v)
+				d.dequeued(len(d.buf))
+			case v := <-in:
+				d.enqueue(v)
 			}
 		} else {
 			v := <-d.In
-			d.buf = append(d.buf, v)
+			d.enqueue(v)
 		}
 	}
 }
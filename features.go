@@ -0,0 +1,344 @@
+package o3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FeatureMask bits as announced by Threema clients
+const (
+	FEATUREAUDIO      FeatureMask = 0x01 //indicates support for audio messages
+	FEATUREGROUPS     FeatureMask = 0x02 //indicates support for group chats
+	FEATUREPOLLS      FeatureMask = 0x04 //indicates support for polls
+	FEATUREFILES      FeatureMask = 0x08 //indicates support for file messages
+	FEATUREVOIP       FeatureMask = 0x10 //indicates support for audio calls
+	FEATUREVIDEOCALLS FeatureMask = 0x20 //indicates support for video calls
+)
+
+// DefaultFeatureMask is announced for identities created by CreateIdentity, the features
+// of what used to be feature level 4
+const DefaultFeatureMask = FEATUREAUDIO | FEATUREGROUPS | FEATUREPOLLS | FEATUREFILES
+
+// DefaultFeatureMaskTTL is how long a contact's feature mask is used before it is fetched
+// again if SessionContext.FeatureMaskTTL is zero
+const DefaultFeatureMaskTTL = 24 * time.Hour
+
+// requiredFeatures lists the message types a recipient's client has to announce support for
+var requiredFeatures = map[MsgType]FeatureMask{
+	AUDIOMESSAGE: FEATUREAUDIO,
+	POLLMESSAGE:  FEATUREPOLLS,
+	FILEMESSAGE:  FEATUREFILES,
+}
+
+// Has reports whether all features in f are set in m
+func (m FeatureMask) Has(f FeatureMask) bool {
+	return m&f == f
+}
+
+func (m FeatureMask) String() string {
+	names := []struct {
+		f    FeatureMask
+		name string
+	}{
+		{FEATUREAUDIO, "audio"},
+		{FEATUREGROUPS, "groups"},
+		{FEATUREPOLLS, "polls"},
+		{FEATUREFILES, "files"},
+		{FEATUREVOIP, "voip"},
+		{FEATUREVIDEOCALLS, "videocalls"},
+	}
+	var parts []string
+	rest := m
+	for _, n := range names {
+		if m.Has(n.f) {
+			parts = append(parts, n.name)
+			rest &^= n.f
+		}
+	}
+	if rest != 0 {
+		parts = append(parts, fmt.Sprintf("%#x", uint64(rest)))
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, "|")
+}
+
+// UnsupportedFeatureError is returned if a message is sent to a contact whose client
+// does not announce support for the message's type
+type UnsupportedFeatureError struct {
+	ID      IDString
+	Type    MsgType
+	Missing FeatureMask
+}
+
+func (e *UnsupportedFeatureError) Error() string {
+	return fmt.Sprintf("o3: %s cannot receive messages of type %#x, missing features: %s", e.ID, uint8(e.Type), e.Missing)
+}
+
+// SetFeatureMask announces the features supported by thid to the directory
+func (tr ThreemaRest) SetFeatureMask(thid ThreemaID, mask FeatureMask) error {
+	return tr.SetFeatureMaskContext(context.Background(), thid, mask)
+}
+
+// SetFeatureMaskContext is SetFeatureMask with a context controlling the requests
+func (tr ThreemaRest) SetFeatureMaskContext(ctx context.Context, thid ThreemaID, mask FeatureMask) error {
+	return tr.authenticatedRequest(ctx, "identity/set_featuremask", thid, map[string]interface{}{
+		"featureMask": mask,
+	}, nil)
+}
+
+// featureCache keeps the feature masks of contacts with the time they were fetched. It
+// is shared by all copies of a SessionContext. Entries of masks being fetched for the
+// first time have a zero fetched time.
+type featureCache struct {
+	mu      sync.Mutex
+	entries map[IDString]*featureEntry
+}
+
+type featureEntry struct {
+	mask       FeatureMask
+	fetched    time.Time
+	refreshing bool
+}
+
+func newFeatureCache() *featureCache {
+	return &featureCache{entries: make(map[IDString]*featureEntry)}
+}
+
+// get returns the cached feature mask of id, whether there is one and whether it was
+// fetched less than ttl ago
+func (fc *featureCache) get(id IDString, ttl time.Duration) (mask FeatureMask, ok, fresh bool) {
+	if fc == nil {
+		return 0, false, false
+	}
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	entry, ok := fc.entries[id]
+	if !ok || entry.fetched.IsZero() {
+		return 0, false, false
+	}
+	return entry.mask, true, time.Since(entry.fetched) < ttl
+}
+
+// put records the feature mask of id that has just been fetched
+func (fc *featureCache) put(id IDString, mask FeatureMask) {
+	if fc == nil {
+		return
+	}
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.entries[id] = &featureEntry{mask: mask, fetched: time.Now()}
+}
+
+// startRefresh marks the mask of id as being fetched and reports whether no other
+// fetch is running
+func (fc *featureCache) startRefresh(id IDString) bool {
+	if fc == nil {
+		return false
+	}
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	entry, ok := fc.entries[id]
+	if !ok {
+		fc.entries[id] = &featureEntry{refreshing: true}
+		return true
+	}
+	if entry.refreshing {
+		return false
+	}
+	entry.refreshing = true
+	return true
+}
+
+// endRefresh allows another fetch of the mask of id after a failed one
+func (fc *featureCache) endRefresh(id IDString) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	entry, ok := fc.entries[id]
+	if ok && entry.fetched.IsZero() {
+		delete(fc.entries, id)
+	} else if ok {
+		entry.refreshing = false
+	}
+}
+
+func (sc *SessionContext) featureMaskTTL() time.Duration {
+	if sc.FeatureMaskTTL == 0 {
+		return DefaultFeatureMaskTTL
+	}
+	return sc.FeatureMaskTTL
+}
+
+// ContactFeatures returns the feature mask of a contact. Masks are fetched from the
+// directory and cached for FeatureMaskTTL. Known contacts also keep theirs in the
+// Features field.
+func (sc *SessionContext) ContactFeatures(id IDString) (FeatureMask, error) {
+	if mask, ok, fresh := sc.features.get(id, sc.featureMaskTTL()); ok && fresh {
+		return mask, nil
+	}
+	return sc.fetchFeatures(id)
+}
+
+// fetchFeatures fetches the feature mask of a contact from the directory
+func (sc *SessionContext) fetchFeatures(id IDString) (FeatureMask, error) {
+	store := sc.contacts()
+	statuses, err := sc.Directory.CheckIdentities([]IDString{id})
+	if err != nil {
+		contact, _ := store.Get(id.String())
+		return contact.Features, err
+	}
+	status := statuses[0]
+	if status.State == IDENTITYINVALID {
+		return 0, fmt.Errorf("%w: %s", ErrIdentityNotFound, id)
+	}
+	if status.State == IDENTITYUNKNOWN {
+		contact, _ := store.Get(id.String())
+		return contact.Features, fmt.Errorf("o3: directory did not report on %s", id)
+	}
+	if err := sc.recordFeatures(id, status.Features); err != nil {
+		sc.reportError(err)
+	}
+	return status.Features, nil
+}
+
+// recordFeatures caches a freshly fetched feature mask and stores it in the contact if
+// it is known
+func (sc *SessionContext) recordFeatures(id IDString, mask FeatureMask) error {
+	sc.features.put(id, mask)
+	store := sc.contacts()
+	if contact, ok := store.Get(id.String()); ok && contact.Features != mask {
+		contact.Features = mask
+		return store.Put(contact)
+	}
+	return nil
+}
+
+// sendingFeatures returns the cached feature mask of a recipient for the send loop and
+// whether there is one. It never waits for the directory: missing and expired masks are
+// fetched in the background, expired ones are still used until then.
+func (sc *SessionContext) sendingFeatures(id IDString) (FeatureMask, bool) {
+	mask, ok, fresh := sc.features.get(id, sc.featureMaskTTL())
+	if !fresh && sc.features.startRefresh(id) {
+		go func() {
+			if _, err := sc.fetchFeatures(id); err != nil {
+				sc.features.endRefresh(id)
+				sc.reportError(err)
+			}
+		}()
+	}
+	return mask, ok
+}
+
+// CanReceive reports whether the client of a contact supports messages of type t
+func (sc *SessionContext) CanReceive(id IDString, t MsgType) (bool, error) {
+	required, ok := requiredFeatures[t]
+	if !ok {
+		return true, nil
+	}
+	mask, err := sc.ContactFeatures(id)
+	if err != nil {
+		return false, err
+	}
+	return mask.Has(required), nil
+}
+
+// checkCapabilities returns an *UnsupportedFeatureError if the recipient of msg cannot
+// display it. Messages to recipients whose features are not known yet are let through,
+// the send functions check them before a message is queued.
+func (sc *SessionContext) checkCapabilities(msg Message) error {
+	t, ok := messageType(msg)
+	if !ok {
+		return nil
+	}
+	if _, ok := requiredFeatures[t]; !ok {
+		return nil
+	}
+	recipient := msg.header().recipient
+	mask, known := sc.sendingFeatures(recipient)
+	if !known {
+		return nil
+	}
+	return missingFeatures(recipient, t, mask)
+}
+
+// messageType returns the type of msg if it may require a feature of the recipient,
+// without serializing the built in messages
+func messageType(msg Message) (MsgType, bool) {
+	switch m := msg.(type) {
+	case AudioMessage:
+		return AUDIOMESSAGE, true
+	case FileMessage:
+		return FILEMESSAGE, true
+	case TextMessage, TypingNotificationMessage, ImageMessage, DeliveryReceiptMessage,
+		GroupTextMessage, GroupImageMessage, GroupMemberLeftMessage, GroupManageSetImageMessage,
+		GroupManageSetMembersMessage, GroupManageSetNameMessage:
+		return 0, false
+	case outboxMessage:
+		if len(m.payload) == 0 {
+			return 0, false
+		}
+		return MsgType(m.payload[0]), true
+	}
+	plaintext := msg.Serialize()
+	if len(plaintext) == 0 {
+		return 0, false
+	}
+	return MsgType(plaintext[0]), true
+}
+
+// requireFeatures returns an *UnsupportedFeatureError if the client of recipient does not
+// support messages of type t. Only message types requiring a feature look up the mask,
+// which may wait for the directory. If the recipient's features cannot be determined,
+// sending is not held up; the lookup error is reported on ErrorChan instead.
+func (sc *SessionContext) requireFeatures(recipient IDString, t MsgType) error {
+	if _, ok := requiredFeatures[t]; !ok {
+		return nil
+	}
+	mask, err := sc.ContactFeatures(recipient)
+	if err != nil {
+		sc.reportError(err)
+		return nil
+	}
+	return missingFeatures(recipient, t, mask)
+}
+
+// missingFeatures returns an *UnsupportedFeatureError if mask lacks a feature required
+// for messages of type t
+func missingFeatures(recipient IDString, t MsgType, mask FeatureMask) error {
+	required := requiredFeatures[t]
+	if !mask.Has(required) {
+		return &UnsupportedFeatureError{ID: recipient, Type: t, Missing: required &^ mask}
+	}
+	return nil
+}
+
+// newFileOrMediaMessage returns a FileMessage for recipient. Clients without file support
+// get images as an ImageMessage and audio as an AudioMessage instead.
+func (sc *SessionContext) newFileOrMediaMessage(recipient string, filename string) (Message, error) {
+	id := NewIDString(recipient)
+	var unsupported *UnsupportedFeatureError
+	if err := sc.requireFeatures(id, FILEMESSAGE); !errors.As(err, &unsupported) {
+		return NewFileMessage(sc, recipient, filename)
+	}
+
+	content, err := readBlobFile(sc.blobs(), filename)
+	if err != nil {
+		return nil, err
+	}
+	var image, audio MediaInfo
+	if image.complete(content, "image") == nil {
+		return NewImageMessage(sc, recipient, filename)
+	}
+	if audio.complete(content, "audio") == nil {
+		if err := sc.requireFeatures(id, AUDIOMESSAGE); err != nil {
+			return nil, err
+		}
+		return NewAudioMessage(sc, recipient, filename)
+	}
+	return nil, unsupported
+}
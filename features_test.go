@@ -0,0 +1,216 @@
+package o3
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/o3ma/o3/o3test"
+)
+
+func TestCapabilityAwareSending(t *testing.T) {
+	fd := o3test.NewFakeDirectory()
+	defer fd.Close()
+
+	me, err := fakeRest(fd).CreateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fakeRest(fd).SetFeatureMask(me, FEATUREAUDIO|FEATUREGROUPS|FEATUREPOLLS|FEATUREFILES); err != nil {
+		t.Fatal(err)
+	}
+	if mask := FeatureMask(fd.FeatureMask(me.ID.String())); mask != 0x0f {
+		t.Errorf("feature mask not set, got %s", mask)
+	}
+
+	old := testContact("OLDCLNT1", 0x01)
+	old.Features = FEATUREGROUPS
+	addFakeContact(fd, old)
+
+	sc := NewSessionContext(me)
+	sc.Directory = fakeRest(fd)
+	sc.ID.Contacts.Add(testContact("OLDCLNT1", 0x01))
+
+	ok, err := sc.CanReceive(NewIDString("OLDCLNT1"), POLLMESSAGE)
+	if err != nil || ok {
+		t.Errorf("poll allowed to client without poll support: %v, %v", ok, err)
+	}
+	if c, _ := sc.ID.Contacts.Get("OLDCLNT1"); c.Features != FEATUREGROUPS {
+		t.Errorf("feature mask not cached in contact: %s", c.Features)
+	}
+
+	// the cached mask is used until it expires
+	addFakeContact(fd, testContact("OLDCLNT1", 0x01))
+	if mask, _ := sc.ContactFeatures(NewIDString("OLDCLNT1")); mask != FEATUREGROUPS {
+		t.Errorf("cached feature mask not used, got %s", mask)
+	}
+
+	var unsupported *UnsupportedFeatureError
+	err = sc.SendAudioMessage("OLDCLNT1", "audio.m4a", nil)
+	if !errors.As(err, &unsupported) || unsupported.Missing != FEATUREAUDIO {
+		t.Errorf("expected UnsupportedFeatureError, got %v", err)
+	}
+
+	tm, _ := NewTextMessage(&sc, "OLDCLNT1", "hello")
+	if err := sc.checkCapabilities(tm); err != nil {
+		t.Errorf("text message refused: %v", err)
+	}
+}
+
+func TestFeaturesOfNewContactCached(t *testing.T) {
+	fd := o3test.NewFakeDirectory()
+	defer fd.Close()
+
+	me, err := fakeRest(fd).CreateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newClient := testContact("NEWCLNT1", 0x02)
+	newClient.Features = FEATUREAUDIO | FEATUREGROUPS
+	addFakeContact(fd, newClient)
+
+	sc := NewSessionContext(me)
+	sc.Directory = fakeRest(fd)
+
+	// the contact is not in the store before the first send and stored by its dispatch,
+	// the second send uses the cached mask
+	for i := 0; i < 2; i++ {
+		if err := sc.requireFeatures(NewIDString("NEWCLNT1"), AUDIOMESSAGE); err != nil {
+			t.Fatalf("send %d refused: %v", i+1, err)
+		}
+		if _, err := sc.lookupContact(NewIDString("NEWCLNT1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if mask, err := sc.ContactFeatures(NewIDString("NEWCLNT1")); err != nil || mask != newClient.Features {
+		t.Errorf("cached feature mask %s, %v", mask, err)
+	}
+}
+
+func TestFileMessageFallback(t *testing.T) {
+	fd := o3test.NewFakeDirectory()
+	defer fd.Close()
+	fb := o3test.NewFakeBlobServer()
+	defer fb.Close()
+
+	for id, features := range map[string]FeatureMask{
+		"NEWCLNT1": DefaultFeatureMask,
+		"OLDCLNT1": FEATUREAUDIO | FEATUREGROUPS,
+		"ANCIENT1": FEATUREGROUPS,
+	} {
+		c := testContact(id, 0x01)
+		c.Features = features
+		addFakeContact(fd, c)
+	}
+
+	dir := t.TempDir()
+	var photo bytes.Buffer
+	jpeg.Encode(&photo, image.NewRGBA(image.Rect(0, 0, 40, 20)), nil)
+	files := map[string][]byte{
+		"photo.jpg": photo.Bytes(),
+		"voice.mp3": append([]byte("ID3"), bytes.Repeat([]byte{0}, 64)...),
+		"notes.txt": []byte("minutes of the meeting"),
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sc := NewSessionContext(ThreemaID{ID: NewIDString("ECHOECHO")})
+	sc.Directory = fakeRest(fd)
+	sc.Blobs = fakeBlobStore(fb)
+	sendMsgChan := make(chan Message, 1)
+
+	cases := []struct {
+		recipient, file string
+		want            MsgType
+	}{
+		{"NEWCLNT1", "notes.txt", FILEMESSAGE},
+		{"NEWCLNT1", "photo.jpg", FILEMESSAGE},
+		{"OLDCLNT1", "photo.jpg", IMAGEMESSAGE},
+		{"OLDCLNT1", "voice.mp3", AUDIOMESSAGE},
+		{"ANCIENT1", "photo.jpg", IMAGEMESSAGE},
+	}
+	for _, c := range cases {
+		if err := sc.SendFileMessage(c.recipient, filepath.Join(dir, c.file), sendMsgChan); err != nil {
+			t.Errorf("%s to %s: %v", c.file, c.recipient, err)
+			continue
+		}
+		msg := <-sendMsgChan
+		if got := MsgType(msg.Serialize()[0]); got != c.want {
+			t.Errorf("%s to %s sent as type %#x, want %#x", c.file, c.recipient, uint8(got), uint8(c.want))
+		}
+		if fm, ok := msg.(FileMessage); ok && (fm.FileName != c.file || fm.Size != uint32(len(files[c.file]))) {
+			t.Errorf("%s described as %q of %d bytes", c.file, fm.FileName, fm.Size)
+		}
+	}
+
+	var unsupported *UnsupportedFeatureError
+	err := sc.SendFileMessage("OLDCLNT1", filepath.Join(dir, "notes.txt"), sendMsgChan)
+	if !errors.As(err, &unsupported) || unsupported.Missing != FEATUREFILES {
+		t.Errorf("expected missing file support, got %v", err)
+	}
+	err = sc.SendFileMessage("ANCIENT1", filepath.Join(dir, "voice.mp3"), sendMsgChan)
+	if !errors.As(err, &unsupported) || unsupported.Missing != FEATUREAUDIO {
+		t.Errorf("expected missing audio support, got %v", err)
+	}
+}
+
+func TestSendLoopDoesNotWaitForFeatures(t *testing.T) {
+	fd := o3test.NewFakeDirectory()
+	defer fd.Close()
+	old := testContact("OLDCLNT1", 0x01)
+	old.Features = FEATUREGROUPS
+	addFakeContact(fd, old)
+
+	// a directory that does not answer until released
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		fd.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer slow.Close()
+	defer close(release)
+
+	sc := NewSessionContext(ThreemaID{ID: NewIDString("ECHOECHO")})
+	sc.Directory = ThreemaRest{BaseURL: slow.URL, Client: slow.Client()}
+	poll := outboxMessage{
+		messageHeader: messageHeader{recipient: NewIDString("OLDCLNT1")},
+		payload:       []byte{byte(POLLMESSAGE)}}
+
+	// unknown features are fetched in the background
+	done := make(chan error)
+	go func() { done <- sc.checkCapabilities(poll) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("message to recipient with unknown features refused: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("send loop waits for the directory")
+	}
+
+	release <- struct{}{}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok, _ := sc.features.get(NewIDString("OLDCLNT1"), time.Hour); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("feature mask not fetched in the background")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	var unsupported *UnsupportedFeatureError
+	if err := sc.checkCapabilities(poll); !errors.As(err, &unsupported) {
+		t.Errorf("poll to client without poll support not refused: %v", err)
+	}
+}
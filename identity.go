@@ -7,11 +7,12 @@ import (
 	"encoding/base32"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"strings"
+	"unicode"
 
-	"github.com/howeyc/gopass"
 	"golang.org/x/crypto/curve25519"
 	"golang.org/x/crypto/pbkdf2"
 	"golang.org/x/crypto/salsa20"
@@ -24,6 +25,11 @@ func (pn PubNick) String() string {
 	return string(pn[:])
 }
 
+// Trimmed returns the nickname without the zero bytes padding it to 32 bytes
+func (pn PubNick) Trimmed() string {
+	return strings.TrimRight(string(pn[:]), "\x00")
+}
+
 //NewPubNick creates a new PubNick from the input string.
 //Will only take the first 32 bytes of input
 func NewPubNick(pb string) PubNick {
@@ -64,19 +70,58 @@ func (thid ThreemaID) GetPubKey() *[32]byte {
 	return publicKey
 }
 
-// ReadPassword uses gopass to read a password from the command line without echoing it
+// ReadPassword uses gopass to read a password from the command line without echoing it.
+// The prompt is written to stderr so it does not mix with the program's output.
 func ReadPassword() ([]byte, error) {
-	fmt.Printf("Enter identity password: ")
+	return TTYSecret("Enter identity password: ")()
+}
+
+// ErrIDBackupPassword is returned if the checksum of a decrypted identity backup does not
+// match, which almost always means the password is wrong
+var ErrIDBackupPassword = errors.New("o3: identity backup checksum mismatch, wrong password?")
+
+// ErrInvalidIDBackup is wrapped by the errors returned for malformed identity backups
+var ErrInvalidIDBackup = errors.New("o3: invalid identity backup")
+
+// idBackupLength is the number of base32 characters in an identity backup without dashes
+const idBackupLength = 80
+
+// maxIDBackupFile limits how much of a file is read when looking for an identity backup
+const maxIDBackupFile = 4096
 
-	return gopass.GetPasswd()
+// normalizeIDBackup strips whitespace and dashes from an identity backup string and
+// checks that the remainder is a base32 string of the correct length
+func normalizeIDBackup(idstr string) (string, error) {
+	normalized := strings.Map(func(r rune) rune {
+		switch {
+		case r == '-' || unicode.IsSpace(r) || r == '\ufeff':
+			return -1
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		}
+		return r
+	}, idstr)
+
+	if len(normalized) != idBackupLength {
+		return "", fmt.Errorf("%w: expected %d base32 characters, found %d", ErrInvalidIDBackup, idBackupLength, len(normalized))
+	}
+	for i, c := range normalized {
+		if !(c >= 'A' && c <= 'Z' || c >= '2' && c <= '7') {
+			return "", fmt.Errorf("%w: invalid character %q at position %d", ErrInvalidIDBackup, c, i+1)
+		}
+	}
+	return normalized, nil
 }
 
 func decryptID(identity string, password []byte) ([]byte, []byte, error) {
-	b32 := strings.NewReplacer("-", "").Replace(identity)
-	buf, err := base32.StdEncoding.DecodeString(b32)
+	b32, err := normalizeIDBackup(identity)
 	if err != nil {
 		return nil, nil, err
 	}
+	buf, err := base32.StdEncoding.DecodeString(b32)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s", ErrInvalidIDBackup, err)
+	}
 	key := genkey(password, buf[0:8])
 
 	plain := make([]byte, 42)
@@ -92,7 +137,7 @@ func decryptID(identity string, password []byte) ([]byte, []byte, error) {
 		return id, pk, nil
 
 	}
-	return nil, nil, errors.New("Verification failed. Wrong password?")
+	return nil, nil, ErrIDBackupPassword
 }
 
 func genkey(password, salt []byte) [32]byte {
@@ -144,16 +189,34 @@ func LoadIDFromFile(filename string, password []byte) (ThreemaID, error) {
 	}
 	defer file.Close()
 
-	buf := make([]byte, 100)
+	return LoadID(file, StaticSecret(password))
+}
+
+// LoadID reads a Threema identity backup from r and decrypts it with the password
+// obtained from secret. Whitespace, line breaks in any style and dashes are ignored,
+// so backups copied from the app or saved on Windows load as well. The format is
+// checked before secret is asked for the password; malformed backups result in an
+// error wrapping ErrInvalidIDBackup, a wrong password in ErrIDBackupPassword.
+func LoadID(r io.Reader, secret SecretSource) (ThreemaID, error) {
+	buf, err := ioutil.ReadAll(io.LimitReader(r, maxIDBackupFile+1))
+	if err != nil {
+		return ThreemaID{}, err
+	}
+	if len(buf) > maxIDBackupFile {
+		return ThreemaID{}, fmt.Errorf("%w: more than %d bytes", ErrInvalidIDBackup, maxIDBackupFile)
+	}
+	idstr, err := normalizeIDBackup(string(buf))
+	if err != nil {
+		return ThreemaID{}, err
+	}
 
-	n, err := file.Read(buf)
+	password, err := secret()
 	if err != nil {
 		return ThreemaID{}, err
-	} else if n != 100 {
-		return ThreemaID{}, errors.New("File does not contain a valid ID")
 	}
+	defer wipe(password)
 
-	return ParseIDBackupString(string(buf), password)
+	return ParseIDBackupString(idstr, password)
 }
 
 // ParseIDBackupString parses the base32-encoded encrypted ID string contained in a threema backup.
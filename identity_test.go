@@ -0,0 +1,71 @@
+package o3
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadID(t *testing.T) {
+	password := []byte("secret")
+	var lsk [32]byte
+	lsk[0] = 0x99
+	idstr, err := encryptID([]byte("ECHOECHO"), lsk[:], password)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	asked := 0
+	callback := func() ([]byte, error) {
+		asked++
+		return []byte("secret"), nil
+	}
+
+	// leading whitespace, CRLF and a wrapped line are accepted
+	formatted := "\r\n  " + idstr[:50] + "\r\n" + strings.ToLower(idstr[50:]) + "\r\n"
+	thid, err := LoadID(strings.NewReader(formatted), callback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thid.String() != "ECHOECHO" || thid.LSK != lsk {
+		t.Errorf("wrong identity loaded: %s", thid)
+	}
+
+	if _, err := LoadID(strings.NewReader(idstr), StaticSecret([]byte("wrong"))); !errors.Is(err, ErrIDBackupPassword) {
+		t.Errorf("expected ErrIDBackupPassword, got %v", err)
+	}
+
+	asked = 0
+	if _, err := LoadID(strings.NewReader(idstr[:90]), callback); !errors.Is(err, ErrInvalidIDBackup) || asked != 0 {
+		t.Errorf("expected ErrInvalidIDBackup without asking for the password, got %v", err)
+	}
+	if _, err := LoadID(strings.NewReader("1"+idstr[1:]), callback); !errors.Is(err, ErrInvalidIDBackup) {
+		t.Errorf("expected ErrInvalidIDBackup for invalid character, got %v", err)
+	}
+
+	dir := t.TempDir()
+	passwordFile := filepath.Join(dir, "password")
+	ioutil.WriteFile(passwordFile, []byte("secret\r\n"), 0600)
+	if _, err := LoadID(strings.NewReader(idstr), FileSecret(passwordFile)); err != nil {
+		t.Errorf("file secret: %v", err)
+	}
+
+	t.Setenv("O3_TEST_PASSWORD", "secret")
+	if _, err := LoadID(strings.NewReader(idstr), EnvSecret("O3_TEST_PASSWORD")); err != nil {
+		t.Errorf("env secret: %v", err)
+	}
+	if _, err := LoadID(strings.NewReader(idstr), EnvSecret("O3_TEST_UNSET")); err == nil {
+		t.Error("unset environment variable accepted")
+	}
+
+	backupFile := filepath.Join(dir, "identity.txt")
+	ioutil.WriteFile(backupFile, []byte(idstr+"\n"), 0600)
+	if _, err := LoadIDFromFile(backupFile, password); err != nil {
+		t.Errorf("LoadIDFromFile: %v", err)
+	}
+	if string(password) != "secret" {
+		t.Error("caller's password was wiped")
+	}
+}
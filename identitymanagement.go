@@ -0,0 +1,143 @@
+package o3
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+)
+
+// LinkStatus holds the email address and phone number that are linked to an identity.
+// Fields are empty if nothing is linked or the link has not been verified yet.
+type LinkStatus struct {
+	Email string
+	Phone string
+}
+
+// LinkEmail links an email address to thid. The directory sends a verification email;
+// the address is linked once the link in it is followed. An empty email removes the link.
+func (tr ThreemaRest) LinkEmail(thid ThreemaID, email string) error {
+	return tr.LinkEmailContext(context.Background(), thid, email)
+}
+
+// LinkEmailContext is LinkEmail with a context controlling the requests
+func (tr ThreemaRest) LinkEmailContext(ctx context.Context, thid ThreemaID, email string) error {
+	if email != "" {
+		normalized, err := NormalizeEmail(email)
+		if err != nil {
+			return err
+		}
+		email = normalized
+	}
+	return tr.authenticatedRequest(ctx, "identity/link_email", thid, map[string]interface{}{
+		"email":    email,
+		"language": "en",
+	}, nil)
+}
+
+// LinkPhoneNumber links a phone number in international format to thid. The directory
+// sends a code by SMS, which has to be passed to VerifyPhoneNumber along with the
+// returned verification ID. An empty phone removes the link; the verification ID is
+// empty in that case.
+func (tr ThreemaRest) LinkPhoneNumber(thid ThreemaID, phone string) (string, error) {
+	return tr.LinkPhoneNumberContext(context.Background(), thid, phone)
+}
+
+// LinkPhoneNumberContext is LinkPhoneNumber with a context controlling the requests
+func (tr ThreemaRest) LinkPhoneNumberContext(ctx context.Context, thid ThreemaID, phone string) (string, error) {
+	if phone != "" {
+		normalized, err := NormalizePhoneNumber(phone)
+		if err != nil {
+			return "", err
+		}
+		phone = normalized
+	}
+
+	var result struct {
+		directoryResult
+		VerificationID string `json:"verificationId"`
+	}
+	err := tr.authenticatedRequest(ctx, "identity/link_mobileno", thid, map[string]interface{}{
+		"mobileNo": phone,
+		"language": "en",
+	}, &result)
+	return result.VerificationID, err
+}
+
+// VerifyPhoneNumber completes linking a phone number with the code received by SMS
+func (tr ThreemaRest) VerifyPhoneNumber(verificationID, code string) error {
+	return tr.VerifyPhoneNumberContext(context.Background(), verificationID, code)
+}
+
+// VerifyPhoneNumberContext is VerifyPhoneNumber with a context controlling the request
+func (tr ThreemaRest) VerifyPhoneNumberContext(ctx context.Context, verificationID, code string) error {
+	var result directoryResult
+	err := tr.do(ctx, "identity/link_mobileno", map[string]interface{}{
+		"verificationId": verificationID,
+		"code":           code,
+	}, &result)
+	if err != nil {
+		return err
+	}
+	if !result.Success {
+		return &DirectoryError{Op: "identity/link_mobileno", StatusCode: http.StatusOK, Message: result.Error}
+	}
+	return nil
+}
+
+// GetLinkStatus returns the email address and phone number currently linked to thid
+func (tr ThreemaRest) GetLinkStatus(thid ThreemaID) (LinkStatus, error) {
+	return tr.GetLinkStatusContext(context.Background(), thid)
+}
+
+// GetLinkStatusContext is GetLinkStatus with a context controlling the requests
+func (tr ThreemaRest) GetLinkStatusContext(ctx context.Context, thid ThreemaID) (LinkStatus, error) {
+	var result struct {
+		directoryResult
+		Email    string `json:"email"`
+		MobileNo string `json:"mobileNo"`
+	}
+	if err := tr.authenticatedRequest(ctx, "identity/fetch_priv", thid, map[string]interface{}{}, &result); err != nil {
+		return LinkStatus{}, err
+	}
+	status := LinkStatus{Email: result.Email}
+	if result.MobileNo != "" {
+		status.Phone = "+" + result.MobileNo
+	}
+	return status, nil
+}
+
+// SetRevocationPassword sets the password that allows revoking thid without its secret
+// key, e.g. on the Threema website
+func (tr ThreemaRest) SetRevocationPassword(thid ThreemaID, password string) error {
+	return tr.SetRevocationPasswordContext(context.Background(), thid, password)
+}
+
+// SetRevocationPasswordContext is SetRevocationPassword with a context controlling the requests
+func (tr ThreemaRest) SetRevocationPasswordContext(ctx context.Context, thid ThreemaID, password string) error {
+	if password == "" {
+		return errors.New("o3: empty revocation password")
+	}
+	return tr.authenticatedRequest(ctx, "identity/set_revocation_key", thid, map[string]interface{}{
+		"revocationKey": revocationKey(password),
+	}, nil)
+}
+
+// RevokeIdentity permanently revokes thid. Revoked identities can neither send nor
+// receive messages and their ID is never assigned again.
+func (tr ThreemaRest) RevokeIdentity(thid ThreemaID) error {
+	return tr.RevokeIdentityContext(context.Background(), thid)
+}
+
+// RevokeIdentityContext is RevokeIdentity with a context controlling the requests
+func (tr ThreemaRest) RevokeIdentityContext(ctx context.Context, thid ThreemaID) error {
+	return tr.authenticatedRequest(ctx, "identity/revoke", thid, map[string]interface{}{}, nil)
+}
+
+// revocationKey derives the value the directory stores for a revocation password:
+// the first four bytes of its SHA-256 hash
+func revocationKey(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return base64.StdEncoding.EncodeToString(sum[:4])
+}
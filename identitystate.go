@@ -0,0 +1,115 @@
+package o3
+
+import (
+	"context"
+	"fmt"
+)
+
+// IdentityState is the state of an identity as reported by the directory
+type IdentityState uint8
+
+// IdentityStates as used by the directory's identity/check endpoint
+const (
+	IDENTITYACTIVE   IdentityState = 0 //indicates the identity is in use
+	IDENTITYINACTIVE IdentityState = 1 //indicates the identity has not been used for a long time but can still receive messages
+	IDENTITYINVALID  IdentityState = 2 //indicates the identity has been revoked or never existed
+
+	IDENTITYUNKNOWN IdentityState = 0xff //indicates the directory did not report on the identity
+)
+
+func (s IdentityState) String() string {
+	switch s {
+	case IDENTITYACTIVE:
+		return "active"
+	case IDENTITYINACTIVE:
+		return "inactive"
+	case IDENTITYINVALID:
+		return "invalid"
+	case IDENTITYUNKNOWN:
+		return "unknown"
+	}
+	return fmt.Sprintf("IdentityState(%d)", uint8(s))
+}
+
+// IdentityStatus is the state and feature mask of a single identity
+type IdentityStatus struct {
+	ID       IDString
+	State    IdentityState
+	Features FeatureMask
+}
+
+// PruneRevoked checks the state of all contacts and group members known to the session
+// and removes revoked identities from the ContactStore and from the members of all groups.
+// Only identities the directory reports as IDENTITYINVALID are removed; those it does not
+// report on are kept. The feature masks of the remaining contacts are updated. It returns
+// the removed IDs.
+func (sc *SessionContext) PruneRevoked(ctx context.Context) ([]IDString, error) {
+	store := sc.contacts()
+
+	seen := make(map[IDString]bool)
+	var ids []IDString
+	addID := func(id IDString) {
+		if id != sc.ID.ID && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	for _, contact := range store.List() {
+		addID(IDString(contact.ID))
+	}
+	for _, groups := range sc.ID.Groups {
+		for _, group := range groups {
+			for _, member := range group.Members {
+				addID(member)
+			}
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	statuses, err := sc.Directory.CheckIdentitiesContext(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	revoked := make(map[IDString]bool)
+	var removed []IDString
+	for _, status := range statuses {
+		if status.State == IDENTITYINVALID {
+			revoked[status.ID] = true
+			removed = append(removed, status.ID)
+			if _, ok := store.Get(status.ID.String()); ok {
+				if err := store.Delete(status.ID.String()); err != nil {
+					return removed, err
+				}
+			}
+			continue
+		}
+		if status.State == IDENTITYUNKNOWN {
+			continue
+		}
+		if err := sc.recordFeatures(status.ID, status.Features); err != nil {
+			return removed, err
+		}
+	}
+
+	for creator, groups := range sc.ID.Groups {
+		for groupID, group := range groups {
+			sc.ID.Groups[creator][groupID] = group.withoutMembers(revoked)
+		}
+	}
+	return removed, nil
+}
+
+// withoutMembers returns a copy of the group with all members contained in ids removed
+func (g Group) withoutMembers(ids map[IDString]bool) Group {
+	members := make([]IDString, 0, len(g.Members))
+	for _, member := range g.Members {
+		if !ids[member] {
+			members = append(members, member)
+		}
+	}
+	g.Members = members
+	return g
+}
@@ -0,0 +1,191 @@
+package o3
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/draw"
+	"image/jpeg"
+)
+
+// Defaults of ImageOptions
+const (
+	DefaultImageMaxSize       = 1600
+	DefaultImageQuality       = 85
+	DefaultImageThumbnailSize = 256
+)
+
+// ImageOptions configures the preprocessing of images before they are sent: they are
+// decoded, rotated upright according to their EXIF orientation, scaled down and
+// re-encoded as JPEG without any metadata, which drops EXIF data such as the GPS
+// position. Animated GIFs are reduced to their first frame.
+type ImageOptions struct {
+	// MaxSize is the maximum width and height of sent images, DefaultImageMaxSize if zero
+	MaxSize int
+	// Quality is the JPEG quality from 1 to 100, DefaultImageQuality if zero
+	Quality int
+	// ThumbnailSize is the maximum width and height of the thumbnail,
+	// DefaultImageThumbnailSize if zero
+	ThumbnailSize int
+}
+
+func (opts ImageOptions) maxSize() int {
+	if opts.MaxSize > 0 {
+		return opts.MaxSize
+	}
+	return DefaultImageMaxSize
+}
+
+func (opts ImageOptions) quality() int {
+	if opts.Quality > 0 {
+		return opts.Quality
+	}
+	return DefaultImageQuality
+}
+
+func (opts ImageOptions) thumbnailSize() int {
+	if opts.ThumbnailSize > 0 {
+		return opts.ThumbnailSize
+	}
+	return DefaultImageThumbnailSize
+}
+
+// PrepareImage runs an image through the preprocessing configured by opts. It returns
+// the JPEG to send and a MediaInfo describing it, including a JPEG thumbnail.
+func PrepareImage(data []byte, opts ImageOptions) ([]byte, MediaInfo, error) {
+	img, err := decodeImage(data)
+	if err != nil {
+		return nil, MediaInfo{}, err
+	}
+	upright := orientImage(toRGBA(img), exifOrientation(data))
+
+	width, height := fitSize(upright.Bounds().Dx(), upright.Bounds().Dy(), opts.maxSize())
+	scaled := scaleImage(upright, width, height)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, scaled, &jpeg.Options{Quality: opts.quality()}); err != nil {
+		return nil, MediaInfo{}, err
+	}
+
+	thumbWidth, thumbHeight := fitSize(width, height, opts.thumbnailSize())
+	var thumb bytes.Buffer
+	if err := jpeg.Encode(&thumb, scaleImage(scaled, thumbWidth, thumbHeight), &jpeg.Options{Quality: 75}); err != nil {
+		return nil, MediaInfo{}, err
+	}
+
+	info := MediaInfo{
+		MIMEType:  "image/jpeg",
+		Width:     width,
+		Height:    height,
+		Thumbnail: thumb.Bytes()}
+	return buf.Bytes(), info, nil
+}
+
+// prepareImage preprocesses an image if opts is not nil and returns it unchanged otherwise
+func prepareImage(opts *ImageOptions, data []byte, info MediaInfo) ([]byte, MediaInfo, error) {
+	if opts == nil {
+		return data, info, nil
+	}
+	return PrepareImage(data, *opts)
+}
+
+// toRGBA returns img as *image.RGBA with its origin at (0, 0)
+func toRGBA(img image.Image) *image.RGBA {
+	bounds := img.Bounds()
+	if rgba, ok := img.(*image.RGBA); ok && bounds.Min == (image.Point{}) {
+		return rgba
+	}
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, bounds.Min, draw.Src)
+	return rgba
+}
+
+// orientImage turns an image stored with the given EXIF orientation upright
+func orientImage(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dstW, dstH := w, h
+	if orientation >= 5 {
+		dstW, dstH = h, w
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < dstH; y++ {
+		for x := 0; x < dstW; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // flip horizontally
+				sx, sy = w-1-x, y
+			case 3: // rotate by 180°
+				sx, sy = w-1-x, h-1-y
+			case 4: // flip vertically
+				sx, sy = x, h-1-y
+			case 5: // transpose
+				sx, sy = y, x
+			case 6: // rotate clockwise
+				sx, sy = y, h-1-x
+			case 7: // transverse
+				sx, sy = w-1-y, h-1-x
+			case 8: // rotate counterclockwise
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[y*dst.Stride+x*4:y*dst.Stride+x*4+4], src.Pix[sy*src.Stride+sx*4:])
+		}
+	}
+	return dst
+}
+
+// exifOrientation returns the orientation tag of a JPEG's EXIF data, or 1 (upright) if
+// there is none
+func exifOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	data = data[2:]
+	for len(data) >= 4 && data[0] == 0xFF {
+		marker := data[1]
+		length := int(binary.BigEndian.Uint16(data[2:]))
+		// the EXIF data precedes the image data
+		if marker == 0xDA || length < 2 || len(data) < 2+length {
+			break
+		}
+		segment := data[4 : 2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+		data = data[2+length:]
+	}
+	return 1
+}
+
+// tiffOrientation reads the orientation tag from the first IFD of a TIFF structure
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	offset := int(order.Uint32(tiff[4:]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < entries; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			return int(order.Uint16(tiff[entry+8:]))
+		}
+	}
+	return 1
+}
@@ -0,0 +1,92 @@
+package o3
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/o3ma/o3/o3test"
+)
+
+func TestPrepareImage(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 400; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 0x80, 0xFF})
+		}
+	}
+	var encoded bytes.Buffer
+	jpeg.Encode(&encoded, img, nil)
+
+	// insert EXIF data claiming the camera was rotated and carrying a fake position
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x06\x00\x00\x00\x00\x00\x00GPS 47.3769N 8.5417E")
+	exif := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(app1[2:], uint16(2+len(exif)))
+	photo := append(append(append([]byte{}, encoded.Bytes()[:2]...), append(app1, exif...)...), encoded.Bytes()[2:]...)
+	if exifOrientation(photo) != 6 {
+		t.Fatal("test photo has no orientation")
+	}
+
+	prepared, info, err := PrepareImage(photo, ImageOptions{MaxSize: 100, ThumbnailSize: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(prepared, []byte("Exif")) || bytes.Contains(prepared, []byte("GPS")) {
+		t.Error("metadata was not stripped")
+	}
+	config, err := jpeg.DecodeConfig(bytes.NewReader(prepared))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// rotated upright and scaled down
+	if config.Width != 50 || config.Height != 100 || info.Width != 50 || info.Height != 100 {
+		t.Errorf("got %dx%d (info %dx%d), want 50x100", config.Width, config.Height, info.Width, info.Height)
+	}
+	thumb, err := ProbeImage(info.Thumbnail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thumb.Width != 10 || thumb.Height != 20 {
+		t.Errorf("got thumbnail %dx%d, want 10x20", thumb.Width, thumb.Height)
+	}
+}
+
+func TestGroupImageUsesSessionSettings(t *testing.T) {
+	fb := o3test.NewFakeBlobServer()
+	defer fb.Close()
+
+	var encoded bytes.Buffer
+	jpeg.Encode(&encoded, image.NewRGBA(image.Rect(0, 0, 400, 200)), nil)
+	filename := filepath.Join(t.TempDir(), "group.jpg")
+	if err := ioutil.WriteFile(filename, encoded.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	sc := NewSessionContext(ThreemaID{ID: NewIDString("ECHOECHO")})
+	sc.Blobs = fakeBlobStore(fb)
+	sc.ImageOptions = &ImageOptions{MaxSize: 100}
+
+	check := func(err error, im groupImageMessageBody) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := fb.Blob(im.BlobID); !ok {
+			t.Error("image not uploaded to the session's blob store")
+		}
+		if im.Info.Width != 100 {
+			t.Errorf("image options not applied, width %d", im.Info.Width)
+		}
+	}
+	var gim GroupImageMessage
+	err := gim.SetImageData(filename, sc)
+	check(err, gim.groupImageMessageBody)
+	var sim GroupManageSetImageMessage
+	err = sim.SetImageData(filename, sc)
+	check(err, sim.groupImageMessageBody)
+}
@@ -0,0 +1,104 @@
+package o3
+
+import "fmt"
+
+// InboundPolicy decides which senders may deliver messages to a session
+type InboundPolicy uint8
+
+// InboundPolicy mock enum
+const (
+	BLOCKLIST    InboundPolicy = 0x0 //indicates messages from all senders except blocked contacts are accepted
+	ALLOWALL     InboundPolicy = 0x1 //indicates messages from all senders are accepted, even from blocked contacts
+	CONTACTSONLY InboundPolicy = 0x2 //indicates only messages from known contacts that are not blocked are accepted
+)
+
+// InboundFilter configures how a session screens the senders of incoming messages.
+// Rejected messages are always acknowledged to the server, so they are not delivered
+// again, but they never show up on the receive channel.
+type InboundFilter struct {
+	Policy InboundPolicy
+	// FilterGroups applies CONTACTSONLY to group messages as well. By default group
+	// messages from non-contacts are accepted, since group members need not be contacts.
+	// Their senders are not added to the ContactStore.
+	FilterGroups bool
+	// Quarantine receives rejected messages instead of dropping them. Sending blocks the
+	// receive loop, so the channel should be buffered and drained. With ManualAck they
+	// have to be acknowledged like any other message.
+	Quarantine chan<- ReceivedMsg
+}
+
+// senderVerdict is the outcome of screening the sender of an incoming message
+type senderVerdict uint8
+
+const (
+	senderAccepted senderVerdict = iota
+	senderRejected
+	// senderGroupsOnly means only group messages from this sender are accepted
+	senderGroupsOnly
+)
+
+// screenSender applies the session's InboundFilter to the sender of a message
+func (sc *SessionContext) screenSender(sender IDString) senderVerdict {
+	contact, known := sc.contacts().Get(sender.String())
+
+	switch sc.Inbound.Policy {
+	case ALLOWALL:
+		return senderAccepted
+	case CONTACTSONLY:
+		if known && !contact.Blocked {
+			return senderAccepted
+		} else if known || sc.Inbound.FilterGroups {
+			return senderRejected
+		}
+		return senderGroupsOnly
+	default:
+		if known && contact.Blocked {
+			return senderRejected
+		}
+		return senderAccepted
+	}
+}
+
+// isGroupMessage reports whether a decrypted message payload is a group message
+func isGroupMessage(plaintext []byte) bool {
+	if len(plaintext) == 0 {
+		return false
+	}
+	switch MsgType(plaintext[0]) {
+	case GROUPTEXTMESSAGE, GROUPIMAGEMESSAGE, GROUPSETMEMEBERSMESSAGE, GROUPSETNAMEMESSAGE,
+		GROUPMEMBERLEFTMESSAGE, GROUPSETIMAGEMESSAGE:
+		return true
+	}
+	return false
+}
+
+// Block marks the given ID as blocked in the session's ContactStore. IDs not yet known
+// are stored without a public key, which is fetched from the directory once needed.
+func (sc *SessionContext) Block(id IDString) error {
+	return sc.setBlocked(id, true)
+}
+
+// Unblock removes the blocked mark from a contact. Contacts that were only stored to be
+// blocked, i.e. without a public key, are deleted.
+func (sc *SessionContext) Unblock(id IDString) error {
+	return sc.setBlocked(id, false)
+}
+
+func (sc *SessionContext) setBlocked(id IDString, blocked bool) error {
+	store := sc.contacts()
+	contact, ok := store.Get(id.String())
+	if !ok {
+		if !blocked {
+			return nil
+		}
+		if !validIDString(id.String()) {
+			return fmt.Errorf("o3: invalid Threema ID: %q", id.String())
+		}
+		contact = ThreemaContact{ID: id}
+	}
+	if !blocked && !contact.hasKey() {
+		return store.Delete(id.String())
+	}
+	contact.Blocked = blocked
+	return store.Put(contact)
+}
@@ -0,0 +1,50 @@
+package o3
+
+import "testing"
+
+func TestScreenSender(t *testing.T) {
+	sc := NewSessionContext(ThreemaID{ID: NewIDString("ECHOECHO")})
+	sc.ID.Contacts.Add(testContact("FRIEND01", 0x01))
+	if err := sc.Block(NewIDString("SPAMMER1")); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		policy       InboundPolicy
+		filterGroups bool
+		sender       string
+		want         senderVerdict
+	}{
+		{BLOCKLIST, false, "FRIEND01", senderAccepted},
+		{BLOCKLIST, false, "STRANGER", senderAccepted},
+		{BLOCKLIST, false, "SPAMMER1", senderRejected},
+		{ALLOWALL, false, "SPAMMER1", senderAccepted},
+		{CONTACTSONLY, false, "FRIEND01", senderAccepted},
+		{CONTACTSONLY, false, "STRANGER", senderGroupsOnly},
+		{CONTACTSONLY, true, "STRANGER", senderRejected},
+		{CONTACTSONLY, false, "SPAMMER1", senderRejected},
+	}
+	for _, c := range cases {
+		sc.Inbound = InboundFilter{Policy: c.policy, FilterGroups: c.filterGroups}
+		if got := sc.screenSender(NewIDString(c.sender)); got != c.want {
+			t.Errorf("policy %d, filter groups %v, sender %s: got verdict %d, want %d",
+				c.policy, c.filterGroups, c.sender, got, c.want)
+		}
+	}
+
+	if err := sc.Unblock(NewIDString("SPAMMER1")); err != nil {
+		t.Fatal(err)
+	}
+	sc.Inbound = InboundFilter{Policy: BLOCKLIST}
+	if got := sc.screenSender(NewIDString("SPAMMER1")); got != senderAccepted {
+		t.Errorf("unblocked sender still rejected")
+	}
+	// blocked only, so the sender is a stranger again
+	if _, ok := sc.ID.Contacts.Get("SPAMMER1"); ok {
+		t.Errorf("keyless contact kept after unblocking")
+	}
+	sc.Inbound = InboundFilter{Policy: CONTACTSONLY}
+	if got := sc.screenSender(NewIDString("SPAMMER1")); got != senderGroupsOnly {
+		t.Errorf("unblocked stranger treated as contact")
+	}
+}
@@ -0,0 +1,154 @@
+package o3
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultKeyRecheckInterval is how often the key of a contact is fetched again at most if
+// SessionContext.KeyRecheckInterval is zero
+const DefaultKeyRecheckInterval = 10 * time.Minute
+
+// KeyMismatchError is reported when the directory returns a public key for a contact
+// that differs from the key pinned in the session's ContactStore.
+type KeyMismatchError struct {
+	ID       IDString
+	Pinned   [32]byte
+	Reported [32]byte
+	// Refused is set if the pinned key is kept and the session refuses to use the contact
+	Refused bool
+}
+
+func (e *KeyMismatchError) Error() string {
+	if e.Refused {
+		return fmt.Sprintf("o3: public key of %s changed from %s to %s; contact refused until the change is accepted",
+			e.ID, hex.EncodeToString(e.Pinned[:]), hex.EncodeToString(e.Reported[:]))
+	}
+	return fmt.Sprintf("o3: public key of %s changed from %s to %s",
+		e.ID, hex.EncodeToString(e.Pinned[:]), hex.EncodeToString(e.Reported[:]))
+}
+
+// CheckContactKey compares the pinned public key of a contact with the key currently
+// published by the directory. Unknown contacts are fetched and pinned. If the keys differ
+// a *KeyMismatchError is returned after the change has been handled as described at
+// SessionContext.StrictKeys.
+func (sc *SessionContext) CheckContactKey(id IDString) error {
+	contact, ok := sc.contacts().Get(id.String())
+	if !ok {
+		_, err := sc.lookupContact(id)
+		return err
+	}
+	_, err := sc.recheckContactKey(contact)
+	return err
+}
+
+// AcceptKeyChange replaces the pinned key of a contact with the changed key reported by
+// the directory. The contact's verification level is reset to UNVERIFIED.
+func (sc *SessionContext) AcceptKeyChange(id IDString) error {
+	store := sc.contacts()
+	contact, ok := store.Get(id.String())
+	if !ok {
+		return fmt.Errorf("o3: unknown contact %s", id)
+	}
+	if !contact.KeyChanged {
+		return nil
+	}
+
+	contact.LPK = contact.ChangedLPK
+	contact.ChangedLPK = [32]byte{}
+	contact.KeyChanged = false
+	contact.Verification = UNVERIFIED
+	return store.Put(contact)
+}
+
+// refuseChangedKey returns an error if a changed key of contact has been kept back, i.e.
+// the session is strict or the contact was verified
+func (sc *SessionContext) refuseChangedKey(contact ThreemaContact) error {
+	if !contact.KeyChanged {
+		return nil
+	}
+	return &KeyMismatchError{
+		ID:       IDString(contact.ID),
+		Pinned:   contact.LPK,
+		Reported: contact.ChangedLPK,
+		Refused:  true}
+}
+
+// keyCheckLimiter records when the keys of contacts were last rechecked. It is shared by
+// all copies of a SessionContext.
+type keyCheckLimiter struct {
+	mu      sync.Mutex
+	checked map[IDString]time.Time
+}
+
+func newKeyCheckLimiter() *keyCheckLimiter {
+	return &keyCheckLimiter{checked: make(map[IDString]time.Time)}
+}
+
+// allow reports whether the key of id may be rechecked and records the check if so
+func (kl *keyCheckLimiter) allow(id IDString, interval time.Duration) bool {
+	if kl == nil {
+		return true
+	}
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+	if last, ok := kl.checked[id]; ok && time.Since(last) < interval {
+		return false
+	}
+	kl.checked[id] = time.Now()
+	return true
+}
+
+// recheckLimited is recheckContactKey for messages that cannot be decrypted. Each
+// contact is rechecked once per KeyRecheckInterval at most, so a flood of undecryptable
+// messages does not become a flood of directory requests.
+func (sc *SessionContext) recheckLimited(contact ThreemaContact) (ThreemaContact, error) {
+	interval := sc.KeyRecheckInterval
+	if interval == 0 {
+		interval = DefaultKeyRecheckInterval
+	}
+	if !sc.keyChecks.allow(IDString(contact.ID), interval) {
+		return contact, fmt.Errorf("o3: key of %s was rechecked recently", IDString(contact.ID))
+	}
+	return sc.recheckContactKey(contact)
+}
+
+// recheckContactKey fetches the key of a pinned contact from the directory. It returns
+// the contact that should be used from now on, which is only different from the given
+// one if the key changed, the session is not strict and the contact is UNVERIFIED.
+func (sc *SessionContext) recheckContactKey(contact ThreemaContact) (ThreemaContact, error) {
+	fetched, err := sc.Directory.GetContactByID(IDString(contact.ID))
+	if err != nil {
+		return contact, err
+	}
+	if fetched.LPK == contact.LPK {
+		return contact, nil
+	}
+	contact.KeyFetched = fetched.KeyFetched
+
+	// a verified key is never replaced behind the user's back
+	keep := sc.StrictKeys || contact.Verification != UNVERIFIED
+	mismatch := &KeyMismatchError{
+		ID:       IDString(contact.ID),
+		Pinned:   contact.LPK,
+		Reported: fetched.LPK,
+		Refused:  keep}
+
+	if keep {
+		contact.KeyChanged = true
+		contact.ChangedLPK = fetched.LPK
+	} else {
+		contact.LPK = fetched.LPK
+		contact.KeyChanged = false
+		contact.ChangedLPK = [32]byte{}
+		contact.Verification = UNVERIFIED
+	}
+	if err := sc.contacts().Put(contact); err != nil {
+		sc.reportError(err)
+	}
+	sc.reportError(mismatch)
+
+	return contact, mismatch
+}
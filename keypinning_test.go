@@ -0,0 +1,106 @@
+package o3
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/o3ma/o3/o3test"
+)
+
+func TestVerifiedKeyNotReplaced(t *testing.T) {
+	fd := o3test.NewFakeDirectory()
+	defer fd.Close()
+
+	sc := NewSessionContext(ThreemaID{ID: NewIDString("ECHOECHO")})
+	sc.Directory = fakeRest(fd)
+
+	verified := testContact("FRIEND01", 0x01)
+	verified.Verification = FULLYVERIFIED
+	sc.ID.Contacts.Add(verified)
+	sc.ID.Contacts.Add(testContact("FRIEND02", 0x01))
+	addFakeContact(fd, testContact("FRIEND01", 0x02))
+	addFakeContact(fd, testContact("FRIEND02", 0x02))
+
+	// not strict, still the verified key is kept
+	var mismatch *KeyMismatchError
+	if err := sc.CheckContactKey(NewIDString("FRIEND01")); !errors.As(err, &mismatch) || !mismatch.Refused {
+		t.Fatalf("expected refused key mismatch, got %v", err)
+	}
+	if c, _ := sc.ID.Contacts.Get("FRIEND01"); c.LPK != verified.LPK || c.Verification != FULLYVERIFIED {
+		t.Error("verified key replaced")
+	}
+	if _, err := sc.lookupContact(NewIDString("FRIEND01")); !errors.As(err, &mismatch) {
+		t.Errorf("changed verified contact not refused: %v", err)
+	}
+
+	if err := sc.CheckContactKey(NewIDString("FRIEND02")); !errors.As(err, &mismatch) || mismatch.Refused {
+		t.Fatalf("expected adopted key mismatch, got %v", err)
+	}
+	if c, _ := sc.ID.Contacts.Get("FRIEND02"); c.LPK != testContact("FRIEND02", 0x02).LPK {
+		t.Error("unverified key not replaced")
+	}
+}
+
+func TestKeyRecheckLimited(t *testing.T) {
+	fd := o3test.NewFakeDirectory()
+	defer fd.Close()
+
+	sc := NewSessionContext(ThreemaID{ID: NewIDString("ECHOECHO")})
+	sc.Directory = fakeRest(fd)
+	sc.KeyRecheckInterval = time.Hour
+	friend := testContact("FRIEND01", 0x01)
+	addFakeContact(fd, friend)
+
+	if _, err := sc.recheckLimited(friend); err != nil {
+		t.Fatal(err)
+	}
+	addFakeContact(fd, testContact("FRIEND01", 0x02))
+	if c, err := sc.recheckLimited(friend); err == nil || c.LPK != friend.LPK {
+		t.Errorf("key rechecked again within the interval: %v", err)
+	}
+}
+
+func TestRefusedRecipientSkipped(t *testing.T) {
+	fd := o3test.NewFakeDirectory()
+	defer fd.Close()
+
+	sc := NewSessionContext(ThreemaID{ID: NewIDString("ECHOECHO")})
+	sc.Directory = fakeRest(fd)
+	verified := testContact("FRIEND01", 0x01)
+	verified.Verification = FULLYVERIFIED
+	sc.ID.Contacts.Add(verified)
+	sc.ID.Contacts.Add(testContact("FRIEND02", 0x01))
+	addFakeContact(fd, testContact("FRIEND01", 0x02))
+	if err := sc.CheckContactKey(NewIDString("FRIEND01")); err == nil {
+		t.Fatal("key change not detected")
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	sc.connection = client
+	go sc.sendLoop()
+
+	refused, _ := NewTextMessage(&sc, "FRIEND01", "lost")
+	delivered, _ := NewTextMessage(&sc, "FRIEND02", "sent")
+	sc.sendMsgChan.In <- refused
+	sc.sendMsgChan.In <- delivered
+
+	// the refused message is reported, the loop goes on with the next one
+	var mismatch *KeyMismatchError
+	if err := <-sc.ErrorChan; !errors.As(err, &mismatch) || mismatch.ID != refused.header().recipient {
+		t.Fatalf("got %v, want refused key of FRIEND01", err)
+	}
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var size uint16
+	if err := binary.Read(server, binary.LittleEndian, &size); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(server, make([]byte, size)); err != nil {
+		t.Fatal(err)
+	}
+}
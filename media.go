@@ -0,0 +1,280 @@
+package o3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ErrUnsupportedMedia is returned if media cannot be sent with the requested message type
+var ErrUnsupportedMedia = errors.New("o3: unsupported media type")
+
+// MediaInfo describes the content of a media message. Fields that are unknown stay zero.
+type MediaInfo struct {
+	// MIMEType is the type of the content, e.g. "image/jpeg". If empty the constructors
+	// detect it from the content.
+	MIMEType string
+	// Duration is the play time of audio
+	Duration time.Duration
+	// Width and Height are the dimensions of images in pixels
+	Width  int
+	Height int
+	// Thumbnail is a JPEG preview of images, set by the image preprocessing
+	Thumbnail []byte
+}
+
+// complete fills in the fields of mi that are unknown by probing content and ensures
+// the content has the wanted kind, e.g. "image"
+func (mi *MediaInfo) complete(content []byte, kind string) error {
+	var probed MediaInfo
+	switch kind {
+	case "image":
+		if mi.MIMEType == "" || mi.Width == 0 || mi.Height == 0 {
+			probed, _ = ProbeImage(content)
+		}
+	case "audio":
+		if mi.MIMEType == "" || mi.Duration == 0 {
+			probed, _ = ProbeAudio(content)
+		}
+	}
+	if mi.MIMEType == "" {
+		mi.MIMEType = probed.MIMEType
+	}
+	if mi.MIMEType == "" {
+		mi.MIMEType = http.DetectContentType(content)
+	}
+	if mi.Duration == 0 {
+		mi.Duration = probed.Duration
+	}
+	if mi.Width == 0 || mi.Height == 0 {
+		mi.Width, mi.Height = probed.Width, probed.Height
+	}
+
+	mimeType := strings.ToLower(mi.MIMEType)
+	if strings.HasPrefix(mimeType, kind+"/") {
+		return nil
+	}
+	// AAC audio in an MP4 container is commonly labelled as video and Ogg is detected
+	// without telling audio from video
+	if kind == "audio" && (strings.HasPrefix(mimeType, "video/mp4") || strings.HasPrefix(mimeType, "application/ogg")) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s is not %s", ErrUnsupportedMedia, mi.MIMEType, kind)
+}
+
+// durationSeconds converts a duration to the whole seconds of audio messages, rounding up
+func durationSeconds(d time.Duration) uint16 {
+	seconds := (d + time.Second - 1) / time.Second
+	if seconds > 0xFFFF {
+		return 0xFFFF
+	}
+	if seconds < 0 {
+		return 0
+	}
+	return uint16(seconds)
+}
+
+// readBlobSource reads media that is to be encrypted and uploaded to store. Media that
+// would exceed the store's maximum blob size once encrypted is rejected.
+func readBlobSource(store BlobStore, r io.Reader) ([]byte, error) {
+	limit := maxBlobSize(store) - blobOverhead
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(io.LimitReader(r, limit+1)); err != nil {
+		return nil, err
+	}
+	if int64(buf.Len()) > limit {
+		return nil, ErrBlobTooLarge
+	}
+	return buf.Bytes(), nil
+}
+
+// newMessageHeader returns the header of a new message from the session's identity
+func newMessageHeader(sc *SessionContext, recipient IDString) messageHeader {
+	return messageHeader{
+		sender:    sc.ID.ID,
+		recipient: recipient,
+		id:        NewMsgID(),
+		time:      time.Now(),
+		pubNick:   sc.ID.Nick,
+	}
+}
+
+// NewImageMessageFromBytes returns an ImageMessage with the given image, see NewImageMessageFromReader
+func NewImageMessageFromBytes(ctx context.Context, sc *SessionContext, recipient string, image []byte, info MediaInfo) (ImageMessage, error) {
+	return NewImageMessageFromReader(ctx, sc, recipient, bytes.NewReader(image), info)
+}
+
+// NewImageMessageFromReader returns an ImageMessage ready to be encrypted. The image
+// is read from r, encrypted for the recipient and uploaded to the session's BlobStore.
+// Missing dimensions in info are probed from the image. If the session has
+// ImageOptions the image is preprocessed first.
+func NewImageMessageFromReader(ctx context.Context, sc *SessionContext, recipient string, r io.Reader, info MediaInfo) (ImageMessage, error) {
+	plainImage, err := readBlobSource(sc.blobs(), r)
+	if err != nil {
+		return ImageMessage{}, err
+	}
+	plainImage, info, err = prepareImage(sc.ImageOptions, plainImage, info)
+	if err != nil {
+		return ImageMessage{}, err
+	}
+	if err := info.complete(plainImage, "image"); err != nil {
+		return ImageMessage{}, err
+	}
+
+	im := ImageMessage{
+		newMessageHeader(sc, NewIDString(recipient)),
+		imageMessageBody{Info: info},
+	}
+	im.Nonce, im.ServerID, im.Size, im.BlobID, err = encryptAndUploadAsym(ctx, *sc, plainImage, recipient)
+	if err != nil {
+		return ImageMessage{}, err
+	}
+	return im, nil
+}
+
+// NewAudioMessageFromBytes returns an AudioMessage with the given audio, see NewAudioMessageFromReader
+func NewAudioMessageFromBytes(ctx context.Context, sc *SessionContext, recipient string, audio []byte, info MediaInfo) (AudioMessage, error) {
+	return NewAudioMessageFromReader(ctx, sc, recipient, bytes.NewReader(audio), info)
+}
+
+// NewAudioMessageFromReader returns an AudioMessage ready to be encrypted. The audio
+// is read from r, encrypted and uploaded to the session's BlobStore. info.Duration is
+// sent along, rounded up to whole seconds; if it is zero the duration is probed from the
+// audio.
+func NewAudioMessageFromReader(ctx context.Context, sc *SessionContext, recipient string, r io.Reader, info MediaInfo) (AudioMessage, error) {
+	plainAudio, err := readBlobSource(sc.blobs(), r)
+	if err != nil {
+		return AudioMessage{}, err
+	}
+	if err := info.complete(plainAudio, "audio"); err != nil {
+		return AudioMessage{}, err
+	}
+
+	am := AudioMessage{
+		newMessageHeader(sc, NewIDString(recipient)),
+		audioMessageBody{Duration: durationSeconds(info.Duration), Info: info},
+	}
+	am.Key, am.ServerID, am.Size, am.BlobID, err = encryptAndUploadSym(ctx, sc.blobs(), plainAudio)
+	if err != nil {
+		return AudioMessage{}, err
+	}
+	return am, nil
+}
+
+// uploadGroupImage encrypts and uploads an image once for all members of a group
+func uploadGroupImage(ctx context.Context, sc *SessionContext, r io.Reader, info MediaInfo) (groupImageMessageBody, error) {
+	plainImage, err := readBlobSource(sc.blobs(), r)
+	if err != nil {
+		return groupImageMessageBody{}, err
+	}
+	plainImage, info, err = prepareImage(sc.ImageOptions, plainImage, info)
+	if err != nil {
+		return groupImageMessageBody{}, err
+	}
+	if err := info.complete(plainImage, "image"); err != nil {
+		return groupImageMessageBody{}, err
+	}
+
+	body := groupImageMessageBody{Info: info}
+	body.Key, body.ServerID, body.Size, body.BlobID, err = encryptAndUploadSym(ctx, sc.blobs(), plainImage)
+	return body, err
+}
+
+// NewGroupImageMessagesFromBytes returns GroupImageMessages with the given image, see NewGroupImageMessagesFromReader
+func NewGroupImageMessagesFromBytes(ctx context.Context, sc *SessionContext, group Group, image []byte, info MediaInfo) ([]GroupImageMessage, error) {
+	return NewGroupImageMessagesFromReader(ctx, sc, group, bytes.NewReader(image), info)
+}
+
+// NewGroupImageMessagesFromReader returns a GroupImageMessage for every member of group,
+// ready to be encrypted. The image is read from r and uploaded once for all members.
+func NewGroupImageMessagesFromReader(ctx context.Context, sc *SessionContext, group Group, r io.Reader, info MediaInfo) ([]GroupImageMessage, error) {
+	body, err := uploadGroupImage(ctx, sc, r, info)
+	if err != nil {
+		return nil, err
+	}
+
+	gims := make([]GroupImageMessage, len(group.Members))
+	for i, member := range group.Members {
+		gims[i] = GroupImageMessage{
+			groupMessageHeader{
+				creatorID: group.CreatorID,
+				groupID:   group.GroupID},
+			newMessageHeader(sc, member),
+			body,
+		}
+	}
+	return gims, nil
+}
+
+// NewGroupManageSetImageMessagesFromBytes returns GroupManageSetImageMessages with the given image, see NewGroupManageSetImageMessagesFromReader
+func NewGroupManageSetImageMessagesFromBytes(ctx context.Context, sc *SessionContext, group Group, image []byte, info MediaInfo) ([]GroupManageSetImageMessage, error) {
+	return NewGroupManageSetImageMessagesFromReader(ctx, sc, group, bytes.NewReader(image), info)
+}
+
+// NewGroupManageSetImageMessagesFromReader returns a GroupManageSetImageMessage for every
+// member of group, ready to be encrypted. The image is read from r and uploaded once
+// for all members.
+func NewGroupManageSetImageMessagesFromReader(ctx context.Context, sc *SessionContext, group Group, r io.Reader, info MediaInfo) ([]GroupManageSetImageMessage, error) {
+	body, err := uploadGroupImage(ctx, sc, r, info)
+	if err != nil {
+		return nil, err
+	}
+
+	gms := make([]GroupManageSetImageMessage, len(group.Members))
+	for i, member := range group.Members {
+		gms[i] = GroupManageSetImageMessage{
+			groupManageMessageHeader{
+				groupID: group.GroupID},
+			newMessageHeader(sc, member),
+			body,
+		}
+	}
+	return gms, nil
+}
+
+// writeMedia writes decrypted media to w
+func writeMedia(w io.Writer, plain []byte) (int64, error) {
+	n, err := w.Write(plain)
+	return int64(n), err
+}
+
+// WriteImageData downloads and decrypts the image and writes it to w
+func (im ImageMessage) WriteImageData(ctx context.Context, sc SessionContext, w io.Writer) (int64, error) {
+	plain, err := downloadAndDecryptAsym(ctx, sc, im.inboundMedia(), im.Nonce)
+	if err != nil {
+		return 0, err
+	}
+	return writeMedia(w, plain)
+}
+
+// WriteAudioData downloads and decrypts the audio and writes it to w
+func (am AudioMessage) WriteAudioData(ctx context.Context, sc SessionContext, w io.Writer) (int64, error) {
+	plain, err := downloadAndDecryptSym(ctx, sc, am.inboundMedia(), am.Key)
+	if err != nil {
+		return 0, err
+	}
+	return writeMedia(w, plain)
+}
+
+// WriteImageData downloads and decrypts the image and writes it to w
+func (im GroupImageMessage) WriteImageData(ctx context.Context, sc SessionContext, w io.Writer) (int64, error) {
+	plain, err := downloadAndDecryptSym(ctx, sc, im.inboundMedia(), im.Key)
+	if err != nil {
+		return 0, err
+	}
+	return writeMedia(w, plain)
+}
+
+// WriteImageData downloads and decrypts the group image and writes it to w
+func (im GroupManageSetImageMessage) WriteImageData(ctx context.Context, sc SessionContext, w io.Writer) (int64, error) {
+	plain, err := downloadAndDecryptSym(ctx, sc, im.inboundMedia(), im.Key)
+	if err != nil {
+		return 0, err
+	}
+	return writeMedia(w, plain)
+}
@@ -0,0 +1,46 @@
+package o3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/o3ma/o3/o3test"
+)
+
+func TestAudioMessageFromBytes(t *testing.T) {
+	fb := o3test.NewFakeBlobServer()
+	defer fb.Close()
+	sc := NewSessionContext(ThreemaID{ID: NewIDString("ECHOECHO")})
+	sc.Blobs = fakeBlobStore(fb)
+
+	audio := append([]byte("ID3"), bytes.Repeat([]byte{0}, 64)...)
+	am, err := NewAudioMessageFromBytes(context.Background(), &sc, "ABCDEFGH", audio, MediaInfo{Duration: 2500 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if am.Duration != 3 || am.Info.MIMEType != "audio/mpeg" {
+		t.Errorf("got duration %d and type %q, want 3 and audio/mpeg", am.Duration, am.Info.MIMEType)
+	}
+
+	var buf bytes.Buffer
+	if _, err := am.WriteAudioData(context.Background(), sc, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), audio) {
+		t.Error("received audio differs from sent audio")
+	}
+	if !fb.Done(am.BlobID) {
+		t.Error("blob of 1:1 audio message not marked as done")
+	}
+	if cached, ok := sc.MediaCache.Get(mediaCacheKey(am.inboundMedia(), am.Key[:])); !ok || !bytes.Equal(cached, audio) {
+		t.Error("downloaded audio not cached")
+	}
+
+	_, err = NewAudioMessageFromBytes(context.Background(), &sc, "ABCDEFGH", []byte("just text"), MediaInfo{})
+	if !errors.Is(err, ErrUnsupportedMedia) {
+		t.Errorf("expected ErrUnsupportedMedia for text, got %v", err)
+	}
+}
@@ -0,0 +1,165 @@
+package o3
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// Defaults of the MediaCache created by NewSessionContext
+const (
+	DefaultMediaCacheSize = 64 << 20
+	DefaultMediaCacheTTL  = time.Hour
+)
+
+// MediaCache keeps decrypted media, so the media of a message can be read repeatedly
+// without downloading it again. This matters because blobs of 1:1 messages are marked
+// as done after their first download and may be deleted by the server. Implementations
+// have to be safe for concurrent use.
+type MediaCache interface {
+	// Get returns the media stored under key and whether it was found
+	Get(key MediaCacheKey) ([]byte, bool)
+	// Put stores media under key
+	Put(key MediaCacheKey, media []byte)
+}
+
+// MediaCacheKey identifies decrypted media by its blob, its sender and the key material
+// it was decrypted with. Cached media is only handed out to messages that would have
+// decrypted the blob to it, so a message cannot obtain other media by reusing a blob ID.
+type MediaCacheKey [32]byte
+
+// mediaCacheKey derives the MediaCacheKey of media decrypted with secret
+func mediaCacheKey(media InboundMedia, secret []byte) MediaCacheKey {
+	h := sha256.New()
+	h.Write(media.BlobID[:])
+	h.Write(media.Sender[:])
+	h.Write(secret)
+	var key MediaCacheKey
+	copy(key[:], h.Sum(nil))
+	return key
+}
+
+// MemoryMediaCache is an in-memory MediaCache evicting the least recently used media
+// once MaxBytes is exceeded and media older than TTL. Media larger than MaxBytes is not
+// cached. Callers get copies of the stored media. Use NewMemoryMediaCache to create one.
+type MemoryMediaCache struct {
+	MaxBytes int64
+	TTL      time.Duration
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List
+	entries map[MediaCacheKey]*list.Element
+}
+
+type mediaCacheEntry struct {
+	key    MediaCacheKey
+	media  []byte
+	stored time.Time
+}
+
+// NewMemoryMediaCache returns an empty MemoryMediaCache. A ttl of zero keeps media
+// until it is evicted for space.
+func NewMemoryMediaCache(maxBytes int64, ttl time.Duration) *MemoryMediaCache {
+	return &MemoryMediaCache{
+		MaxBytes: maxBytes,
+		TTL:      ttl,
+		lru:      list.New(),
+		entries:  make(map[MediaCacheKey]*list.Element)}
+}
+
+// Get returns a copy of the media stored under key
+func (mc *MemoryMediaCache) Get(key MediaCacheKey) ([]byte, bool) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	elem, ok := mc.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*mediaCacheEntry)
+	if mc.TTL > 0 && time.Since(entry.stored) > mc.TTL {
+		mc.remove(elem)
+		return nil, false
+	}
+	mc.lru.MoveToFront(elem)
+	return append([]byte(nil), entry.media...), true
+}
+
+// Put stores a copy of media, evicting expired and least recently used media as needed
+func (mc *MemoryMediaCache) Put(key MediaCacheKey, media []byte) {
+	if int64(len(media)) > mc.MaxBytes {
+		return
+	}
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	if elem, ok := mc.entries[key]; ok {
+		mc.remove(elem)
+	}
+	entry := &mediaCacheEntry{key: key, media: append([]byte(nil), media...), stored: time.Now()}
+	mc.entries[key] = mc.lru.PushFront(entry)
+	mc.size += int64(len(media))
+
+	for elem := mc.lru.Back(); elem != nil; {
+		prev := elem.Prev()
+		if mc.size <= mc.MaxBytes && (mc.TTL <= 0 || time.Since(elem.Value.(*mediaCacheEntry).stored) <= mc.TTL) {
+			break
+		}
+		mc.remove(elem)
+		elem = prev
+	}
+}
+
+// Size returns the number of bytes of media stored
+func (mc *MemoryMediaCache) Size() int64 {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.size
+}
+
+func (mc *MemoryMediaCache) remove(elem *list.Element) {
+	entry := mc.lru.Remove(elem).(*mediaCacheEntry)
+	delete(mc.entries, entry.key)
+	mc.size -= int64(len(entry.media))
+}
+
+// fetchMedia returns the decrypted media of a blob from the session's MediaCache or
+// downloads, decrypts and inspects it. secret is the key material decrypt uses, which
+// is part of the cache key. Blobs of 1:1 messages are marked as done after the
+// download; group blobs are left alone as the other members still need them.
+func (sc SessionContext) fetchMedia(ctx context.Context, media InboundMedia, secret []byte, decrypt func(ciphertext []byte) ([]byte, error)) ([]byte, error) {
+	cacheKey := mediaCacheKey(media, secret)
+	if sc.MediaCache != nil {
+		if data, ok := sc.MediaCache.Get(cacheKey); ok {
+			return data, nil
+		}
+	}
+
+	ciphertext, err := downloadBlob(ctx, sc.blobs(), media.BlobID)
+	if err != nil {
+		return nil, err
+	}
+	media.Data, err = decrypt(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	if media.Type == IMAGEMESSAGE || media.Type == AUDIOMESSAGE {
+		// the media has been delivered already, a failure only delays the deletion
+		if err := sc.blobs().MarkDone(ctx, media.BlobID); err != nil {
+			sc.reportError(err)
+		}
+	}
+
+	if err := sc.inspectMedia(ctx, &media); err != nil {
+		return nil, err
+	}
+	if sc.MediaCache != nil {
+		sc.MediaCache.Put(cacheKey, media.Data)
+	}
+	return media.Data, nil
+}
@@ -0,0 +1,64 @@
+package o3
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/o3ma/o3/o3test"
+)
+
+func TestMemoryMediaCacheEviction(t *testing.T) {
+	mc := NewMemoryMediaCache(10, time.Hour)
+	mc.Put(MediaCacheKey{1}, []byte("aaaa"))
+	mc.Put(MediaCacheKey{2}, []byte("bbbb"))
+	mc.Get(MediaCacheKey{1})
+	// exceeds the size, evicting the least recently used blob 2
+	mc.Put(MediaCacheKey{3}, []byte("cccc"))
+
+	if _, ok := mc.Get(MediaCacheKey{2}); ok {
+		t.Error("least recently used media not evicted")
+	}
+	if media, ok := mc.Get(MediaCacheKey{1}); !ok || string(media) != "aaaa" {
+		t.Error("recently used media evicted")
+	}
+	if mc.Size() != 8 {
+		t.Errorf("size %d, want 8", mc.Size())
+	}
+
+	mc.Put(MediaCacheKey{4}, []byte("way too large"))
+	if _, ok := mc.Get(MediaCacheKey{4}); ok {
+		t.Error("media larger than the cache was stored")
+	}
+
+	mc.TTL = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	if _, ok := mc.Get(MediaCacheKey{1}); ok {
+		t.Error("expired media returned")
+	}
+}
+
+func TestMediaCacheBoundToKey(t *testing.T) {
+	fb := o3test.NewFakeBlobServer()
+	defer fb.Close()
+
+	sc := NewSessionContext(ThreemaID{ID: NewIDString("ECHOECHO")})
+	sc.Blobs = fakeBlobStore(fb)
+	key, _, _, blobID, err := encryptAndUploadSym(context.Background(), sc.Blobs, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	media := InboundMedia{Type: GROUPIMAGEMESSAGE, Sender: NewIDString("MEMBER01"), BlobID: blobID}
+	if _, err := downloadAndDecryptSym(context.Background(), sc, media, key); err != nil {
+		t.Fatal(err)
+	}
+
+	// another sender reusing the blob ID does not hit the cache, with or without the key
+	media.Sender = NewIDString("ATTACKER")
+	if _, ok := sc.MediaCache.Get(mediaCacheKey(media, key[:])); ok {
+		t.Error("media cached for another sender")
+	}
+	if _, err := downloadAndDecryptSym(context.Background(), sc, media, [32]byte{1}); err == nil {
+		t.Error("cached media served for a wrong key")
+	}
+}
@@ -0,0 +1,142 @@
+package o3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// MediaVerdict is the decision of a MediaInspector about inbound media
+type MediaVerdict uint8
+
+// MediaVerdict mock enum
+const (
+	MEDIAACCEPT     MediaVerdict = 0x0 //indicates the media is handed out, possibly transformed
+	MEDIAREJECT     MediaVerdict = 0x1 //indicates the media is withheld
+	MEDIAQUARANTINE MediaVerdict = 0x2 //indicates the media is withheld and sent to the quarantine
+)
+
+// ErrMediaRejected is matched by errors.Is for all *MediaRejectedError
+var ErrMediaRejected = errors.New("o3: media rejected by inspection")
+
+// MediaRejectedError is returned by the media accessors of messages if an inspector
+// withheld the media
+type MediaRejectedError struct {
+	BlobID      [16]byte
+	Reason      string
+	Quarantined bool
+}
+
+func (e *MediaRejectedError) Error() string {
+	return fmt.Sprintf("o3: media of blob %x rejected: %s", e.BlobID, e.Reason)
+}
+
+// Is makes errors.Is report a MediaRejectedError as ErrMediaRejected
+func (e *MediaRejectedError) Is(target error) bool {
+	return target == ErrMediaRejected
+}
+
+// InboundMedia is decrypted media of a received message about to be handed out
+type InboundMedia struct {
+	// Type is the type of the message carrying the media, e.g. IMAGEMESSAGE
+	Type   MsgType
+	Sender IDString
+	BlobID [16]byte
+	// MIMEType is detected from Data before the inspectors run
+	MIMEType string
+	Data     []byte
+}
+
+// kind returns the kind of media the message type carries, e.g. "image"
+func (im InboundMedia) kind() string {
+	if im.Type == AUDIOMESSAGE {
+		return "audio"
+	}
+	return "image"
+}
+
+// MediaInspector inspects inbound media. Inspectors may transform the media by
+// replacing media.Data and accepting it. An error fails the access to the media.
+type MediaInspector interface {
+	Inspect(ctx context.Context, media *InboundMedia) (verdict MediaVerdict, reason string, err error)
+}
+
+// MediaInspectorFunc adapts a function to a MediaInspector
+type MediaInspectorFunc func(ctx context.Context, media *InboundMedia) (MediaVerdict, string, error)
+
+// Inspect calls f
+func (f MediaInspectorFunc) Inspect(ctx context.Context, media *InboundMedia) (MediaVerdict, string, error) {
+	return f(ctx, media)
+}
+
+// MIMEInspector rejects media whose content does not match the message type, e.g. an
+// "image" that is not an image
+var MIMEInspector MediaInspector = MediaInspectorFunc(func(ctx context.Context, media *InboundMedia) (MediaVerdict, string, error) {
+	info := MediaInfo{MIMEType: media.MIMEType}
+	if err := info.complete(media.Data, media.kind()); err != nil {
+		return MEDIAREJECT, fmt.Sprintf("content of type %s does not match the message", media.MIMEType), nil
+	}
+	return MEDIAACCEPT, "", nil
+})
+
+// MediaInspection configures how a session inspects the media of received messages
+// when it is accessed with GetImageData, GetAudioData or their Write variants. Only
+// media that passed is stored in the MediaCache. MIMEInspector and ClamAV are built in
+// inspectors.
+type MediaInspection struct {
+	// Inspectors are run in order on every piece of media. The first one withholding
+	// the media ends the inspection.
+	Inspectors []MediaInspector
+	// Quarantine receives media withheld with MEDIAQUARANTINE. Sending blocks the access
+	// to the media, so the channel should be buffered and drained.
+	Quarantine chan<- InboundMedia
+}
+
+// inspectMedia runs the session's inspectors on media
+func (sc SessionContext) inspectMedia(ctx context.Context, media *InboundMedia) error {
+	if len(sc.Media.Inspectors) == 0 {
+		return nil
+	}
+	sniffed := MediaInfo{}
+	sniffed.complete(media.Data, media.kind())
+	media.MIMEType = sniffed.MIMEType
+
+	for _, inspector := range sc.Media.Inspectors {
+		verdict, reason, err := inspector.Inspect(ctx, media)
+		if err != nil {
+			return err
+		}
+		switch verdict {
+		case MEDIAACCEPT:
+			continue
+		case MEDIAQUARANTINE:
+			if sc.Media.Quarantine != nil {
+				select {
+				case sc.Media.Quarantine <- *media:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			return &MediaRejectedError{BlobID: media.BlobID, Reason: reason, Quarantined: true}
+		default:
+			return &MediaRejectedError{BlobID: media.BlobID, Reason: reason}
+		}
+	}
+	return nil
+}
+
+func (im ImageMessage) inboundMedia() InboundMedia {
+	return InboundMedia{Type: IMAGEMESSAGE, Sender: im.Sender(), BlobID: im.BlobID}
+}
+
+func (am AudioMessage) inboundMedia() InboundMedia {
+	return InboundMedia{Type: AUDIOMESSAGE, Sender: am.Sender(), BlobID: am.BlobID}
+}
+
+func (im GroupImageMessage) inboundMedia() InboundMedia {
+	return InboundMedia{Type: GROUPIMAGEMESSAGE, Sender: im.Sender(), BlobID: im.BlobID}
+}
+
+func (im GroupManageSetImageMessage) inboundMedia() InboundMedia {
+	return InboundMedia{Type: GROUPSETIMAGEMESSAGE, Sender: im.Sender(), BlobID: im.BlobID}
+}
@@ -0,0 +1,77 @@
+package o3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"testing"
+
+	"github.com/o3ma/o3/o3test"
+)
+
+func TestMediaInspection(t *testing.T) {
+	fb := o3test.NewFakeBlobServer()
+	defer fb.Close()
+	fc := o3test.NewFakeClamd(t)
+	defer fc.Close()
+
+	quarantine := make(chan InboundMedia, 1)
+	clamav := ClamAV{Network: "tcp", Address: fc.Addr()}
+	clamav.Quarantine = true
+	sc := NewSessionContext(ThreemaID{ID: NewIDString("ECHOECHO")})
+	sc.Blobs = fakeBlobStore(fb)
+	sc.MediaCache = nil
+	sc.Media = MediaInspection{
+		Inspectors: []MediaInspector{MIMEInspector, clamav},
+		Quarantine: quarantine}
+	group := Group{CreatorID: sc.ID.ID, Members: []IDString{NewIDString("ABCDEFGH")}}
+
+	var encoded bytes.Buffer
+	png.Encode(&encoded, image.NewGray(image.Rect(0, 0, 4, 4)))
+	clean := encoded.Bytes()
+	infected := append(append([]byte{}, clean...), `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`...)
+
+	gims, err := NewGroupImageMessagesFromBytes(context.Background(), &sc, group, clean, MediaInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := gims[0].GetImageData(sc); err != nil || !bytes.Equal(data, clean) {
+		t.Errorf("clean image not handed out: %v", err)
+	}
+
+	gims, err = NewGroupImageMessagesFromBytes(context.Background(), &sc, group, infected, MediaInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = gims[0].GetImageData(sc)
+	var rejected *MediaRejectedError
+	if !errors.As(err, &rejected) || !rejected.Quarantined || !errors.Is(err, ErrMediaRejected) {
+		t.Fatalf("expected quarantined MediaRejectedError, got %v", err)
+	}
+	if media := <-quarantine; !bytes.Equal(media.Data, infected) || media.MIMEType != "image/png" {
+		t.Errorf("quarantine got %d bytes of %s", len(media.Data), media.MIMEType)
+	}
+	if fc.Scans() != 2 {
+		t.Errorf("clamd scanned %d times, want 2", fc.Scans())
+	}
+
+	// an "image" that is plain text fails the MIME check before it reaches clamd
+	var gim GroupImageMessage
+	gim.Key, gim.ServerID, gim.Size, gim.BlobID, err = encryptAndUploadSym(context.Background(), sc.blobs(), []byte("no image at all"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gim.GetImageData(sc); !errors.Is(err, ErrMediaRejected) {
+		t.Errorf("expected text to be rejected, got %v", err)
+	}
+
+	sc.Media.Inspectors = []MediaInspector{MediaInspectorFunc(func(ctx context.Context, media *InboundMedia) (MediaVerdict, string, error) {
+		media.Data = []byte("redacted")
+		return MEDIAACCEPT, "", nil
+	})}
+	if data, err := gim.GetImageData(sc); err != nil || string(data) != "redacted" {
+		t.Errorf("transformation not applied: %q, %v", data, err)
+	}
+}
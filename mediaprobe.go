@@ -0,0 +1,405 @@
+package o3
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/jpeg"
+	"time"
+
+	// register the formats understood by ProbeImage and Thumbnail
+	_ "image/gif"
+	_ "image/png"
+)
+
+// ErrUnknownMediaFormat is returned if the format of media is not recognized
+var ErrUnknownMediaFormat = errors.New("o3: unknown media format")
+
+// ErrImageTooLarge is returned by Thumbnail and PrepareImage for images with more
+// pixels than they are willing to decode
+var ErrImageTooLarge = errors.New("o3: image has too many pixels")
+
+// maxImagePixels limits the pixel count of decoded images. A small file can declare
+// huge dimensions and decoding it allocates four bytes per pixel, 200 MB at this limit.
+const maxImagePixels = 50 * 1000 * 1000
+
+// ProbeAudio determines the MIME type and duration of audio in an MP4/M4A, raw AAC
+// (ADTS), MP3 or Ogg (Opus or Vorbis) container
+func ProbeAudio(data []byte) (MediaInfo, error) {
+	var (
+		info MediaInfo
+		err  error
+	)
+	switch {
+	case len(data) >= 12 && string(data[4:8]) == "ftyp":
+		info.MIMEType = "audio/mp4"
+		info.Duration, err = mp4Duration(data)
+	case bytes.HasPrefix(data, []byte("OggS")):
+		info.MIMEType = "audio/ogg"
+		info.Duration, err = oggDuration(data)
+	default:
+		frames := skipID3(data)
+		if len(frames) >= 2 && frames[0] == 0xFF && frames[1]&0xF6 == 0xF0 {
+			info.MIMEType = "audio/aac"
+			info.Duration, err = adtsDuration(frames)
+		} else {
+			info.MIMEType = "audio/mpeg"
+			info.Duration, err = mp3Duration(frames)
+		}
+	}
+	if err != nil {
+		return MediaInfo{}, err
+	}
+	return info, nil
+}
+
+// ProbeImage determines the MIME type and dimensions of a JPEG, PNG or GIF image
+// without decoding it
+func ProbeImage(data []byte) (MediaInfo, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return MediaInfo{}, ErrUnknownMediaFormat
+	}
+	return MediaInfo{MIMEType: "image/" + format, Width: config.Width, Height: config.Height}, nil
+}
+
+// Thumbnail returns a JPEG of the image turned upright and scaled down to fit into a
+// square of maxSize pixels. Images that already fit are only re-encoded.
+func Thumbnail(data []byte, maxSize int) ([]byte, error) {
+	img, err := decodeImage(data)
+	if err != nil {
+		return nil, err
+	}
+	upright := orientImage(toRGBA(img), exifOrientation(data))
+	width, height := fitSize(upright.Bounds().Dx(), upright.Bounds().Dy(), maxSize)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, scaleImage(upright, width, height), &jpeg.Options{Quality: 75}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeImage decodes a JPEG, PNG or GIF image after checking its dimensions against
+// maxImagePixels
+func decodeImage(data []byte) (image.Image, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrUnknownMediaFormat
+	}
+	if int64(config.Width)*int64(config.Height) > maxImagePixels {
+		return nil, ErrImageTooLarge
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrUnknownMediaFormat
+	}
+	return img, nil
+}
+
+// fitSize scales width and height down to fit into a square of maxSize, keeping the
+// aspect ratio
+func fitSize(width, height, maxSize int) (int, int) {
+	if width <= maxSize && height <= maxSize {
+		return width, height
+	}
+	if width >= height {
+		height = height * maxSize / width
+		if height < 1 {
+			height = 1
+		}
+		return maxSize, height
+	}
+	width = width * maxSize / height
+	if width < 1 {
+		width = 1
+	}
+	return width, maxSize
+}
+
+// scaleImage scales img to width x height by averaging the source pixels covered by
+// each target pixel, which gives smooth results for the large factors of thumbnails
+func scaleImage(img image.Image, width, height int) *image.RGBA {
+	src := toRGBA(img)
+	srcW, srcH := src.Bounds().Dx(), src.Bounds().Dy()
+	if srcW == width && srcH == height {
+		return src
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := y*srcH/height, (y+1)*srcH/height
+		if y1 == y0 {
+			y1++
+		}
+		for x := 0; x < width; x++ {
+			x0, x1 := x*srcW/width, (x+1)*srcW/width
+			if x1 == x0 {
+				x1++
+			}
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride+x0*4 : sy*src.Stride+x1*4]
+				for i := 0; i < len(row); i += 4 {
+					sum[0] += int(row[i])
+					sum[1] += int(row[i+1])
+					sum[2] += int(row[i+2])
+					sum[3] += int(row[i+3])
+				}
+			}
+			n := (y1 - y0) * (x1 - x0)
+			off := y*dst.Stride + x*4
+			for i := range sum {
+				dst.Pix[off+i] = uint8(sum[i] / n)
+			}
+		}
+	}
+	return dst
+}
+
+// scaleDuration converts a number of samples or ticks at the given rate to a duration
+func scaleDuration(ticks uint64, rate uint64) time.Duration {
+	if rate == 0 {
+		return 0
+	}
+	return time.Duration(float64(ticks) / float64(rate) * float64(time.Second))
+}
+
+// mp4Box returns the payload of the first box of the given type in data
+func mp4Box(data []byte, boxType string) []byte {
+	for len(data) >= 8 {
+		size, header := uint64(binary.BigEndian.Uint32(data)), uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return nil
+			}
+			size, header = binary.BigEndian.Uint64(data[8:]), 16
+		}
+		if size < header || size > uint64(len(data)) {
+			return nil
+		}
+		if string(data[4:8]) == boxType {
+			return data[header:size]
+		}
+		data = data[size:]
+	}
+	return nil
+}
+
+// mp4Duration reads the duration from the movie header of an MP4 file
+func mp4Duration(data []byte) (time.Duration, error) {
+	mvhd := mp4Box(mp4Box(data, "moov"), "mvhd")
+	switch {
+	case len(mvhd) >= 20 && mvhd[0] == 0:
+		timescale := binary.BigEndian.Uint32(mvhd[12:])
+		return scaleDuration(uint64(binary.BigEndian.Uint32(mvhd[16:])), uint64(timescale)), nil
+	case len(mvhd) >= 32 && mvhd[0] == 1:
+		timescale := binary.BigEndian.Uint32(mvhd[20:])
+		return scaleDuration(binary.BigEndian.Uint64(mvhd[24:]), uint64(timescale)), nil
+	}
+	return 0, ErrUnknownMediaFormat
+}
+
+// oggDuration reads the duration of an Ogg Opus or Vorbis stream from the granule
+// position of its last page
+func oggDuration(data []byte) (time.Duration, error) {
+	var rate, preSkip uint64
+	if i := bytes.Index(data, []byte("OpusHead")); i >= 0 && len(data) >= i+12 {
+		// Opus always counts granules at 48 kHz
+		rate, preSkip = 48000, uint64(binary.LittleEndian.Uint16(data[i+10:]))
+	} else if i := bytes.Index(data, []byte("\x01vorbis")); i >= 0 && len(data) >= i+16 {
+		rate = uint64(binary.LittleEndian.Uint32(data[i+12:]))
+	} else {
+		return 0, ErrUnknownMediaFormat
+	}
+
+	for end := len(data); end > 0; {
+		i := bytes.LastIndex(data[:end], []byte("OggS"))
+		if i < 0 {
+			break
+		}
+		if len(data) >= i+14 && data[i+4] == 0 {
+			granule := binary.LittleEndian.Uint64(data[i+6:])
+			// -1 marks pages without a finished packet
+			if granule != ^uint64(0) {
+				if granule < preSkip {
+					granule = preSkip
+				}
+				return scaleDuration(granule-preSkip, rate), nil
+			}
+		}
+		end = i
+	}
+	return 0, ErrUnknownMediaFormat
+}
+
+// adtsSampleRates maps the sampling frequency index of ADTS headers to Hz
+var adtsSampleRates = []uint64{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// adtsDuration adds up the samples of all frames of a raw AAC stream
+func adtsDuration(data []byte) (time.Duration, error) {
+	var samples, rate uint64
+	for len(data) >= 7 && data[0] == 0xFF && data[1]&0xF6 == 0xF0 {
+		index := int(data[2]>>2) & 0x0F
+		if index >= len(adtsSampleRates) {
+			break
+		}
+		rate = adtsSampleRates[index]
+		length := int(data[3]&0x03)<<11 | int(data[4])<<3 | int(data[5]>>5)
+		if length < 7 || length > len(data) {
+			break
+		}
+		samples += 1024 * uint64(data[6]&0x03+1)
+		data = data[length:]
+	}
+	if samples == 0 {
+		return 0, ErrUnknownMediaFormat
+	}
+	return scaleDuration(samples, rate), nil
+}
+
+// skipID3 returns data without a leading ID3v2 tag
+func skipID3(data []byte) []byte {
+	if len(data) < 10 || !bytes.HasPrefix(data, []byte("ID3")) {
+		return data
+	}
+	size := int(data[6]&0x7F)<<21 | int(data[7]&0x7F)<<14 | int(data[8]&0x7F)<<7 | int(data[9]&0x7F)
+	size += 10
+	if data[5]&0x10 != 0 {
+		size += 10 // footer
+	}
+	if size > len(data) {
+		return nil
+	}
+	return data[size:]
+}
+
+// mp3Bitrates holds the bitrates in kbit/s of MPEG audio frames indexed by version
+// (MPEG-1 or later), layer and the bitrate index of the frame header
+var mp3Bitrates = [2][3][15]uint64{
+	{
+		{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+	},
+	{
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+	},
+}
+
+// mp3Frame holds the fields of an MPEG audio frame header needed to find the duration
+type mp3Frame struct {
+	mpeg1      bool
+	mono       bool
+	samples    uint64
+	sampleRate uint64
+	length     int
+}
+
+// parseMP3Frame parses the frame header at the start of data
+func parseMP3Frame(data []byte) (mp3Frame, bool) {
+	if len(data) < 4 || data[0] != 0xFF || data[1]&0xE0 != 0xE0 {
+		return mp3Frame{}, false
+	}
+	version := data[1] >> 3 & 0x03 // 0: MPEG-2.5, 2: MPEG-2, 3: MPEG-1
+	layer := 3 - int(data[1]>>1&0x03)
+	bitrateIndex := data[2] >> 4
+	rateIndex := data[2] >> 2 & 0x03
+	if version == 1 || layer == 3 || bitrateIndex == 0 || bitrateIndex == 15 || rateIndex == 3 {
+		return mp3Frame{}, false
+	}
+
+	f := mp3Frame{mpeg1: version == 3, mono: data[3]>>6 == 3}
+	f.sampleRate = []uint64{44100, 48000, 32000}[rateIndex]
+	versionIndex := 1
+	if f.mpeg1 {
+		versionIndex = 0
+	} else if version == 2 {
+		f.sampleRate /= 2
+	} else {
+		f.sampleRate /= 4
+	}
+	bitrate := mp3Bitrates[versionIndex][layer][bitrateIndex] * 1000
+	padding := int(data[2] >> 1 & 0x01)
+
+	switch {
+	case layer == 0:
+		f.samples = 384
+		f.length = (int(12*bitrate/f.sampleRate) + padding) * 4
+	case layer == 2 && !f.mpeg1:
+		f.samples = 576
+		f.length = int(72*bitrate/f.sampleRate) + padding
+	default:
+		f.samples = 1152
+		f.length = int(144*bitrate/f.sampleRate) + padding
+	}
+	return f, true
+}
+
+// mp3Duration determines the duration of an MP3 stream from its Xing or VBRI header if
+// present and by adding up the samples of all frames otherwise
+func mp3Duration(data []byte) (time.Duration, error) {
+	// tolerate a few bytes of garbage before the first frame
+	for i := 0; i < len(data) && i < 4096; i++ {
+		if first, ok := parseMP3Frame(data[i:]); ok {
+			if frames, ok := mp3HeaderFrames(data[i:], first); ok {
+				return scaleDuration(frames*first.samples, first.sampleRate), nil
+			}
+			return mp3CountFrames(data[i:])
+		}
+	}
+	return 0, ErrUnknownMediaFormat
+}
+
+// mp3HeaderFrames reads the number of frames from the Xing/Info or VBRI header that
+// encoders put into the first frame
+func mp3HeaderFrames(data []byte, first mp3Frame) (uint64, bool) {
+	if len(data) < 40 {
+		return 0, false
+	}
+	sideInfo := 32
+	switch {
+	case first.mpeg1 && first.mono, !first.mpeg1 && !first.mono:
+		sideInfo = 17
+	case !first.mpeg1 && first.mono:
+		sideInfo = 9
+	}
+	if xing := data[4+sideInfo:]; len(xing) >= 12 &&
+		(bytes.HasPrefix(xing, []byte("Xing")) || bytes.HasPrefix(xing, []byte("Info"))) {
+		// flag 1 announces the frame count
+		if binary.BigEndian.Uint32(xing[4:])&0x01 != 0 {
+			return uint64(binary.BigEndian.Uint32(xing[8:])), true
+		}
+	}
+	if vbri := data[36:]; len(vbri) >= 18 && bytes.HasPrefix(vbri, []byte("VBRI")) {
+		return uint64(binary.BigEndian.Uint32(vbri[14:])), true
+	}
+	return 0, false
+}
+
+// mp3CountFrames adds up the samples of consecutive frames
+func mp3CountFrames(data []byte) (time.Duration, error) {
+	var samples, rate uint64
+	frames := 0
+	for {
+		f, ok := parseMP3Frame(data)
+		if !ok || f.length < 4 || f.length > len(data) {
+			break
+		}
+		samples += f.samples
+		rate = f.sampleRate
+		frames++
+		data = data[f.length:]
+	}
+	// a single frame may well be a false sync in some other format
+	if frames < 2 {
+		return 0, ErrUnknownMediaFormat
+	}
+	return scaleDuration(samples, rate), nil
+}
@@ -0,0 +1,121 @@
+package o3
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+	"time"
+)
+
+func mp4TestBox(boxType string, payload ...[]byte) []byte {
+	content := bytes.Join(payload, nil)
+	box := make([]byte, 8, 8+len(content))
+	binary.BigEndian.PutUint32(box, uint32(8+len(content)))
+	copy(box[4:], boxType)
+	return append(box, content...)
+}
+
+func oggTestPage(granule uint64, payload []byte) []byte {
+	page := make([]byte, 27)
+	copy(page, "OggS")
+	binary.LittleEndian.PutUint64(page[6:], granule)
+	return append(page, payload...)
+}
+
+func TestProbeAudio(t *testing.T) {
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:], 1000)
+	binary.BigEndian.PutUint32(mvhd[16:], 12345)
+	m4a := append(mp4TestBox("ftyp", []byte("M4A \x00\x00\x00\x00")), mp4TestBox("moov", mp4TestBox("mvhd", mvhd))...)
+
+	opusHead := []byte("OpusHead\x01\x01\x38\x01\x80\xbb\x00\x00\x00\x00\x00")
+	opus := append(oggTestPage(0, opusHead), oggTestPage(5*48000+312, []byte("audio"))...)
+
+	// MPEG-1 layer III frames at 128 kbit/s and 44.1 kHz are 417 bytes long
+	frame := make([]byte, 417)
+	copy(frame, []byte{0xFF, 0xFB, 0x90, 0x00})
+	mp3 := append([]byte("ID3\x04\x00\x00\x00\x00\x00\x00"), bytes.Repeat(frame, 10)...)
+
+	// ADTS frames at 44.1 kHz, each 10 bytes long
+	adtsFrame := []byte{0xFF, 0xF1, 0x50, 0x80, 0x01, 0x5F, 0xFC, 0, 0, 0}
+	aac := bytes.Repeat(adtsFrame, 43)
+
+	for _, tc := range []struct {
+		name     string
+		data     []byte
+		mimeType string
+		duration time.Duration
+	}{
+		{"m4a", m4a, "audio/mp4", 12345 * time.Millisecond},
+		{"opus", opus, "audio/ogg", 5 * time.Second},
+		{"mp3", mp3, "audio/mpeg", scaleDuration(10*1152, 44100)},
+		{"aac", aac, "audio/aac", scaleDuration(43*1024, 44100)},
+	} {
+		info, err := ProbeAudio(tc.data)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if info.MIMEType != tc.mimeType || info.Duration != tc.duration {
+			t.Errorf("%s: got %s %v, want %s %v", tc.name, info.MIMEType, info.Duration, tc.mimeType, tc.duration)
+		}
+	}
+
+	if _, err := ProbeAudio([]byte("definitely not audio")); err != ErrUnknownMediaFormat {
+		t.Errorf("expected ErrUnknownMediaFormat, got %v", err)
+	}
+}
+
+func TestProbeImageAndThumbnail(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	for i := range img.Pix {
+		img.Pix[i] = 0xFF
+	}
+	img.Set(0, 0, color.Black)
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+
+	info, err := ProbeImage(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.MIMEType != "image/png" || info.Width != 200 || info.Height != 100 {
+		t.Errorf("got %+v", info)
+	}
+
+	thumbnail, err := Thumbnail(buf.Bytes(), 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err = ProbeImage(thumbnail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.MIMEType != "image/jpeg" || info.Width != 50 || info.Height != 25 {
+		t.Errorf("got thumbnail %+v", info)
+	}
+}
+
+func TestRejectHugeImages(t *testing.T) {
+	// a tiny PNG claiming to be 100000x100000 pixels
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1)))
+	data := buf.Bytes()
+	binary.BigEndian.PutUint32(data[16:], 100000)
+	binary.BigEndian.PutUint32(data[20:], 100000)
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+
+	if info, err := ProbeImage(data); err != nil || info.Width != 100000 {
+		t.Fatalf("test image not recognized: %+v %v", info, err)
+	}
+	if _, err := Thumbnail(data, 50); err != ErrImageTooLarge {
+		t.Errorf("Thumbnail: expected ErrImageTooLarge, got %v", err)
+	}
+	if _, _, err := PrepareImage(data, ImageOptions{}); err != ErrImageTooLarge {
+		t.Errorf("PrepareImage: expected ErrImageTooLarge, got %v", err)
+	}
+}
@@ -1,9 +1,12 @@
 package o3
 
 import (
+	"context"
 	"fmt"
-	"io/ioutil"
+	"mime"
 	mrand "math/rand"
+	"net/http"
+	"path/filepath"
 	"time"
 
 	"errors"
@@ -181,6 +184,8 @@ type imageMessageBody struct {
 	ServerID byte
 	Size     uint32
 	Nonce    nonce
+	// Info describes the image as given to the constructor, it is not transmitted
+	Info MediaInfo
 }
 
 // NewImageMessage returns a ImageMessage ready to be encrypted
@@ -211,17 +216,23 @@ func (im ImageMessage) GetPrintableContent() string {
 
 // GetImageData return the decrypted Image needs the recipients secret key
 func (im ImageMessage) GetImageData(sc SessionContext) ([]byte, error) {
-	return downloadAndDecryptAsym(sc, im.BlobID, im.Sender().String(), im.Nonce)
+	return downloadAndDecryptAsym(context.Background(), sc, im.inboundMedia(), im.Nonce)
 }
 
 // SetImageData encrypts and uploads the image. Sets the blob info in the ImageMessage. Needs the recipients public key.
 func (im *ImageMessage) SetImageData(filename string, sc SessionContext) error {
-	plainImage, err := ioutil.ReadFile(filename)
-	if err != nil {
+	plainImage, err := readBlobFile(sc.blobs(), filename)
+	if errors.Is(err, ErrBlobTooLarge) {
+		return err
+	} else if err != nil {
 		return errors.New("could not load image")
 	}
+	plainImage, im.Info, err = prepareImage(sc.ImageOptions, plainImage, MediaInfo{})
+	if err != nil {
+		return err
+	}
 
-	im.Nonce, im.ServerID, im.Size, im.BlobID, err = encryptAndUploadAsym(sc, plainImage, im.recipient.String())
+	im.Nonce, im.ServerID, im.Size, im.BlobID, err = encryptAndUploadAsym(context.Background(), sc, plainImage, im.recipient.String())
 
 	return err
 }
@@ -245,6 +256,9 @@ type audioMessageBody struct {
 	ServerID byte
 	Size     uint32
 	Key      [32]byte
+	// Info describes the audio as given to the constructor. Only the duration is
+	// transmitted, received messages carry nothing else.
+	Info MediaInfo
 }
 
 // NewAudioMessage returns a ImageMessage ready to be encrypted
@@ -275,20 +289,24 @@ func (am AudioMessage) GetPrintableContent() string {
 
 // GetAudioData return the decrypted audio, needs the recipients secret key
 func (am AudioMessage) GetAudioData(sc SessionContext) ([]byte, error) {
-	return downloadAndDecryptSym(am.BlobID, am.Key)
+	return downloadAndDecryptSym(context.Background(), sc, am.inboundMedia(), am.Key)
 }
 
 // SetAudioData encrypts and uploads the audio. Sets the blob info in the ImageMessage. Needs the recipients public key.
 func (am *AudioMessage) SetAudioData(filename string, sc SessionContext) error {
-	plainAudio, err := ioutil.ReadFile(filename)
-	if err != nil {
+	plainAudio, err := readBlobFile(sc.blobs(), filename)
+	if errors.Is(err, ErrBlobTooLarge) {
+		return err
+	} else if err != nil {
 		return errors.New("could not load audio")
 	}
 
-	// TODO: Should we have a whole media lib as dependency just to set this to the proper value?
-	am.Duration = 0xFF
+	// the duration stays unknown (zero) for formats ProbeAudio does not understand
+	info, _ := ProbeAudio(plainAudio)
+	am.Info = info
+	am.Duration = durationSeconds(info.Duration)
 
-	am.Key, am.ServerID, am.Size, am.BlobID, err = encryptAndUploadSym(plainAudio)
+	am.Key, am.ServerID, am.Size, am.BlobID, err = encryptAndUploadSym(context.Background(), sc.blobs(), plainAudio)
 
 	return err
 }
@@ -300,6 +318,74 @@ func (am AudioMessage) Serialize() []byte {
 
 //--------8<--------8<--------8<--------8<--------8<--------8<--------8<--------8<--------8<----
 
+//FileMessage represents a file message as sent e2e encrypted to other threema users
+type FileMessage struct {
+	messageHeader
+	fileMessageBody
+}
+
+type fileMessageBody struct {
+	BlobID [16]byte
+	Key    [32]byte
+	// Size is the size of the file before encryption
+	Size uint32
+	// MIMEType and FileName describe the file to the recipient
+	MIMEType string
+	FileName string
+	// Description is an optional caption
+	Description string
+}
+
+// NewFileMessage returns a FileMessage ready to be encrypted. Only clients announcing
+// FEATUREFILES can receive it, see SendFileMessage for a fallback for other clients.
+func NewFileMessage(sc *SessionContext, recipient string, filename string) (FileMessage, error) {
+	recipientID := NewIDString(recipient)
+
+	fm := FileMessage{
+		messageHeader{
+			sender:    sc.ID.ID,
+			recipient: recipientID,
+			id:        NewMsgID(),
+			time:      time.Now(),
+			pubNick:   sc.ID.Nick,
+		},
+		fileMessageBody{},
+	}
+	err := fm.SetFileData(filename, *sc)
+	if err != nil {
+		return FileMessage{}, err
+	}
+	return fm, nil
+}
+
+// SetFileData encrypts and uploads the file. Sets the blob info, MIME type and file name
+// in the FileMessage.
+func (fm *FileMessage) SetFileData(filename string, sc SessionContext) error {
+	plainFile, err := readBlobFile(sc.blobs(), filename)
+	if errors.Is(err, ErrBlobTooLarge) {
+		return err
+	} else if err != nil {
+		return errors.New("could not load file")
+	}
+
+	fm.MIMEType = mime.TypeByExtension(filepath.Ext(filename))
+	if fm.MIMEType == "" {
+		fm.MIMEType = http.DetectContentType(plainFile)
+	}
+	fm.FileName = filepath.Base(filename)
+	fm.Size = uint32(len(plainFile))
+	fm.Key, _, _, fm.BlobID, err = encryptAndUploadSym(context.Background(), sc.blobs(), plainFile)
+
+	return err
+}
+
+//Serialize returns a fully serialized byte slice of a FileMessage
+func (fm FileMessage) Serialize() []byte {
+	return serializeFileMsg(fm).Bytes()
+}
+
+//--------8<--------8<--------8<--------8<--------8<--------8<--------8<--------8<--------8<----
+
 //TypingNotificationMessage represents a typing notifiaction message
 type TypingNotificationMessage struct {
 	messageHeader
@@ -356,6 +442,8 @@ type groupImageMessageBody struct {
 	ServerID byte
 	Size     uint32
 	Key      [32]byte
+	// Info describes the image as given to the constructor, it is not transmitted
+	Info MediaInfo
 }
 
 // GroupCreator returns the ID of the groups admin/creator as string
@@ -382,21 +470,29 @@ func (im GroupImageMessage) Serialize() []byte {
 
 // GetImageData return the decrypted Image needs the recipients secret key
 func (im GroupImageMessage) GetImageData(sc SessionContext) ([]byte, error) {
-	return downloadAndDecryptSym(im.BlobID, im.Key)
+	return downloadAndDecryptSym(context.Background(), sc, im.inboundMedia(), im.Key)
 }
 
-// SetImageData encrypts the given image symmetrically and adds it to the message
-func (im *GroupImageMessage) SetImageData(filename string) error {
-	return im.groupImageMessageBody.setImageData(filename)
+// SetImageData encrypts the given image symmetrically and adds it to the message.
+// The image is prepared according to the session's ImageOptions and uploaded to its
+// BlobStore.
+func (im *GroupImageMessage) SetImageData(filename string, sc SessionContext) error {
+	return im.groupImageMessageBody.setImageData(sc.blobs(), sc.ImageOptions, filename)
 }
 
-func (im *groupImageMessageBody) setImageData(filename string) error {
-	plainImage, err := ioutil.ReadFile(filename)
-	if err != nil {
+func (im *groupImageMessageBody) setImageData(store BlobStore, opts *ImageOptions, filename string) error {
+	plainImage, err := readBlobFile(store, filename)
+	if errors.Is(err, ErrBlobTooLarge) {
+		return err
+	} else if err != nil {
 		return errors.New("could not load image")
 	}
+	plainImage, im.Info, err = prepareImage(opts, plainImage, MediaInfo{})
+	if err != nil {
+		return err
+	}
 
-	im.Key, im.ServerID, im.Size, im.BlobID, err = encryptAndUploadSym(plainImage)
+	im.Key, im.ServerID, im.Size, im.BlobID, err = encryptAndUploadSym(context.Background(), store, plainImage)
 
 	return err
 }
@@ -541,7 +637,7 @@ func NewGroupManageSetImageMessages(sc *SessionContext, group Group, filename st
 			groupImageMessageBody{},
 		}
 
-		err := gms[i].SetImageData(filename)
+		err := gms[i].groupImageMessageBody.setImageData(sc.blobs(), sc.ImageOptions, filename)
 		if err != nil {
 			//TODO: pretty sure this isn't a good idea
 			return nil
@@ -553,12 +649,14 @@ func NewGroupManageSetImageMessages(sc *SessionContext, group Group, filename st
 
 // GetImageData returns the decrypted Image
 func (im GroupManageSetImageMessage) GetImageData(sc SessionContext) ([]byte, error) {
-	return downloadAndDecryptSym(im.BlobID, im.Key)
+	return downloadAndDecryptSym(context.Background(), sc, im.inboundMedia(), im.Key)
 }
 
-// SetImageData encrypts the given image symmetrically and adds it to the message
-func (im *GroupManageSetImageMessage) SetImageData(filename string) error {
-	return im.groupImageMessageBody.setImageData(filename)
+// SetImageData encrypts the given image symmetrically and adds it to the message.
+// The image is prepared according to the session's ImageOptions and uploaded to its
+// BlobStore.
+func (im *GroupManageSetImageMessage) SetImageData(filename string, sc SessionContext) error {
+	return im.groupImageMessageBody.setImageData(sc.blobs(), sc.ImageOptions, filename)
 }
 
 //Serialize returns a fully serialized byte slice of an ImageMessage
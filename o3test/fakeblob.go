@@ -0,0 +1,125 @@
+package o3test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeBlobServer is a local stand-in for Threema's blob servers keeping blobs in memory,
+// so media messages can be tested offline. It has to be closed after use. Point an
+// o3.HTTPBlobStore at it with
+//
+//	&o3.HTTPBlobStore{
+//		UploadURL:   fb.URL + "/upload",
+//		DownloadURL: fb.URL + "/{blobId}",
+//		DoneURL:     fb.URL + "/{blobId}/done",
+//		Client:      fb.Client(),
+//	}
+type FakeBlobServer struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	blobs       map[string][]byte
+	done        map[string]bool
+	interrupted int
+}
+
+// NewFakeBlobServer starts a FakeBlobServer
+func NewFakeBlobServer() *FakeBlobServer {
+	fb := &FakeBlobServer{
+		blobs: make(map[string][]byte),
+		done:  make(map[string]bool),
+	}
+	fb.Server = httptest.NewServer(http.HandlerFunc(fb.serveHTTP))
+	return fb
+}
+
+// Blob returns the stored blob with the given ID
+func (fb *FakeBlobServer) Blob(blobID [16]byte) ([]byte, bool) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	blob, ok := fb.blobs[hex.EncodeToString(blobID[:])]
+	return blob, ok
+}
+
+// InterruptDownloads makes the server drop the connection halfway through the next n
+// downloads, to exercise resuming
+func (fb *FakeBlobServer) InterruptDownloads(n int) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	fb.interrupted = n
+}
+
+// Done reports whether the blob with the given ID has been marked as done
+func (fb *FakeBlobServer) Done(blobID [16]byte) bool {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	return fb.done[hex.EncodeToString(blobID[:])]
+}
+
+func (fb *FakeBlobServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+
+	switch {
+	case path == "upload" && r.Method == http.MethodPost:
+		file, _, err := r.FormFile("blob")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		blob, err := ioutil.ReadAll(file)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var blobID [16]byte
+		rand.Read(blobID[:])
+		id := hex.EncodeToString(blobID[:])
+
+		fb.mu.Lock()
+		fb.blobs[id] = blob
+		fb.mu.Unlock()
+		w.Write([]byte(id))
+	case strings.HasSuffix(path, "/done") && r.Method == http.MethodPost:
+		id := strings.TrimSuffix(path, "/done")
+		fb.mu.Lock()
+		defer fb.mu.Unlock()
+		if _, ok := fb.blobs[id]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fb.done[id] = true
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet:
+		fb.mu.Lock()
+		blob, ok := fb.blobs[path]
+		interrupt := fb.interrupted > 0
+		if ok && interrupt {
+			fb.interrupted--
+		}
+		fb.mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if interrupt {
+			w.Header().Set("Content-Length", strconv.Itoa(len(blob)))
+			w.Write(blob[:len(blob)/2])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		// ServeContent answers range requests of resumed downloads
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(blob))
+	default:
+		http.NotFound(w, r)
+	}
+}
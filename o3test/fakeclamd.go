@@ -0,0 +1,112 @@
+package o3test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+// FakeClamd is a local stand-in for a clamd daemon answering INSTREAM scans. It reports
+// streams containing one of its signatures as infected, so inspection can be tested
+// without ClamAV installed. It has to be closed after use. Point an o3.ClamAV at it with
+//
+//	o3.ClamAV{Network: "tcp", Address: fc.Addr()}
+type FakeClamd struct {
+	listener net.Listener
+
+	mu         sync.Mutex
+	signatures map[string]string
+	scans      int
+}
+
+// NewFakeClamd starts a FakeClamd on a local TCP port. It knows the EICAR test string
+// as "Eicar-Signature".
+func NewFakeClamd(t testing.TB) *FakeClamd {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("FakeClamd cannot listen: %v", err)
+	}
+	fc := &FakeClamd{
+		listener: listener,
+		signatures: map[string]string{
+			`X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`: "Eicar-Signature"}}
+	go fc.serve()
+	return fc
+}
+
+// Addr returns the TCP address the FakeClamd listens on
+func (fc *FakeClamd) Addr() string {
+	return fc.listener.Addr().String()
+}
+
+// AddSignature makes streams containing pattern be reported as infected with name
+func (fc *FakeClamd) AddSignature(name, pattern string) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.signatures[pattern] = name
+}
+
+// Scans returns the number of completed scans
+func (fc *FakeClamd) Scans() int {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.scans
+}
+
+// Close stops the FakeClamd
+func (fc *FakeClamd) Close() error {
+	return fc.listener.Close()
+}
+
+func (fc *FakeClamd) serve() {
+	for {
+		conn, err := fc.listener.Accept()
+		if err != nil {
+			return
+		}
+		go fc.scan(conn)
+	}
+}
+
+func (fc *FakeClamd) scan(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	command, err := r.ReadString(0)
+	if err != nil {
+		return
+	}
+	if command != "zINSTREAM\x00" {
+		conn.Write([]byte("UNKNOWN COMMAND\x00"))
+		return
+	}
+
+	var stream bytes.Buffer
+	for {
+		var size uint32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return
+		}
+		if size == 0 {
+			break
+		}
+		if _, err := io.CopyN(&stream, r, int64(size)); err != nil {
+			return
+		}
+	}
+
+	fc.mu.Lock()
+	fc.scans++
+	reply := "stream: OK"
+	for pattern, name := range fc.signatures {
+		if bytes.Contains(stream.Bytes(), []byte(pattern)) {
+			reply = "stream: " + name + " FOUND"
+			break
+		}
+	}
+	fc.mu.Unlock()
+	conn.Write([]byte(reply + "\x00"))
+}
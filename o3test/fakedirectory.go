@@ -0,0 +1,508 @@
+// Package o3test provides local stand-ins for the servers o3 talks to, so applications
+// using o3 can be tested without network access. The fakes speak the servers' wire
+// protocols and do not depend on o3 itself.
+package o3test
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+// stateInvalid is the state of revoked identities, o3.IDENTITYINVALID
+const stateInvalid = 2
+
+// createIdentityNonce is the nonce of the response to an identity/create challenge
+var createIdentityNonce = [24]byte{0x63, 0x72, 0x65, 0x61, 0x74, 0x65, 0x49, 0x64, 0x65, 0x6e, 0x74, 0x69, 0x74, 0x79, 0x20, 0x72, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x2e}
+
+// Keys of the HMAC-SHA256 hashes used for contact discovery
+var (
+	emailHashKey = [32]byte{0x30, 0xa5, 0x50, 0x0f, 0xed, 0x97, 0x01, 0xfa, 0x6d, 0xef, 0xdb, 0x61, 0x08, 0x41, 0x90, 0x0f,
+		0xeb, 0xb8, 0xe4, 0x30, 0x88, 0x1f, 0x7a, 0xd8, 0x16, 0x82, 0x62, 0x64, 0xec, 0x09, 0xba, 0xd7}
+	phoneHashKey = [32]byte{0x85, 0xad, 0xf8, 0x22, 0x69, 0x53, 0xf3, 0xd9, 0x6c, 0xfd, 0x5d, 0x09, 0xbf, 0x29, 0x55, 0x5e,
+		0xb9, 0x55, 0xfc, 0xd8, 0xaa, 0x5e, 0xc4, 0xf9, 0xfc, 0xd8, 0x69, 0xe2, 0x58, 0x37, 0x07, 0x23}
+)
+
+// FakeDirectory is a local stand-in for the Threema directory API implementing
+// identity creation, lookup and the authenticated identity operations, so identity
+// flows can be tested without network access. Point an o3.ThreemaRest at it with
+//
+//	o3.ThreemaRest{BaseURL: fd.URL, Client: fd.Client()}
+type FakeDirectory struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	identities map[string]*fakeIdentity
+	challenges map[string]fakeChallenge
+	// verifications holds pending phone number links by verification ID
+	verifications map[string]fakeVerification
+}
+
+type fakeIdentity struct {
+	publicKey     [32]byte
+	featureLevel  int
+	featureMask   uint64
+	state         uint8
+	email         string
+	phone         string
+	revocationKey string
+}
+
+// fakeVerification is a pending phone number link
+type fakeVerification struct {
+	id    string
+	phone string
+	code  string
+}
+
+// fakeChallenge is a token handed out in the first stage of a two-stage request
+type fakeChallenge struct {
+	token     []byte
+	secretKey [32]byte
+}
+
+// NewFakeDirectory starts a FakeDirectory. It has to be closed after use.
+func NewFakeDirectory() *FakeDirectory {
+	fd := &FakeDirectory{
+		identities:    make(map[string]*fakeIdentity),
+		challenges:    make(map[string]fakeChallenge),
+		verifications: make(map[string]fakeVerification),
+	}
+	fd.Server = httptest.NewServer(http.HandlerFunc(fd.serveHTTP))
+	return fd
+}
+
+// AddIdentity registers an existing identity with the FakeDirectory
+func (fd *FakeDirectory) AddIdentity(id string, publicKey [32]byte, featureMask uint64) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	fd.identities[id] = &fakeIdentity{publicKey: publicKey, featureMask: featureMask}
+}
+
+// SetState changes the state of a registered identity to one of the values of
+// o3.IdentityState. Identities set to o3.IDENTITYINVALID are treated as revoked and can
+// no longer be fetched.
+func (fd *FakeDirectory) SetState(id string, state uint8) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	if ident, ok := fd.identities[id]; ok {
+		ident.state = state
+	}
+}
+
+// LinkEmail links an email address normalized as by o3.NormalizeEmail to a registered
+// identity without verification
+func (fd *FakeDirectory) LinkEmail(id string, email string) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	if ident, ok := fd.identities[id]; ok {
+		ident.email = email
+	}
+}
+
+// LinkPhoneNumber links a phone number normalized as by o3.NormalizePhoneNumber to a
+// registered identity without verification
+func (fd *FakeDirectory) LinkPhoneNumber(id string, phone string) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	if ident, ok := fd.identities[id]; ok {
+		ident.phone = phone
+	}
+}
+
+// VerificationCode returns the code that would have been sent by SMS for a pending
+// phone number link
+func (fd *FakeDirectory) VerificationCode(verificationID string) string {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	return fd.verifications[verificationID].code
+}
+
+// RevocationPasswordMatches reports whether password is the revocation password set for id
+func (fd *FakeDirectory) RevocationPasswordMatches(id string, password string) bool {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	ident, ok := fd.identities[id]
+	sum := sha256.Sum256([]byte(password))
+	return ok && ident.revocationKey != "" && ident.revocationKey == base64.StdEncoding.EncodeToString(sum[:4])
+}
+
+// PublicKey returns the public key registered for id
+func (fd *FakeDirectory) PublicKey(id string) ([32]byte, bool) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	ident, ok := fd.identities[id]
+	if !ok {
+		return [32]byte{}, false
+	}
+	return ident.publicKey, true
+}
+
+// FeatureLevel returns the feature level last set for id
+func (fd *FakeDirectory) FeatureLevel(id string) int {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	if ident, ok := fd.identities[id]; ok {
+		return ident.featureLevel
+	}
+	return 0
+}
+
+// FeatureMask returns the feature mask last set for id
+func (fd *FakeDirectory) FeatureMask(id string) uint64 {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	if ident, ok := fd.identities[id]; ok {
+		return ident.featureMask
+	}
+	return 0
+}
+
+func (fd *FakeDirectory) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	op := strings.TrimPrefix(r.URL.Path, "/")
+
+	var params map[string]interface{}
+	if r.Method == http.MethodPost {
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+			writeFakeError(w, http.StatusBadRequest, "invalid JSON")
+			return
+		}
+	}
+
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+
+	switch {
+	case op == "identity/create" && r.Method == http.MethodPost:
+		fd.createIdentity(w, params)
+	case op == "identity/set_featurelevel" && r.Method == http.MethodPost:
+		fd.authenticated(w, params, func(ident *fakeIdentity) {
+			level, _ := params["featureLevel"].(float64)
+			ident.featureLevel = int(level)
+			writeFakeJSON(w, map[string]interface{}{"success": true})
+		})
+	case op == "identity/set_featuremask" && r.Method == http.MethodPost:
+		fd.authenticated(w, params, func(ident *fakeIdentity) {
+			mask, _ := params["featureMask"].(float64)
+			ident.featureMask = uint64(mask)
+			writeFakeJSON(w, map[string]interface{}{"success": true})
+		})
+	case op == "identity/fetch_bulk" && r.Method == http.MethodPost:
+		fd.fetchBulk(w, params)
+	case op == "identity/check" && r.Method == http.MethodPost:
+		fd.check(w, params)
+	case op == "identity/match" && r.Method == http.MethodPost:
+		fd.match(w, params)
+	case op == "identity/link_email" && r.Method == http.MethodPost:
+		fd.authenticated(w, params, func(ident *fakeIdentity) {
+			// the link is verified immediately, there is no mail to follow
+			ident.email, _ = params["email"].(string)
+			writeFakeJSON(w, map[string]interface{}{"success": true, "linked": ident.email != ""})
+		})
+	case op == "identity/link_mobileno" && r.Method == http.MethodPost:
+		if _, verify := params["verificationId"]; verify {
+			fd.verifyPhoneNumber(w, params)
+			return
+		}
+		fd.authenticated(w, params, func(ident *fakeIdentity) {
+			fd.linkPhoneNumber(w, params, ident)
+		})
+	case op == "identity/fetch_priv" && r.Method == http.MethodPost:
+		fd.authenticated(w, params, func(ident *fakeIdentity) {
+			writeFakeJSON(w, map[string]interface{}{"success": true, "email": ident.email, "mobileNo": ident.phone})
+		})
+	case op == "identity/set_revocation_key" && r.Method == http.MethodPost:
+		fd.authenticated(w, params, func(ident *fakeIdentity) {
+			ident.revocationKey, _ = params["revocationKey"].(string)
+			writeFakeJSON(w, map[string]interface{}{"success": true})
+		})
+	case op == "identity/revoke" && r.Method == http.MethodPost:
+		fd.authenticated(w, params, func(ident *fakeIdentity) {
+			ident.state = stateInvalid
+			ident.email, ident.phone = "", ""
+			writeFakeJSON(w, map[string]interface{}{"success": true})
+		})
+	case strings.HasPrefix(op, "identity/") && r.Method == http.MethodGet:
+		id := strings.TrimPrefix(op, "identity/")
+		ident, ok := fd.identities[id]
+		if !ok || ident.state == stateInvalid {
+			writeFakeError(w, http.StatusNotFound, "identity not found")
+			return
+		}
+		writeFakeJSON(w, map[string]interface{}{
+			"identity":  id,
+			"publicKey": base64.StdEncoding.EncodeToString(ident.publicKey[:]),
+		})
+	default:
+		writeFakeError(w, http.StatusNotFound, "unknown endpoint")
+	}
+}
+
+func (fd *FakeDirectory) createIdentity(w http.ResponseWriter, params map[string]interface{}) {
+	pk, _ := params["publicKey"].(string)
+	rawKey, err := base64.StdEncoding.DecodeString(pk)
+	if err != nil || len(rawKey) != 32 {
+		writeFakeError(w, http.StatusBadRequest, "invalid public key")
+		return
+	}
+	var publicKey [32]byte
+	copy(publicKey[:], rawKey)
+
+	if _, stage2 := params["token"]; !stage2 {
+		fd.challenge(w)
+		return
+	}
+	if !fd.verify(params, &publicKey, &createIdentityNonce) {
+		writeFakeJSON(w, map[string]interface{}{"success": false, "error": "invalid response"})
+		return
+	}
+
+	id := fd.newID()
+	fd.identities[id] = &fakeIdentity{publicKey: publicKey}
+	writeFakeJSON(w, map[string]interface{}{"success": true, "identity": id})
+}
+
+func (fd *FakeDirectory) fetchBulk(w http.ResponseWriter, params map[string]interface{}) {
+	var identities []map[string]interface{}
+	for _, id := range fakeIDList(params) {
+		ident, ok := fd.identities[id]
+		if !ok || ident.state == stateInvalid {
+			continue
+		}
+		identities = append(identities, map[string]interface{}{
+			"identity":    id,
+			"publicKey":   base64.StdEncoding.EncodeToString(ident.publicKey[:]),
+			"featureMask": ident.featureMask,
+			"state":       ident.state,
+		})
+	}
+	writeFakeJSON(w, map[string]interface{}{"identities": identities})
+}
+
+func (fd *FakeDirectory) check(w http.ResponseWriter, params map[string]interface{}) {
+	ids := fakeIDList(params)
+	identities := make([]string, len(ids))
+	states := make([]uint8, len(ids))
+	featureMasks := make([]uint64, len(ids))
+	for i, id := range ids {
+		identities[i] = id
+		states[i] = stateInvalid
+		if ident, ok := fd.identities[id]; ok {
+			states[i] = ident.state
+			featureMasks[i] = ident.featureMask
+		}
+	}
+	writeFakeJSON(w, map[string]interface{}{
+		"identities":    identities,
+		"states":        states,
+		"featureMasks":  featureMasks,
+		"checkInterval": 86400,
+	})
+}
+
+func (fd *FakeDirectory) match(w http.ResponseWriter, params map[string]interface{}) {
+	emailHashes := fakeStringSet(params["emailHashes"])
+	phoneHashes := fakeStringSet(params["mobileNoHashes"])
+
+	var identities []map[string]interface{}
+	for id, ident := range fd.identities {
+		if ident.state == stateInvalid {
+			continue
+		}
+		m := map[string]interface{}{
+			"identity":  id,
+			"publicKey": base64.StdEncoding.EncodeToString(ident.publicKey[:]),
+		}
+		if ident.email != "" {
+			hash := discoveryHash(&emailHashKey, ident.email)
+			if encoded := base64.StdEncoding.EncodeToString(hash[:]); emailHashes[encoded] {
+				m["emailHash"] = encoded
+			}
+		}
+		if ident.phone != "" {
+			hash := discoveryHash(&phoneHashKey, ident.phone)
+			if encoded := base64.StdEncoding.EncodeToString(hash[:]); phoneHashes[encoded] {
+				m["mobileNoHash"] = encoded
+			}
+		}
+		if len(m) > 2 {
+			identities = append(identities, m)
+		}
+	}
+	writeFakeJSON(w, map[string]interface{}{"identities": identities})
+}
+
+func (fd *FakeDirectory) linkPhoneNumber(w http.ResponseWriter, params map[string]interface{}, ident *fakeIdentity) {
+	phone, _ := params["mobileNo"].(string)
+	if phone == "" {
+		ident.phone = ""
+		writeFakeJSON(w, map[string]interface{}{"success": true, "linked": false})
+		return
+	}
+
+	var id string
+	for candidate, i := range fd.identities {
+		if i == ident {
+			id = candidate
+		}
+	}
+	raw := make([]byte, 12)
+	rand.Read(raw)
+	verificationID := base64.RawURLEncoding.EncodeToString(raw)
+	code := make([]byte, 6)
+	rand.Read(code)
+	for i := range code {
+		code[i] = '0' + code[i]%10
+	}
+	fd.verifications[verificationID] = fakeVerification{id: id, phone: phone, code: string(code)}
+	writeFakeJSON(w, map[string]interface{}{"success": true, "linked": false, "verificationId": verificationID})
+}
+
+func (fd *FakeDirectory) verifyPhoneNumber(w http.ResponseWriter, params map[string]interface{}) {
+	verificationID, _ := params["verificationId"].(string)
+	code, _ := params["code"].(string)
+	pending, ok := fd.verifications[verificationID]
+	if !ok || pending.code != code {
+		writeFakeJSON(w, map[string]interface{}{"success": false, "error": "invalid verification code"})
+		return
+	}
+	delete(fd.verifications, verificationID)
+	if ident, ok := fd.identities[pending.id]; ok {
+		ident.phone = pending.phone
+	}
+	writeFakeJSON(w, map[string]interface{}{"success": true})
+}
+
+// authenticated runs action for the identity of a two-stage request once its
+// response has been verified
+func (fd *FakeDirectory) authenticated(w http.ResponseWriter, params map[string]interface{}, action func(*fakeIdentity)) {
+	idString, _ := params["identity"].(string)
+	ident, ok := fd.identities[idString]
+	if !ok || ident.state == stateInvalid {
+		writeFakeError(w, http.StatusNotFound, "identity not found")
+		return
+	}
+
+	if _, stage2 := params["token"]; !stage2 {
+		fd.challenge(w)
+		return
+	}
+
+	nonceString, _ := params["nonce"].(string)
+	rawNonce, err := base64.StdEncoding.DecodeString(nonceString)
+	if err != nil || len(rawNonce) != 24 {
+		writeFakeError(w, http.StatusBadRequest, "invalid nonce")
+		return
+	}
+	var nonce [24]byte
+	copy(nonce[:], rawNonce)
+	if !fd.verify(params, &ident.publicKey, &nonce) {
+		writeFakeJSON(w, map[string]interface{}{"success": false, "error": "invalid response"})
+		return
+	}
+	action(ident)
+}
+
+// challenge hands out a new token and the public key the response has to be encrypted for
+func (fd *FakeDirectory) challenge(w http.ResponseWriter) {
+	pk, sk, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		writeFakeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	token := make([]byte, 32)
+	rand.Read(token)
+
+	tokenString := base64.StdEncoding.EncodeToString(token)
+	fd.challenges[tokenString] = fakeChallenge{token: token, secretKey: *sk}
+	writeFakeJSON(w, map[string]interface{}{
+		"token":           tokenString,
+		"tokenRespKeyPub": base64.StdEncoding.EncodeToString(pk[:]),
+	})
+}
+
+// verify checks that the response of a two-stage request is the token encrypted with
+// the secret key belonging to publicKey. Tokens can only be used once.
+func (fd *FakeDirectory) verify(params map[string]interface{}, publicKey *[32]byte, nonce *[24]byte) bool {
+	tokenString, _ := params["token"].(string)
+	ch, ok := fd.challenges[tokenString]
+	if !ok {
+		return false
+	}
+	delete(fd.challenges, tokenString)
+
+	responseString, _ := params["response"].(string)
+	response, err := base64.StdEncoding.DecodeString(responseString)
+	if err != nil {
+		return false
+	}
+	token, ok := box.Open(nil, response, nonce, publicKey, &ch.secretKey)
+	return ok && string(token) == string(ch.token)
+}
+
+// newID returns an unused random ID
+func (fd *FakeDirectory) newID() string {
+	const chars = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	for {
+		raw := make([]byte, 8)
+		rand.Read(raw)
+		for i := range raw {
+			raw[i] = chars[int(raw[i])%len(chars)]
+		}
+		id := string(raw)
+		if _, taken := fd.identities[id]; !taken {
+			return id
+		}
+	}
+}
+
+// fakeIDList returns the IDs of a bulk request
+func fakeIDList(params map[string]interface{}) []string {
+	list, _ := params["identities"].([]interface{})
+	ids := make([]string, 0, len(list))
+	for _, v := range list {
+		if s, ok := v.(string); ok {
+			ids = append(ids, s)
+		}
+	}
+	return ids
+}
+
+// discoveryHash returns the HMAC-SHA256 of a normalized email address or phone number
+func discoveryHash(key *[32]byte, normalized string) [32]byte {
+	var sum [32]byte
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write([]byte(normalized))
+	copy(sum[:], mac.Sum(nil))
+	return sum
+}
+
+func fakeStringSet(v interface{}) map[string]bool {
+	list, _ := v.([]interface{})
+	set := make(map[string]bool, len(list))
+	for _, item := range list {
+		if s, ok := item.(string); ok {
+			set[s] = true
+		}
+	}
+	return set
+}
+
+func writeFakeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeFakeError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": msg})
+}
@@ -0,0 +1,73 @@
+package o3test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// maxBackupSize is the largest backup a FakeSafeServer accepts
+const maxBackupSize = 1 << 20
+
+// FakeSafeServer is a local stand-in for a Threema Safe server storing backups in
+// memory. It has to be closed after use. Point an o3.SafeServer at it with
+//
+//	o3.SafeServer{URL: fs.URL, Client: fs.Client()}
+type FakeSafeServer struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	backups map[string][]byte
+}
+
+// NewFakeSafeServer starts a FakeSafeServer
+func NewFakeSafeServer() *FakeSafeServer {
+	fs := &FakeSafeServer{backups: make(map[string][]byte)}
+	fs.Server = httptest.NewServer(http.HandlerFunc(fs.serveHTTP))
+	return fs
+}
+
+// Backup returns the stored backup with the given hex encoded ID
+func (fs *FakeSafeServer) Backup(backupID string) ([]byte, bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	data, ok := fs.backups[backupID]
+	return data, ok
+}
+
+func (fs *FakeSafeServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	backupID := strings.TrimPrefix(r.URL.Path, "/backups/")
+	if backupID == r.URL.Path || len(backupID) != 64 {
+		http.NotFound(w, r)
+		return
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodPut:
+		data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBackupSize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		fs.backups[backupID] = data
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet:
+		data, ok := fs.backups[backupID]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(data)
+	case http.MethodDelete:
+		delete(fs.backups, backupID)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,285 @@
+package o3
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OutboxEntry is an outgoing message kept in an Outbox until the server acknowledges it
+type OutboxEntry struct {
+	Sender    IDString
+	Recipient IDString
+	ID        uint64
+	Time      time.Time
+	PubNick   PubNick
+	// Payload is the serialized message before encryption
+	Payload []byte
+}
+
+// Outbox keeps outgoing messages durable: a session adds every message enqueued for
+// sending, removes it when the server acknowledges it and resends the remaining ones
+// with their original IDs on the next Run, so recipients can drop duplicates. Messages
+// that can never be sent are removed as well and reported as *UndeliverableError.
+// Implementations have to be safe for concurrent use.
+type Outbox interface {
+	// Add stores an entry, replacing an entry with the same recipient and ID
+	Add(entry OutboxEntry) error
+	// Remove deletes the entry with the given recipient and ID, if any
+	Remove(recipient IDString, id uint64) error
+	// List returns all entries in the order they were added
+	List() ([]OutboxEntry, error)
+}
+
+// UndeliverableError is reported for an outgoing message that can never be sent, e.g.
+// because its recipient does not exist or their changed key was refused. The message is
+// removed from the session's Outbox.
+type UndeliverableError struct {
+	Recipient IDString
+	ID        uint64
+	Err       error
+}
+
+func (e *UndeliverableError) Error() string {
+	return fmt.Sprintf("o3: message %016x to %s discarded: %v", e.ID, e.Recipient, e.Err)
+}
+
+// Unwrap returns the reason the message cannot be sent
+func (e *UndeliverableError) Unwrap() error {
+	return e.Err
+}
+
+// outboxMessage is a message restored from an Outbox. It is sent with its original
+// header and payload.
+type outboxMessage struct {
+	messageHeader
+	payload []byte
+}
+
+// Serialize returns the stored payload
+func (om outboxMessage) Serialize() []byte {
+	return om.payload
+}
+
+// newOutboxEntry captures a message so it can be resent after a restart
+func newOutboxEntry(msg Message) OutboxEntry {
+	mh := msg.header()
+	return OutboxEntry{
+		Sender:    mh.sender,
+		Recipient: mh.recipient,
+		ID:        mh.id,
+		Time:      mh.time,
+		PubNick:   mh.pubNick,
+		Payload:   msg.Serialize()}
+}
+
+// message turns an entry back into a message ready to be dispatched
+func (oe OutboxEntry) message() Message {
+	return outboxMessage{
+		messageHeader: messageHeader{
+			sender:    oe.Sender,
+			recipient: oe.Recipient,
+			id:        oe.ID,
+			time:      oe.Time,
+			pubNick:   oe.PubNick},
+		payload: oe.Payload}
+}
+
+// FileOutbox is an Outbox keeping every entry in a file of its own within a directory.
+// Entries are written to a temporary file that is synced and renamed, so a crash never
+// leaves a partial entry behind.
+type FileOutbox struct {
+	mu  sync.Mutex
+	dir string
+	seq int64
+}
+
+// fileOutboxRecord is the JSON form of an OutboxEntry
+type fileOutboxRecord struct {
+	Seq       int64     `json:"seq"`
+	Sender    string    `json:"sender"`
+	Recipient string    `json:"recipient"`
+	ID        uint64    `json:"id"`
+	Time      time.Time `json:"time"`
+	PubNick   string    `json:"nick"`
+	Payload   []byte    `json:"payload"`
+}
+
+// NewFileOutbox returns a FileOutbox storing its entries in dir, which is created if
+// it does not exist. Entries left by a previous run are kept.
+func NewFileOutbox(dir string) (*FileOutbox, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileOutbox{dir: dir}, nil
+}
+
+func (fo *FileOutbox) filename(recipient IDString, id uint64) string {
+	return filepath.Join(fo.dir, fmt.Sprintf("%s-%016x.msg", strings.TrimRight(recipient.String(), "\x00"), id))
+}
+
+// Add writes an entry to its file
+func (fo *FileOutbox) Add(entry OutboxEntry) error {
+	fo.mu.Lock()
+	defer fo.mu.Unlock()
+
+	// entries are ordered by this sequence number, which keeps growing across restarts
+	seq := time.Now().UnixNano()
+	if seq <= fo.seq {
+		seq = fo.seq + 1
+	}
+	fo.seq = seq
+
+	data, err := json.Marshal(fileOutboxRecord{
+		Seq:       seq,
+		Sender:    entry.Sender.String(),
+		Recipient: entry.Recipient.String(),
+		ID:        entry.ID,
+		Time:      entry.Time,
+		PubNick:   entry.PubNick.Trimmed(),
+		Payload:   entry.Payload})
+	if err != nil {
+		return err
+	}
+
+	filename := fo.filename(entry.Recipient, entry.ID)
+	tmp, err := ioutil.TempFile(fo.dir, filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// Remove deletes the file of an entry
+func (fo *FileOutbox) Remove(recipient IDString, id uint64) error {
+	fo.mu.Lock()
+	defer fo.mu.Unlock()
+
+	err := os.Remove(fo.filename(recipient, id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// List reads all entries. Files that cannot be parsed are skipped and reported in the
+// returned error after all valid entries have been read.
+func (fo *FileOutbox) List() ([]OutboxEntry, error) {
+	fo.mu.Lock()
+	defer fo.mu.Unlock()
+
+	files, err := filepath.Glob(filepath.Join(fo.dir, "*.msg"))
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		records []fileOutboxRecord
+		invalid []string
+	)
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var rec fileOutboxRecord
+		if err := json.Unmarshal(data, &rec); err != nil || !validIDString(rec.Recipient) {
+			invalid = append(invalid, filepath.Base(file))
+			continue
+		}
+		records = append(records, rec)
+		if rec.Seq > fo.seq {
+			fo.seq = rec.Seq
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Seq < records[j].Seq })
+
+	entries := make([]OutboxEntry, len(records))
+	for i, rec := range records {
+		entries[i] = OutboxEntry{
+			Sender:    NewIDString(rec.Sender),
+			Recipient: NewIDString(rec.Recipient),
+			ID:        rec.ID,
+			Time:      rec.Time,
+			PubNick:   NewPubNick(rec.PubNick),
+			Payload:   rec.Payload}
+	}
+	if len(invalid) > 0 {
+		return entries, fmt.Errorf("o3: invalid outbox entries: %s", strings.Join(invalid, ", "))
+	}
+	return entries, nil
+}
+
+// enqueueOutgoing persists a message in the session's Outbox before it is queued for
+// sending. A failure is reported but does not keep the message from being sent.
+func (sc *SessionContext) enqueueOutgoing(msg Message) {
+	if sc.Outbox == nil {
+		return
+	}
+	if _, restored := msg.(outboxMessage); restored {
+		return
+	}
+	if err := sc.Outbox.Add(newOutboxEntry(msg)); err != nil {
+		sc.reportError(err)
+	}
+}
+
+// discardOutgoing removes a message from the session's Outbox once the server has
+// acknowledged it or it will not be sent at all
+func (sc *SessionContext) discardOutgoing(recipient IDString, id uint64) {
+	if sc.Outbox == nil {
+		return
+	}
+	if err := sc.Outbox.Remove(recipient, id); err != nil {
+		sc.reportError(err)
+	}
+}
+
+// failOutgoing reports a message that could not be sent. Messages that will never be
+// sent are removed from the session's Outbox, others are kept for the next Run.
+func (sc *SessionContext) failOutgoing(msg Message, err error) {
+	mh := msg.header()
+	var mismatch *KeyMismatchError
+	permanent := errors.Is(err, ErrIdentityNotFound) ||
+		(errors.As(err, &mismatch) && mismatch.Refused) ||
+		!validIDString(strings.TrimRight(mh.recipient.String(), "\x00"))
+	if !permanent {
+		sc.reportError(err)
+		return
+	}
+	sc.discardOutgoing(mh.recipient, mh.id)
+	sc.reportError(&UndeliverableError{Recipient: mh.recipient, ID: mh.id, Err: err})
+}
+
+// replayOutbox queues the messages left in the session's Outbox by a previous run
+func (sc *SessionContext) replayOutbox() {
+	if sc.Outbox == nil {
+		return
+	}
+	entries, err := sc.Outbox.List()
+	if err != nil {
+		sc.reportError(err)
+	}
+	for _, entry := range entries {
+		sc.sendMsgChan.In <- entry.message()
+	}
+}
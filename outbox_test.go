@@ -0,0 +1,119 @@
+package o3
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/o3ma/o3/o3test"
+)
+
+func TestFileOutboxReplay(t *testing.T) {
+	dir := t.TempDir()
+	sc := NewSessionContext(ThreemaID{ID: NewIDString("ECHOECHO"), Nick: NewPubNick("echo")})
+	outbox, err := NewFileOutbox(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc.Outbox = outbox
+
+	first, _ := NewTextMessage(&sc, "ABCDEFGH", "first")
+	second, _ := NewTextMessage(&sc, "ABCDEFGH", "second")
+	third, _ := NewTextMessage(&sc, "HGFEDCBA", "third")
+	for _, msg := range []Message{first, second, third} {
+		sc.enqueueOutgoing(msg)
+	}
+	// acknowledged by the server
+	sc.discardOutgoing(second.header().recipient, second.header().id)
+
+	// a new process finds the remaining messages in order
+	reopened, err := NewFileOutbox(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := reopened.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("%d entries, want 2", len(entries))
+	}
+	for i, want := range []TextMessage{first, third} {
+		msg := entries[i].message()
+		got, mh := msg.header(), want.header()
+		if got.sender != mh.sender || got.recipient != mh.recipient || got.id != mh.id ||
+			got.pubNick != mh.pubNick || !got.time.Equal(mh.time) {
+			t.Errorf("entry %d: header %+v, want %+v", i, got, mh)
+		}
+		if !bytes.Equal(msg.Serialize(), entries[i].Payload) || msg.Serialize()[0] != byte(TEXTMESSAGE) {
+			t.Errorf("entry %d: payload not restored", i)
+		}
+	}
+
+	// replayed messages are not stored twice
+	sc.Outbox = reopened
+	sc.enqueueOutgoing(entries[0].message())
+	if entries, _ := reopened.List(); len(entries) != 2 {
+		t.Errorf("%d entries after replay, want 2", len(entries))
+	}
+}
+
+func TestUndeliverableOutboxEntry(t *testing.T) {
+	fd := o3test.NewFakeDirectory()
+	defer fd.Close()
+
+	sc := NewSessionContext(ThreemaID{ID: NewIDString("ECHOECHO")})
+	sc.Directory = fakeRest(fd)
+	sc.ID.Contacts.Add(testContact("FRIEND01", 0x01))
+	outbox, err := NewFileOutbox(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// left by a previous run for an identity the directory does not know
+	stale, _ := NewTextMessage(&sc, "NOBODY00", "stale")
+	outbox.Add(newOutboxEntry(stale))
+	sc.Outbox = outbox
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	sc.connection = client
+	sc.setupQueues()
+	go sc.sendLoop()
+
+	var undeliverable *UndeliverableError
+	select {
+	case err := <-sc.ErrorChan:
+		if !errors.As(err, &undeliverable) || undeliverable.ID != stale.header().id ||
+			!errors.Is(err, ErrIdentityNotFound) {
+			t.Fatalf("got %v, want undeliverable message", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("undeliverable message not reported")
+	}
+
+	// later messages are still sent
+	later, _ := NewTextMessage(&sc, "FRIEND01", "later")
+	sc.sendMsgChan.In <- later
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var size uint16
+	if err := binary.Read(server, binary.LittleEndian, &size); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(server, make([]byte, size)); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the unacknowledged later message is left
+	entries, err := outbox.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].ID != later.header().id {
+		t.Errorf("outbox entries %+v, want the later message only", entries)
+	}
+}
@@ -34,6 +34,27 @@ func writeHelper(wr io.Writer, buf *bytes.Buffer) {
 	}
 }
 
+// writePacket encrypts a serialized packet for the server and writes it. Packets are
+// written by the send and receive loops as well as by ReceivedMsg.Ack, so the nonce
+// counter and the connection are guarded by writeMu.
+func (sc *SessionContext) writePacket(wr io.Writer, plaintext []byte) {
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+	sc.writePacketLocked(wr, plaintext)
+}
+
+// writePacketLocked is writePacket for callers already holding writeMu
+func (sc *SessionContext) writePacketLocked(wr io.Writer, plaintext []byte) {
+	sc.clientNonce.increaseCounter()
+	cipherText := box.Seal(nil, plaintext, sc.clientNonce.bytes(), &sc.serverSPK, &sc.clientSSK)
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, uint16(len(cipherText)))
+	binary.Write(buf, binary.LittleEndian, cipherText)
+
+	writeHelper(wr, buf)
+}
+
 func (sc *SessionContext) dispatchClientHello(wr io.Writer) {
 	defer func() {
 		if r := recover(); r != nil {
@@ -88,20 +109,16 @@ func (sc *SessionContext) dispatchAuthMsg(wr io.Writer) {
 }
 
 func (sc *SessionContext) dispatchAckMsg(wr io.Writer, mp messagePacket) {
+	sc.writePacket(wr, serializeClientAck(mp))
+}
+
+// serializeClientAck returns the acknowledgement of a received message packet
+func serializeClientAck(mp messagePacket) []byte {
 	ackP := ackPacket{
 		PktType:  clientAck,
 		SenderID: mp.Sender,
 		MsgID:    mp.ID}
-	serializedAckPkt := serializeAckPkt(ackP)
-
-	sc.clientNonce.increaseCounter()
-	ackpCipherText := box.Seal(nil, serializedAckPkt.Bytes(), sc.clientNonce.bytes(), &sc.serverSPK, &sc.clientSSK)
-
-	buf := new(bytes.Buffer)
-	binary.Write(buf, binary.LittleEndian, uint16(len(ackpCipherText)))
-	binary.Write(buf, binary.LittleEndian, ackpCipherText)
-
-	writeHelper(wr, buf)
+	return serializeAckPkt(ackP).Bytes()
 }
 
 func (sc *SessionContext) dispatchEchoMsg(wr io.Writer, oldEchoPacket echoPacket) {
@@ -109,31 +126,20 @@ func (sc *SessionContext) dispatchEchoMsg(wr io.Writer, oldEchoPacket echoPacket
 		Counter: oldEchoPacket.Counter + 1}
 	serializedEchoPkt := serializeEchoPkt(ep)
 
-	sc.clientNonce.increaseCounter()
-	epCipherText := box.Seal(nil, serializedEchoPkt.Bytes(), sc.clientNonce.bytes(), &sc.serverSPK, &sc.clientSSK)
-
-	buf := new(bytes.Buffer)
-	binary.Write(buf, binary.LittleEndian, uint16(len(epCipherText)))
-	binary.Write(buf, binary.LittleEndian, epCipherText)
-
-	writeHelper(wr, buf)
+	sc.writePacket(wr, serializedEchoPkt.Bytes())
 }
 
-func (sc *SessionContext) dispatchMessage(wr io.Writer, m Message) {
+// dispatchMessage encrypts and writes a message. If the recipient's public key cannot be
+// resolved, e.g. because a changed key was refused, nothing is written and the error is
+// returned.
+func (sc *SessionContext) dispatchMessage(wr io.Writer, m Message) error {
 	mh := m.header()
 
 	randNonce := newRandomNonce()
 
-	recipient, ok := sc.ID.Contacts.Get(mh.recipient.String())
-	if !ok {
-		var tr ThreemaRest
-		var err error
-
-		recipient, err = tr.GetContactByID(mh.recipient)
-		if err != nil {
-			panic("Recipient's PublicKey could not be found!")
-		}
-		sc.ID.Contacts.Add(recipient)
+	recipient, err := sc.lookupContact(mh.recipient)
+	if err != nil {
+		return err
 	}
 	msgCipherText := box.Seal(nil, m.Serialize(), randNonce.bytes(), &recipient.LPK, &sc.ID.LSK)
 
@@ -151,12 +157,6 @@ func (sc *SessionContext) dispatchMessage(wr io.Writer, m Message) {
 
 	serializedMsgPkt := serializeMsgPkt(messagePkt)
 
-	sc.clientNonce.increaseCounter()
-	serializedMsgPktCipherText := box.Seal(nil, serializedMsgPkt.Bytes(), sc.clientNonce.bytes(), &sc.serverSPK, &sc.clientSSK)
-
-	buf := new(bytes.Buffer)
-	binary.Write(buf, binary.LittleEndian, uint16(len(serializedMsgPktCipherText)))
-	binary.Write(buf, binary.LittleEndian, serializedMsgPktCipherText)
-
-	writeHelper(wr, buf)
+	sc.writePacket(wr, serializedMsgPkt.Bytes())
+	return nil
 }
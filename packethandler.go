@@ -20,6 +20,9 @@ func handlerPanicHandler(context string, i interface{}) error {
 	if _, ok := i.(string); ok {
 		return fmt.Errorf("%s: error occurred handling %s", context, i)
 	}
+	if err, ok := i.(error); ok {
+		return fmt.Errorf("%s: %w", context, err)
+	}
 	return fmt.Errorf("%s: unknown handling error occurred: %#v", context, i)
 }
 
@@ -92,24 +95,46 @@ func (sc *SessionContext) handleClientServerMsg(buf *bytes.Buffer) interface{} {
 	case deliveringMsg:
 		// It is an e2e message!
 		msgPkt := parseMsgPkt(bytes.NewBuffer(plaintext))
-		// Find the sender in our contacts, because we need their public key
-		sender, ok := sc.ID.Contacts.Get(msgPkt.Sender.String())
-		if !ok {
-			var tr ThreemaRest
-			var err error
-			// TODO: Add to local contacts?
-			sender, err = tr.GetContactByID(msgPkt.Sender)
-			if err != nil {
-				panic("Sender's PublicKey could not be found!")
-			}
-			sc.ID.Contacts.Add(sender)
+		verdict := sc.screenSender(msgPkt.Sender)
+		if verdict == senderRejected && sc.Inbound.Quarantine == nil {
+			// No need to decrypt what is dropped anyway
+			msgPkt.Rejected = true
+			return msgPkt
+		}
+		// Find the sender in our contacts, because we need their public key. Senders
+		// that are not accepted outright must not grow the contacts.
+		sender, err := sc.resolveContact(msgPkt.Sender, verdict == senderAccepted)
+		if err != nil && verdict != senderAccepted {
+			msgPkt.Rejected = true
+			return msgPkt
+		} else if err != nil {
+			msgPkt.Err = err
+			return msgPkt
 		}
 		// Decrypt using our private and their public key
 		msgPkt.Plaintext, ok = box.Open(nil, msgPkt.Ciphertext, msgPkt.Nonce.bytes(), &sender.LPK, &sc.ID.LSK)
-		if !ok {
-			panic("Cannot decrypt e2e MSG!")
+		if !ok && verdict != senderAccepted {
+			msgPkt.Rejected = true
+			return msgPkt
+		} else if !ok {
+			// The sender may have a new key, so compare the pinned one with the directory
+			sender, err = sc.recheckLimited(sender)
+			// A changed key that was not refused has already been adopted
+			if mismatch, changed := err.(*KeyMismatchError); err != nil && (!changed || mismatch.Refused) {
+				msgPkt.Err = err
+				return msgPkt
+			}
+			msgPkt.Plaintext, ok = box.Open(nil, msgPkt.Ciphertext, msgPkt.Nonce.bytes(), &sender.LPK, &sc.ID.LSK)
+			if !ok {
+				panic("Cannot decrypt e2e MSG!")
+			}
 		}
 
+		if verdict == senderRejected || (verdict == senderGroupsOnly && !isGroupMessage(msgPkt.Plaintext)) {
+			msgPkt.Rejected = true
+		} else if verdict == senderAccepted {
+			sc.recordNickname(msgPkt.Sender, msgPkt.PubNick)
+		}
 		return msgPkt
 	case serverAck:
 		// It is an ACK for a message we sent
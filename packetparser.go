@@ -233,6 +233,7 @@ func parseAudioMessage(buf *bytes.Buffer) audioMessageBody {
 		Size:     parseUint32(buf),
 		Key:      parseKey(buf)}
 	am.ServerID = am.BlobID[0]
+	am.Info.Duration = time.Duration(am.Duration) * time.Second
 	return am
 }
 
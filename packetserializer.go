@@ -11,6 +11,8 @@ import (
 	"bytes"
 	"crypto/rand"
 	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"math/big"
 	"time"
@@ -60,7 +62,7 @@ func serializeAudioMsg(am AudioMessage) *bytes.Buffer {
 	buf := new(bytes.Buffer)
 	serializeMsgType(buf, AUDIOMESSAGE)
 	// AudioClip duration
-	serializeUint16(buf, 0xFFFF)
+	serializeUint16(buf, am.Duration)
 	serializeBlobID(buf, am.BlobID)
 	serializeUint32(buf, am.Size)
 	serializeKey(buf, am.Key)
@@ -69,6 +71,36 @@ func serializeAudioMsg(am AudioMessage) *bytes.Buffer {
 	return buf
 }
 
+// fileMessageJSON is the body of a file message
+type fileMessageJSON struct {
+	BlobID      string `json:"b"`
+	Key         string `json:"k"`
+	MIMEType    string `json:"m"`
+	FileName    string `json:"n,omitempty"`
+	Size        uint32 `json:"s"`
+	Rendering   int    `json:"j"`
+	Description string `json:"d,omitempty"`
+}
+
+func serializeFileMsg(fm FileMessage) *bytes.Buffer {
+
+	// marshalling strings and numbers cannot fail
+	body, _ := json.Marshal(fileMessageJSON{
+		BlobID:      hex.EncodeToString(fm.BlobID[:]),
+		Key:         hex.EncodeToString(fm.Key[:]),
+		MIMEType:    fm.MIMEType,
+		FileName:    fm.FileName,
+		Size:        fm.Size,
+		Description: fm.Description})
+
+	buf := new(bytes.Buffer)
+	serializeMsgType(buf, FILEMESSAGE)
+	serializeHelper(buf, body)
+	serializePadding(buf)
+
+	return buf
+}
+
 func serializeGroupTextMsg(gtm GroupTextMessage) *bytes.Buffer {
 
 	buf := new(bytes.Buffer)
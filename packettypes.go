@@ -35,6 +35,10 @@ type messagePacket struct {
 	Nonce      nonce
 	Ciphertext []byte
 	Plaintext  []byte
+	// Rejected is set if the sender did not pass the session's InboundFilter
+	Rejected bool
+	// Err is set if the sender's public key could not be resolved
+	Err error
 }
 
 type ackPacket struct {
@@ -0,0 +1,113 @@
+package o3
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// qrCodePrefix is the scheme Threema uses for contact verification QR codes
+const qrCodePrefix = "3mid:"
+
+// ParseContactQRCode parses the payload of a Threema contact QR code of the form
+// "3mid:<ID>,<hex public key>". Since the key was obtained directly from the contact,
+// the returned ThreemaContact has the verification level FULLYVERIFIED.
+func ParseContactQRCode(payload string) (ThreemaContact, error) {
+	payload = strings.TrimSpace(payload)
+	if !strings.HasPrefix(payload, qrCodePrefix) {
+		return ThreemaContact{}, errors.New("o3: not a Threema contact QR code")
+	}
+
+	fields := strings.Split(strings.TrimPrefix(payload, qrCodePrefix), ",")
+	if len(fields) < 2 {
+		return ThreemaContact{}, errors.New("o3: QR code lacks public key")
+	}
+
+	id := strings.ToUpper(fields[0])
+	if !validIDString(id) {
+		return ThreemaContact{}, fmt.Errorf("o3: invalid Threema ID in QR code: %q", fields[0])
+	}
+
+	lpk, err := hex.DecodeString(fields[1])
+	if err != nil {
+		return ThreemaContact{}, fmt.Errorf("o3: invalid public key in QR code: %s", err)
+	}
+	if len(lpk) != 32 {
+		return ThreemaContact{}, fmt.Errorf("o3: invalid public key length in QR code: %d", len(lpk))
+	}
+
+	contact := ThreemaContact{
+		ID:           NewIDString(id),
+		Verification: FULLYVERIFIED}
+	copy(contact.LPK[:], lpk)
+	return contact, nil
+}
+
+// QRCodePayload returns the payload of the QR code other Threema users can scan to
+// verify this identity
+func (thid ThreemaID) QRCodePayload() string {
+	return qrCodePrefix + thid.String() + "," + hex.EncodeToString(thid.GetPubKey()[:])
+}
+
+// Fingerprint returns the fingerprint of the identity's public key as shown by the Threema apps
+func (thid ThreemaID) Fingerprint() string {
+	return KeyFingerprint(*thid.GetPubKey())
+}
+
+// Fingerprint returns the fingerprint of the contact's public key as shown by the Threema apps
+func (tc ThreemaContact) Fingerprint() string {
+	return KeyFingerprint(tc.LPK)
+}
+
+// KeyFingerprint returns the human-readable fingerprint of a public key: the first
+// 16 bytes of its SHA-256 hash in hex
+func KeyFingerprint(key [32]byte) string {
+	sum := sha256.Sum256(key[:])
+	return hex.EncodeToString(sum[:16])
+}
+
+// VerifyContact records a contact obtained from a QR code in the session's ContactStore.
+// An already known contact is raised to the verification level of verified if its
+// pinned key matches. A pending key change is accepted if the changed key matches.
+// Any other key is reported as *KeyMismatchError and not stored.
+func (sc *SessionContext) VerifyContact(verified ThreemaContact) error {
+	store := sc.contacts()
+	known, ok := store.Get(verified.String())
+	if !ok {
+		return store.Put(verified)
+	}
+	if known.KeyChanged && known.ChangedLPK == verified.LPK {
+		known.LPK = verified.LPK
+	}
+	if known.LPK != verified.LPK {
+		return &KeyMismatchError{
+			ID:       IDString(known.ID),
+			Pinned:   known.LPK,
+			Reported: verified.LPK,
+			Refused:  true}
+	}
+
+	known.Verification = verified.Verification
+	known.KeyChanged = false
+	known.ChangedLPK = [32]byte{}
+	return store.Put(known)
+}
+
+// validIDString checks that id looks like a Threema ID: eight characters consisting of
+// capital letters and digits, gateway IDs start with an asterisk.
+func validIDString(id string) bool {
+	if len(id) != 8 {
+		return false
+	}
+	for i, c := range id {
+		switch {
+		case c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '*' && i == 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
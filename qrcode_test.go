@@ -0,0 +1,51 @@
+package o3
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestContactQRCodeRoundTrip(t *testing.T) {
+	var lsk [32]byte
+	for i := range lsk {
+		lsk[i] = byte(i)
+	}
+	thid, err := NewThreemaID("ECHOECHO", lsk, AddressBook{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := thid.QRCodePayload()
+	if !strings.HasPrefix(payload, "3mid:ECHOECHO,") {
+		t.Fatalf("unexpected payload: %q", payload)
+	}
+
+	contact, err := ParseContactQRCode(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contact.String() != "ECHOECHO" || contact.LPK != *thid.GetPubKey() {
+		t.Errorf("parsed contact does not match identity: %#v", contact)
+	}
+	if contact.Verification != FULLYVERIFIED {
+		t.Errorf("expected FULLYVERIFIED, got %d", contact.Verification)
+	}
+	if contact.Fingerprint() != thid.Fingerprint() || len(thid.Fingerprint()) != 32 {
+		t.Errorf("fingerprints differ: %s vs %s", contact.Fingerprint(), thid.Fingerprint())
+	}
+}
+
+func TestParseContactQRCodeInvalid(t *testing.T) {
+	for _, payload := range []string{
+		"",
+		"3mid:ECHOECHO",
+		"3mid:ECHO,00",
+		"3mid:ECHOECHO,zz",
+		"3mid:ECHOECHO,0011",
+		"http://ECHOECHO,00",
+	} {
+		if _, err := ParseContactQRCode(payload); err == nil {
+			t.Errorf("expected error for payload %q", payload)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package o3
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// QueuePolicy decides what happens to a message arriving at a full queue
+type QueuePolicy uint8
+
+// QueuePolicy mock enum
+const (
+	QUEUEBLOCK      QueuePolicy = 0x0 //indicates the producer waits until there is room
+	QUEUEDROPOLDEST QueuePolicy = 0x1 //indicates the oldest queued message is dropped to make room
+	QUEUEFAIL       QueuePolicy = 0x2 //indicates the arriving message is dropped
+)
+
+// QueueOptions limits one of the message queues of a session. Blocking the receive
+// queue stops reading from the connection, which applies TCP backpressure to the
+// server; blocking the send queue blocks senders on the channel returned by Run.
+type QueueOptions struct {
+	// Capacity is the number of messages queued at most, unbounded if zero
+	Capacity int
+	Policy   QueuePolicy
+}
+
+// QueueStats describes the state of a message queue
+type QueueStats struct {
+	// Depth is the number of messages queued, MaxDepth the highest Depth seen
+	Depth    int
+	MaxDepth int
+	Capacity int
+	// Enqueued counts all messages that entered the queue
+	Enqueued uint64
+	// Dropped counts messages dropped for newer ones by QUEUEDROPOLDEST, Rejected those
+	// not taken by QUEUEFAIL
+	Dropped  uint64
+	Rejected uint64
+}
+
+// ErrQueueFull is matched by errors.Is for all *QueueFullError
+var ErrQueueFull = errors.New("o3: queue full")
+
+// QueueFullError is passed to ErrorChan for every message dropped from a full queue.
+// Messages dropped from the send queue are kept in the session's Outbox and resent on
+// the next Run.
+type QueueFullError struct {
+	// Queue is "send" or "receive"
+	Queue  string
+	Policy QueuePolicy
+	// Msg is the dropped message, Received the dropped message of the receive queue
+	Msg      Message
+	Received ReceivedMsg
+}
+
+func (e *QueueFullError) Error() string {
+	return fmt.Sprintf("o3: %s queue full, message dropped", e.Queue)
+}
+
+// Is makes errors.Is report a QueueFullError as ErrQueueFull
+func (e *QueueFullError) Is(target error) bool {
+	return target == ErrQueueFull
+}
+
+// queueState holds the limits and statistics shared by the dynamic channels
+type queueState struct {
+	mu    sync.Mutex
+	opts  QueueOptions
+	stats QueueStats
+}
+
+func (qs *queueState) setLimit(opts QueueOptions) {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	qs.opts = opts
+}
+
+func (qs *queueState) limit() QueueOptions {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	return qs.opts
+}
+
+// record updates the statistics after a message arrived at a queue holding depth
+// messages afterwards
+func (qs *queueState) record(depth int, dropped, rejected bool) {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	switch {
+	case rejected:
+		qs.stats.Rejected++
+	case dropped:
+		qs.stats.Dropped++
+		qs.stats.Enqueued++
+	default:
+		qs.stats.Enqueued++
+	}
+	qs.setDepth(depth)
+}
+
+// setDepth has to be called with mu held
+func (qs *queueState) setDepth(depth int) {
+	qs.stats.Depth = depth
+	if depth > qs.stats.MaxDepth {
+		qs.stats.MaxDepth = depth
+	}
+}
+
+func (qs *queueState) dequeued(depth int) {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	qs.setDepth(depth)
+}
+
+func (qs *queueState) snapshot() QueueStats {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	stats := qs.stats
+	stats.Capacity = qs.opts.Capacity
+	return stats
+}
+
+// SendQueueStats returns the state of the queue of messages waiting to be sent
+func (sc *SessionContext) SendQueueStats() QueueStats {
+	return sc.sendMsgChan.snapshot()
+}
+
+// ReceiveQueueStats returns the state of the queue of received messages waiting to be
+// read from the channel returned by Run
+func (sc *SessionContext) ReceiveQueueStats() QueueStats {
+	return sc.receiveMsgChan.snapshot()
+}
+
+// droppedOutgoing handles a message dropped from the full send queue. It stays in the
+// Outbox, if any, and is resent on the next Run.
+func (sc *SessionContext) droppedOutgoing(msg Message, policy QueuePolicy) {
+	sc.reportError(&QueueFullError{Queue: "send", Policy: policy, Msg: msg})
+}
+
+// droppedIncoming handles a message dropped from the full receive queue
+func (sc *SessionContext) droppedIncoming(rmsg ReceivedMsg, policy QueuePolicy) {
+	sc.reportError(&QueueFullError{Queue: "receive", Policy: policy, Received: rmsg})
+}
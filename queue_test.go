@@ -0,0 +1,122 @@
+package o3
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBoundedReceiveQueue(t *testing.T) {
+	for _, policy := range []QueuePolicy{QUEUEDROPOLDEST, QUEUEFAIL} {
+		d := newDynRecvChan()
+		var dropped []error
+		d.setLimit(QueueOptions{Capacity: 2, Policy: policy})
+		d.setDropHook(func(rmsg ReceivedMsg, _ QueuePolicy) { dropped = append(dropped, rmsg.Err) })
+
+		msgs := []error{errors.New("1"), errors.New("2"), errors.New("3")}
+		for _, err := range msgs {
+			d.In <- ReceivedMsg{Err: err}
+		}
+		want := msgs[1]
+		if policy == QUEUEFAIL {
+			want = msgs[0]
+		}
+		if got := (<-d.Out).Err; got != want {
+			t.Errorf("policy %d: first message %v, want %v", policy, got, want)
+		}
+		stats := d.snapshot()
+		if len(dropped) != 1 || stats.MaxDepth != 2 || stats.Capacity != 2 ||
+			stats.Dropped+stats.Rejected != 1 {
+			t.Errorf("policy %d: dropped %v, stats %+v", policy, dropped, stats)
+		}
+	}
+
+	d := newDynRecvChan()
+	d.setLimit(QueueOptions{Capacity: 1, Policy: QUEUEBLOCK})
+	d.In <- ReceivedMsg{}
+	select {
+	case d.In <- ReceivedMsg{}:
+		t.Error("full queue took a message")
+	case <-time.After(50 * time.Millisecond):
+	}
+	<-d.Out
+	d.In <- ReceivedMsg{}
+	<-d.Out
+	if stats := d.snapshot(); stats.Enqueued != 2 || stats.MaxDepth != 1 || stats.Dropped != 0 {
+		t.Errorf("blocking queue stats %+v", stats)
+	}
+}
+
+func TestQueueFullError(t *testing.T) {
+	err := error(&QueueFullError{Queue: "send", Policy: QUEUEFAIL})
+	if !errors.Is(err, ErrQueueFull) {
+		t.Error("QueueFullError does not match ErrQueueFull")
+	}
+}
+
+func TestBoundedSendQueue(t *testing.T) {
+	sc := NewSessionContext(ThreemaID{ID: NewIDString("ECHOECHO")})
+	d := newDynSendChan()
+	var enqueued, dropped []Message
+	d.setLimit(QueueOptions{Capacity: 1, Policy: QUEUEFAIL})
+	d.setHooks(func(msg Message) { enqueued = append(enqueued, msg) },
+		func(msg Message, _ QueuePolicy) { dropped = append(dropped, msg) })
+
+	first, _ := NewTextMessage(&sc, "ABCDEFGH", "first")
+	second, _ := NewTextMessage(&sc, "ABCDEFGH", "second")
+	d.In <- first
+	d.In <- second
+	if got := <-d.Out; got.header().id != first.header().id {
+		t.Error("first message not sent first")
+	}
+	if len(enqueued) != 2 || len(dropped) != 1 || dropped[0].header().id != second.header().id {
+		t.Errorf("enqueued %d, dropped %d messages", len(enqueued), len(dropped))
+	}
+	if stats := d.snapshot(); stats.Enqueued != 1 || stats.Rejected != 1 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func TestOutboxReplayIntoBoundedQueue(t *testing.T) {
+	for _, policy := range []QueuePolicy{QUEUEBLOCK, QUEUEFAIL} {
+		sc := NewSessionContext(ThreemaID{ID: NewIDString("ECHOECHO")})
+		outbox, err := NewFileOutbox(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			msg, _ := NewTextMessage(&sc, "ABCDEFGH", "pending")
+			outbox.Add(newOutboxEntry(msg))
+		}
+		sc.Outbox = outbox
+		sc.SendQueue = QueueOptions{Capacity: 1, Policy: policy}
+
+		// returns although the send loop is not draining the queue yet
+		done := make(chan struct{})
+		go func() {
+			sc.setupQueues()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("policy %d: replay blocks setup", policy)
+		}
+
+		sent := 1
+		if policy == QUEUEBLOCK {
+			sent = 3
+		}
+		for i := 0; i < sent; i++ {
+			select {
+			case <-sc.sendMsgChan.Out:
+			case <-time.After(time.Second):
+				t.Fatalf("policy %d: %d of %d messages replayed", policy, i, sent)
+			}
+		}
+		// nothing was acknowledged, so every message is still to be sent
+		if entries, _ := outbox.List(); len(entries) != 3 {
+			t.Errorf("policy %d: %d outbox entries left, want 3", policy, len(entries))
+		}
+	}
+}
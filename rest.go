@@ -1,23 +1,253 @@
 package o3
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
-
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
-	"github.com/o3ma/o3rest/apiclient_pkg"
-	"github.com/o3ma/o3rest/models_pkg"
 	"golang.org/x/crypto/nacl/box"
 )
 
-// ThreemaRest provides convenient wrappers for task that require the use of Threemas REST API
+// DefaultDirectoryURL is the base URL of the Threema directory API
+const DefaultDirectoryURL = "https://api.threema.ch/"
+
+// maxDirectoryResponse limits the size of directory responses read into memory
+const maxDirectoryResponse = 1 << 20
+
+// defaultHTTPClient is used for all requests if no client is configured
+var defaultHTTPClient = NewHTTPClient(nil, 30*time.Second)
+
+// ErrIdentityNotFound is returned if the directory does not know a requested identity
+var ErrIdentityNotFound = errors.New("o3: identity not found in directory")
+
+// DirectoryError is returned if the directory rejects a request. For rejections
+// within a successful HTTP response StatusCode is 200 and Message holds the
+// directory's reason.
+type DirectoryError struct {
+	Op         string
+	StatusCode int
+	Message    string
+}
+
+func (e *DirectoryError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("o3: directory request %s failed (HTTP %d): %s", e.Op, e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("o3: directory request %s failed (HTTP %d)", e.Op, e.StatusCode)
+}
+
+// Is makes errors.Is report a DirectoryError with status 404 as ErrIdentityNotFound
+func (e *DirectoryError) Is(target error) bool {
+	return target == ErrIdentityNotFound && e.StatusCode == http.StatusNotFound
+}
+
+// Timeouts of the transport of clients returned by NewHTTPClient
+const (
+	httpDialTimeout           = 30 * time.Second
+	httpTLSHandshakeTimeout   = 10 * time.Second
+	httpResponseHeaderTimeout = 30 * time.Second
+)
+
+// NewHTTPClient returns an HTTP client with the given request timeout that trusts
+// the certificates in roots. If roots is nil, the system roots are used. Connecting,
+// the TLS handshake and waiting for the response headers are limited by the transport
+// even if timeout is zero, which leaves limiting whole transfers to the request context.
+func NewHTTPClient(roots *x509.CertPool, timeout time.Duration) *http.Client {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.DialContext = (&net.Dialer{Timeout: httpDialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	tr.TLSHandshakeTimeout = httpTLSHandshakeTimeout
+	tr.ResponseHeaderTimeout = httpResponseHeaderTimeout
+	if roots != nil {
+		tr.TLSClientConfig = &tls.Config{RootCAs: roots}
+	}
+	return &http.Client{Transport: tr, Timeout: timeout}
+}
+
+// ThreemaRest provides convenient wrappers for task that require the use of Threemas REST API.
+// The zero value talks to DefaultDirectoryURL.
 type ThreemaRest struct {
-	client apiclient_pkg.APICLIENT_IMPL
+	// BaseURL is the base URL of the directory API, DefaultDirectoryURL if empty
+	BaseURL string
+	// Client is used for all requests. If nil, a shared client with a 30 second
+	// timeout trusting the system roots is used; see NewHTTPClient for custom roots.
+	Client *http.Client
+	// UserAgent is sent with all requests, "Threema/2.8" if empty
+	UserAgent string
+}
+
+// directoryResult holds the fields every directory answer to a modifying request contains
+type directoryResult struct {
+	Success bool   `json:"success"`
+	Error   string `json:"error"`
+}
+
+// directoryChallenge is the directory's answer to the first stage of an authenticated request
+type directoryChallenge struct {
+	Token           string `json:"token"`
+	TokenRespKeyPub string `json:"tokenRespKeyPub"`
+}
+
+// createIdentityNonce is the nonce Threema uses for the identity creation response
+var createIdentityNonce = [24]byte{0x63, 0x72, 0x65, 0x61, 0x74, 0x65, 0x49, 0x64, 0x65, 0x6e, 0x74, 0x69, 0x74, 0x79, 0x20, 0x72, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x2e}
+
+func (tr ThreemaRest) client() *http.Client {
+	if tr.Client != nil {
+		return tr.Client
+	}
+	return defaultHTTPClient
+}
+
+func (tr ThreemaRest) endpoint(op string) string {
+	base := tr.BaseURL
+	if base == "" {
+		base = DefaultDirectoryURL
+	}
+	return strings.TrimSuffix(base, "/") + "/" + op
+}
+
+// do sends a request to the directory and decodes the JSON answer into result.
+// A nil body results in a GET request.
+func (tr ThreemaRest) do(ctx context.Context, op string, body, result interface{}) error {
+	method := http.MethodGet
+	var reqBody io.Reader
+	if body != nil {
+		method = http.MethodPost
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(buf)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, tr.endpoint(op), reqBody)
+	if err != nil {
+		return err
+	}
+	userAgent := tr.UserAgent
+	if userAgent == "" {
+		userAgent = "Threema/2.8"
+	}
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := tr.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	raw, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxDirectoryResponse))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		dirErr := &DirectoryError{Op: op, StatusCode: resp.StatusCode}
+		var res directoryResult
+		if json.Unmarshal(raw, &res) == nil {
+			dirErr.Message = res.Error
+		}
+		return dirErr
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.Unmarshal(raw, result); err != nil {
+		return fmt.Errorf("o3: invalid answer to directory request %s: %s", op, err)
+	}
+	return nil
+}
+
+// respond decodes a challenge and encrypts its token for the directory using secretKey
+func (ch directoryChallenge) respond(nonce *[24]byte, secretKey *[32]byte) (string, error) {
+	tokenRespKeyPub, err := base64.StdEncoding.DecodeString(ch.TokenRespKeyPub)
+	if err != nil {
+		return "", err
+	}
+	if len(tokenRespKeyPub) != 32 {
+		return "", errors.New("o3: directory sent invalid token response key")
+	}
+	var tokenPubKey [32]byte
+	copy(tokenPubKey[:], tokenRespKeyPub)
+
+	token, err := base64.StdEncoding.DecodeString(ch.Token)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(box.Seal(nil, token, nonce, &tokenPubKey, secretKey)), nil
+}
+
+// authenticatedRequest performs a request on behalf of thid. The directory answers the
+// first stage with a token, which is encrypted with the identity's secret key and sent
+// along with the same parameters in the second stage. The answer to the second stage
+// is decoded into result, which has to embed directoryResult.
+func (tr ThreemaRest) authenticatedRequest(ctx context.Context, op string, thid ThreemaID, params map[string]interface{}, result interface{}) error {
+	params["identity"] = thid.String()
+
+	var challenge directoryChallenge
+	if err := tr.do(ctx, op, params, &challenge); err != nil {
+		return err
+	}
+
+	var nonce [24]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return err
+	}
+	response, err := challenge.respond(&nonce, &thid.LSK)
+	if err != nil {
+		return err
+	}
+
+	params["token"] = challenge.Token
+	params["response"] = response
+	params["nonce"] = base64.StdEncoding.EncodeToString(nonce[:])
+
+	raw := new(json.RawMessage)
+	if err := tr.do(ctx, op, params, raw); err != nil {
+		return err
+	}
+	var res directoryResult
+	if err := json.Unmarshal(*raw, &res); err != nil {
+		return err
+	}
+	if !res.Success {
+		return &DirectoryError{Op: op, StatusCode: http.StatusOK, Message: res.Error}
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(*raw, result)
 }
 
 // CreateIdentity generates a new NaCl Keypair, registers it with the Three servers and returns the assigned ID
 func (tr ThreemaRest) CreateIdentity() (ThreemaID, error) {
+	return tr.CreateIdentityContext(context.Background())
+}
+
+// CreateIdentityContext is CreateIdentity with a context controlling the requests
+func (tr ThreemaRest) CreateIdentityContext(ctx context.Context) (ThreemaID, error) {
+	return tr.CreateIdentityWithFeatures(ctx, DefaultFeatureMask)
+}
+
+// CreateIdentityWithFeatures is CreateIdentityContext announcing the given features
+// instead of DefaultFeatureMask
+func (tr ThreemaRest) CreateIdentityWithFeatures(ctx context.Context, mask FeatureMask) (ThreemaID, error) {
 	// Get Keypair and nonce ready
 	publicKey, privateKey, err := box.GenerateKey(rand.Reader)
 	if err != nil {
@@ -26,121 +256,202 @@ func (tr ThreemaRest) CreateIdentity() (ThreemaID, error) {
 
 	pubkey := base64.StdEncoding.EncodeToString(publicKey[:])
 
-	// The nonce is hardcoded in threema
-	nonce := [24]byte{0x63, 0x72, 0x65, 0x61, 0x74, 0x65, 0x49, 0x64, 0x65, 0x6e, 0x74, 0x69, 0x74, 0x79, 0x20, 0x72, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x2e}
-
 	// Request token and tokenRespKeyPub
-	idCreateParams := models_pkg.CreateRequest{
-		PublicKey: &pubkey}
-
-	challenge, err := tr.client.IdentityCreate(&idCreateParams)
-	if err != nil {
+	var challenge directoryChallenge
+	if err := tr.do(ctx, "identity/create", map[string]interface{}{"publicKey": pubkey}, &challenge); err != nil {
 		return ThreemaID{}, err
 	}
 
-	// Decode token and tokenRespPub
-	tokenRespKeyPub, err := base64.StdEncoding.DecodeString(*challenge.TokenRespKeyPub)
+	// Compute the Response, the nonce is hardcoded in threema
+	tokenResponse, err := challenge.respond(&createIdentityNonce, privateKey)
 	if err != nil {
 		return ThreemaID{}, err
 	}
-	var tokenPubKey [32]byte
-	copy(tokenPubKey[:], tokenRespKeyPub[:32])
 
-	token, err := base64.StdEncoding.DecodeString(*challenge.Token)
-	if err != nil {
-		return ThreemaID{}, err
+	var finalResult struct {
+		directoryResult
+		Identity string `json:"identity"`
 	}
-
-	// Compute the Response
-	tokenResponse := base64.StdEncoding.EncodeToString(box.Seal(nil, []byte(token), &nonce, &tokenPubKey, privateKey))
-
-	response := models_pkg.CreateStage2Request{
-		PublicKey: &pubkey,
-		Response:  &tokenResponse,
-		Token:     challenge.Token}
-
-	finalResult, err := tr.client.IdentityCreateStage2(&response)
+	err = tr.do(ctx, "identity/create", map[string]interface{}{
+		"publicKey": pubkey,
+		"token":     challenge.Token,
+		"response":  tokenResponse,
+	}, &finalResult)
 	if err != nil {
 		return ThreemaID{}, err
 	}
-	if !*finalResult.Success {
-		panic("Server responded with error!")
+	if !finalResult.Success {
+		return ThreemaID{}, &DirectoryError{Op: "identity/create", StatusCode: http.StatusOK, Message: finalResult.Error}
+	}
+	if !validIDString(finalResult.Identity) {
+		return ThreemaID{}, fmt.Errorf("o3: directory assigned invalid ID %q", finalResult.Identity)
 	}
 
 	newID := ThreemaID{
-		ID:   NewIDString(*finalResult.Identity),
-		Nick: NewPubNick(*finalResult.Identity),
+		ID:   NewIDString(finalResult.Identity),
+		Nick: NewPubNick(finalResult.Identity),
 		LSK:  *privateKey}
 
-	if !tr.setFeatureLevel(newID, 4) {
-		return ThreemaID{}, errors.New("failed to set feature level")
+	if err := tr.SetFeatureMaskContext(ctx, newID, mask); err != nil {
+		return ThreemaID{}, err
 	}
 
 	return newID, nil
 
 }
 
-func (tr ThreemaRest) setFeatureLevel(thid ThreemaID, featurelevel int) (succes bool) {
-	featureLevelFloat := float64(featurelevel)
+// GetContactByID returns a ThreemaContact containing the public key as queried from the Threema servers
+func (tr ThreemaRest) GetContactByID(thIDString IDString) (ThreemaContact, error) {
+	return tr.GetContactByIDContext(context.Background(), thIDString)
+}
 
-	// The nonce is hardcoded in threema
-	nonce := [24]byte{0x63, 0x72, 0x65, 0x61, 0x74, 0x65, 0x49, 0x64, 0x65, 0x6e, 0x74, 0x69, 0x74, 0x79, 0x20, 0x72, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x2e}
-	nonceB64 := base64.StdEncoding.EncodeToString(nonce[:])
+// GetContactByIDContext is GetContactByID with a context controlling the request
+func (tr ThreemaRest) GetContactByIDContext(ctx context.Context, thIDString IDString) (ThreemaContact, error) {
+	var response struct {
+		Identity  string `json:"identity"`
+		PublicKey string `json:"publicKey"`
+	}
+	op := "identity/" + url.PathEscape(thIDString.String())
+	if err := tr.do(ctx, op, nil, &response); err != nil {
+		return ThreemaContact{}, err
+	}
+	// never attach a key to an ID the directory did not vouch for
+	if response.Identity != thIDString.String() {
+		return ThreemaContact{}, &DirectoryError{Op: op, StatusCode: http.StatusOK,
+			Message: fmt.Sprintf("answered for %q instead of %s", response.Identity, thIDString)}
+	}
 
-	idString := thid.String()
-	request := models_pkg.SetFeaturelevelRequest{
-		Identity:     &idString,
-		FeatureLevel: &featureLevelFloat}
+	pubKey, err := decodeDirectoryKey(response.PublicKey)
+	if err != nil {
+		return ThreemaContact{}, err
+	}
 
-	challenge, err := tr.client.IdentitySetFeaturelevel(&request)
+	return ThreemaContact{
+		ID:         [8]byte(thIDString),
+		LPK:        pubKey,
+		KeyFetched: time.Now()}, nil
+}
 
-	// Decode token and tokenRespPub
-	tokenRespKeyPub, err := base64.StdEncoding.DecodeString(*challenge.TokenRespKeyPub)
-	if err != nil {
-		return false
+// bulkIdentity is a single entry of the directory's answer to identity/fetch_bulk
+type bulkIdentity struct {
+	Identity    string        `json:"identity"`
+	PublicKey   string        `json:"publicKey"`
+	FeatureMask FeatureMask   `json:"featureMask"`
+	State       IdentityState `json:"state"`
+}
+
+// GetContactsByID fetches the public keys of many IDs with a single request. IDs
+// unknown to the directory are missing from the result; the order of the result
+// is unspecified.
+func (tr ThreemaRest) GetContactsByID(ids []IDString) ([]ThreemaContact, error) {
+	return tr.GetContactsByIDContext(context.Background(), ids)
+}
+
+// GetContactsByIDContext is GetContactsByID with a context controlling the request
+func (tr ThreemaRest) GetContactsByIDContext(ctx context.Context, ids []IDString) ([]ThreemaContact, error) {
+	var response struct {
+		Identities []bulkIdentity `json:"identities"`
+	}
+	if err := tr.do(ctx, "identity/fetch_bulk", map[string]interface{}{"identities": idStrings(ids)}, &response); err != nil {
+		return nil, err
 	}
-	var tokenPubKey [32]byte
-	copy(tokenPubKey[:], tokenRespKeyPub[:32])
 
-	token, err := base64.StdEncoding.DecodeString(*challenge.Token)
-	if err != nil {
-		return false
+	now := time.Now()
+	contacts := make([]ThreemaContact, 0, len(response.Identities))
+	for _, ident := range response.Identities {
+		if !validIDString(ident.Identity) {
+			return nil, fmt.Errorf("o3: directory sent invalid ID %q", ident.Identity)
+		}
+		pubKey, err := decodeDirectoryKey(ident.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		contacts = append(contacts, ThreemaContact{
+			ID:         NewIDString(ident.Identity),
+			LPK:        pubKey,
+			Features:   ident.FeatureMask,
+			KeyFetched: now})
 	}
+	return contacts, nil
+}
+
+// identityCheckBatch is the number of IDs checked with a single request
+const identityCheckBatch = 500
+
+// CheckIdentities queries the state and feature mask of many IDs, batching them into
+// few requests. The result contains one IdentityStatus per ID in the order of ids; IDs
+// the directory did not report on are IDENTITYUNKNOWN.
+func (tr ThreemaRest) CheckIdentities(ids []IDString) ([]IdentityStatus, error) {
+	return tr.CheckIdentitiesContext(context.Background(), ids)
+}
 
-	// Compute the Response
-	tokenResponse := base64.StdEncoding.EncodeToString(box.Seal(nil, []byte(token), &nonce, &tokenPubKey, &thid.LSK))
+// CheckIdentitiesContext is CheckIdentities with a context controlling the requests
+func (tr ThreemaRest) CheckIdentitiesContext(ctx context.Context, ids []IDString) ([]IdentityStatus, error) {
+	statuses := make([]IdentityStatus, 0, len(ids))
+	for start := 0; start < len(ids); start += identityCheckBatch {
+		end := start + identityCheckBatch
+		if end > len(ids) {
+			end = len(ids)
+		}
+		batch, err := tr.checkIdentityBatch(ctx, ids[start:end])
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, batch...)
+	}
+	return statuses, nil
+}
 
-	response := models_pkg.SetFeaturelevelStage2Request{
-		Response:     &tokenResponse,
-		Identity:     &idString,
-		Nonce:        &nonceB64,
-		Token:        challenge.Token,
-		FeatureLevel: &featureLevelFloat,
+func (tr ThreemaRest) checkIdentityBatch(ctx context.Context, ids []IDString) ([]IdentityStatus, error) {
+	var response struct {
+		Identities   []string        `json:"identities"`
+		States       []IdentityState `json:"states"`
+		FeatureMasks []FeatureMask   `json:"featureMasks"`
+	}
+	if err := tr.do(ctx, "identity/check", map[string]interface{}{"identities": idStrings(ids)}, &response); err != nil {
+		return nil, err
+	}
+	if len(response.States) != len(response.Identities) || len(response.FeatureMasks) != len(response.Identities) {
+		return nil, errors.New("o3: directory sent inconsistent identity check answer")
 	}
 
-	result, err := tr.client.IdentitySetFeaturelevelStage2(&response)
-	if err != nil {
-		return false
+	reported := make(map[IDString]IdentityStatus, len(response.Identities))
+	for i, id := range response.Identities {
+		reported[NewIDString(id)] = IdentityStatus{
+			ID:       NewIDString(id),
+			State:    response.States[i],
+			Features: response.FeatureMasks[i]}
 	}
 
-	return *result.Success
+	statuses := make([]IdentityStatus, len(ids))
+	for i, id := range ids {
+		status, ok := reported[id]
+		if !ok {
+			status = IdentityStatus{ID: id, State: IDENTITYUNKNOWN}
+		}
+		statuses[i] = status
+	}
+	return statuses, nil
 }
 
-// GetContactByID returns a ThreemaContact containing the public key as queried from the Threema servers
-func (tr ThreemaRest) GetContactByID(thIDString IDString) (ThreemaContact, error) {
-	response, err := tr.client.IdentityById(thIDString.String())
-	if err != nil {
-		return ThreemaContact{}, err
+func idStrings(ids []IDString) []string {
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = id.String()
 	}
+	return strs
+}
 
-	pubKeyDecoded, err := base64.StdEncoding.DecodeString(*response.PublicKey)
+// decodeDirectoryKey decodes a base64 encoded public key sent by the directory
+func decodeDirectoryKey(s string) ([32]byte, error) {
+	var key [32]byte
+	raw, err := base64.StdEncoding.DecodeString(s)
 	if err != nil {
-		return ThreemaContact{}, err
+		return key, err
 	}
-	var pubKey [32]byte
-	copy(pubKey[:], (pubKeyDecoded[:32]))
-
-	return ThreemaContact{
-		ID:  [8]byte(thIDString),
-		LPK: pubKey}, nil
+	if len(raw) != 32 {
+		return key, fmt.Errorf("o3: directory sent public key of invalid length %d", len(raw))
+	}
+	copy(key[:], raw)
+	return key, nil
 }
@@ -0,0 +1,259 @@
+package o3
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/o3ma/o3/o3test"
+)
+
+func TestCreateIdentityWithFakeDirectory(t *testing.T) {
+	fd := o3test.NewFakeDirectory()
+	defer fd.Close()
+	tr := fakeRest(fd)
+
+	thid, err := tr.CreateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !validIDString(thid.String()) {
+		t.Errorf("invalid ID assigned: %q", thid)
+	}
+	if mask := FeatureMask(fd.FeatureMask(thid.ID.String())); mask != DefaultFeatureMask {
+		t.Errorf("feature mask not set, got %s", mask)
+	}
+
+	contact, err := tr.GetContactByID(thid.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contact.LPK != *thid.GetPubKey() {
+		t.Error("directory returned wrong public key for new identity")
+	}
+
+	// Requests signed with the wrong key are rejected
+	impostor := thid
+	impostor.LSK[0] ^= 0xff
+	err = tr.SetFeatureMask(impostor, FEATUREGROUPS)
+	var dirErr *DirectoryError
+	if !errors.As(err, &dirErr) || FeatureMask(fd.FeatureMask(thid.ID.String())) != DefaultFeatureMask {
+		t.Errorf("expected DirectoryError for impostor, got %v", err)
+	}
+}
+
+func TestGetContactByIDNotFound(t *testing.T) {
+	fd := o3test.NewFakeDirectory()
+	defer fd.Close()
+
+	_, err := fakeRest(fd).GetContactByID(NewIDString("NOBODY00"))
+	if !errors.Is(err, ErrIdentityNotFound) {
+		t.Errorf("expected ErrIdentityNotFound, got %v", err)
+	}
+}
+
+func TestGetContactByIDWrongIdentity(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"identity":  "IMPOSTOR",
+			"publicKey": base64.StdEncoding.EncodeToString(make([]byte, 32))})
+	}))
+	defer srv.Close()
+
+	_, err := ThreemaRest{BaseURL: srv.URL}.GetContactByID(NewIDString("FRIEND01"))
+	var dirErr *DirectoryError
+	if !errors.As(err, &dirErr) {
+		t.Errorf("expected DirectoryError for answer about another ID, got %v", err)
+	}
+}
+
+func TestKeyChangeDetection(t *testing.T) {
+	fd := o3test.NewFakeDirectory()
+	defer fd.Close()
+
+	sc := NewSessionContext(ThreemaID{ID: NewIDString("ECHOECHO")})
+	sc.Directory = fakeRest(fd)
+	sc.StrictKeys = true
+
+	friend := NewIDString("FRIEND01")
+	addFakeContact(fd, testContact("FRIEND01", 0x01))
+	if err := sc.CheckContactKey(friend); err != nil {
+		t.Fatal(err)
+	}
+
+	addFakeContact(fd, testContact("FRIEND01", 0x02))
+	var mismatch *KeyMismatchError
+	if err := sc.CheckContactKey(friend); !errors.As(err, &mismatch) || !mismatch.Refused {
+		t.Fatalf("expected refused key mismatch, got %v", err)
+	}
+	if _, err := sc.lookupContact(friend); !errors.As(err, &mismatch) {
+		t.Errorf("strict session did not refuse changed contact: %v", err)
+	}
+
+	if err := sc.AcceptKeyChange(friend); err != nil {
+		t.Fatal(err)
+	}
+	contact, err := sc.lookupContact(friend)
+	if err != nil || contact.LPK != testContact("FRIEND01", 0x02).LPK {
+		t.Errorf("accepted key not used: %v", err)
+	}
+}
+
+func TestBulkLookupAndPruneRevoked(t *testing.T) {
+	fd := o3test.NewFakeDirectory()
+	defer fd.Close()
+
+	active := testContact("ACTIVE01", 0x01)
+	active.Features = 0x0f
+	addFakeContact(fd, active)
+	addFakeContact(fd, testContact("REVOKED1", 0x02))
+	fd.SetState("REVOKED1", uint8(IDENTITYINVALID))
+
+	tr := fakeRest(fd)
+	contacts, err := tr.GetContactsByID([]IDString{NewIDString("ACTIVE01"), NewIDString("REVOKED1"), NewIDString("UNKNOWN1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contacts) != 1 || contacts[0].LPK != active.LPK || contacts[0].Features != 0x0f {
+		t.Fatalf("unexpected bulk result: %#v", contacts)
+	}
+
+	sc := NewSessionContext(ThreemaID{ID: NewIDString("ECHOECHO")})
+	sc.Directory = tr
+	sc.ID.Contacts.Add(testContact("ACTIVE01", 0x01))
+	sc.ID.Contacts.Add(testContact("REVOKED1", 0x02))
+	groupID := [8]byte{1}
+	sc.ID.Groups = map[IDString]map[[8]byte]Group{
+		sc.ID.ID: {groupID: {
+			CreatorID: sc.ID.ID,
+			GroupID:   groupID,
+			Members:   []IDString{sc.ID.ID, NewIDString("ACTIVE01"), NewIDString("REVOKED1"), NewIDString("UNKNOWN1")}}}}
+
+	removed, err := sc.PruneRevoked(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 2 {
+		t.Errorf("expected REVOKED1 and UNKNOWN1 to be removed, got %v", removed)
+	}
+	if _, ok := sc.ID.Contacts.Get("REVOKED1"); ok {
+		t.Error("revoked contact still in address book")
+	}
+	if c, _ := sc.ID.Contacts.Get("ACTIVE01"); c.Features != 0x0f {
+		t.Errorf("feature mask not updated: %#x", c.Features)
+	}
+	members := sc.ID.Groups[sc.ID.ID][groupID].Members
+	if len(members) != 2 || members[0] != sc.ID.ID || members[1] != NewIDString("ACTIVE01") {
+		t.Errorf("unexpected members after pruning: %v", members)
+	}
+}
+
+func TestLinkAndRevokeIdentity(t *testing.T) {
+	fd := o3test.NewFakeDirectory()
+	defer fd.Close()
+	tr := fakeRest(fd)
+
+	thid, err := tr.CreateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.LinkEmail(thid, "Bot@Example.com"); err != nil {
+		t.Fatal(err)
+	}
+	verificationID, err := tr.LinkPhoneNumber(thid, "+41 79 123 45 67")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.VerifyPhoneNumber(verificationID, "wrong"); err == nil {
+		t.Error("wrong verification code accepted")
+	}
+	verificationID, _ = tr.LinkPhoneNumber(thid, "+41 79 123 45 67")
+	if err := tr.VerifyPhoneNumber(verificationID, fd.VerificationCode(verificationID)); err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := tr.GetLinkStatus(thid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != (LinkStatus{Email: "bot@example.com", Phone: "+41791234567"}) {
+		t.Errorf("unexpected link status %#v", status)
+	}
+
+	if err := tr.SetRevocationPassword(thid, "decommission"); err != nil {
+		t.Fatal(err)
+	}
+	if !fd.RevocationPasswordMatches(thid.ID.String(), "decommission") {
+		t.Error("revocation password not stored")
+	}
+
+	if err := tr.RevokeIdentity(thid); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tr.GetContactByID(thid.ID); !errors.Is(err, ErrIdentityNotFound) {
+		t.Errorf("revoked identity still published: %v", err)
+	}
+	if err := tr.LinkEmail(thid, "bot@example.com"); err == nil {
+		t.Error("revoked identity could still be modified")
+	}
+}
+
+func TestPartialIdentityCheck(t *testing.T) {
+	// a directory answering each request for all but the last ID
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		var params struct {
+			Identities []string `json:"identities"`
+		}
+		json.NewDecoder(r.Body).Decode(&params)
+		ids := params.Identities[:len(params.Identities)-1]
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"identities":   ids,
+			"states":       make([]IdentityState, len(ids)),
+			"featureMasks": make([]FeatureMask, len(ids))})
+	}))
+	defer srv.Close()
+
+	ids := make([]IDString, identityCheckBatch+1)
+	for i := range ids {
+		ids[i] = NewIDString(fmt.Sprintf("ID%06d", i))
+	}
+	statuses, err := ThreemaRest{BaseURL: srv.URL}.CheckIdentities(ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests != 2 || len(statuses) != len(ids) {
+		t.Fatalf("%d statuses from %d requests", len(statuses), requests)
+	}
+	if statuses[0].State != IDENTITYACTIVE || statuses[identityCheckBatch-1].State != IDENTITYUNKNOWN ||
+		statuses[identityCheckBatch].State != IDENTITYUNKNOWN {
+		t.Errorf("missing IDs not reported as unknown")
+	}
+
+	sc := NewSessionContext(ThreemaID{ID: NewIDString("ECHOECHO")})
+	sc.Directory = ThreemaRest{BaseURL: srv.URL}
+	sc.ID.Contacts.Add(testContact("FRIEND01", 0x01))
+	removed, err := sc.PruneRevoked(context.Background())
+	if err != nil || len(removed) != 0 {
+		t.Errorf("unreported contact pruned: %v, %v", removed, err)
+	}
+	if _, ok := sc.ID.Contacts.Get("FRIEND01"); !ok {
+		t.Error("unreported contact deleted")
+	}
+}
+
+// fakeRest returns a ThreemaRest talking to fd
+func fakeRest(fd *o3test.FakeDirectory) ThreemaRest {
+	return ThreemaRest{BaseURL: fd.URL, Client: fd.Client()}
+}
+
+// addFakeContact registers c with fd
+func addFakeContact(fd *o3test.FakeDirectory, c ThreemaContact) {
+	fd.AddIdentity(c.String(), c.LPK, uint64(c.Features))
+}
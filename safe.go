@@ -0,0 +1,389 @@
+package o3
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// maxSafeBackup limits the size of Threema Safe backups read into memory
+const maxSafeBackup = 1 << 20
+
+// ErrSafeBackupNotFound is returned if the Safe server holds no backup for an identity and password
+var ErrSafeBackupNotFound = errors.New("o3: no Threema Safe backup found")
+
+// ErrSafeDecryption is returned if a Threema Safe backup cannot be decrypted, usually
+// because the password is wrong
+var ErrSafeDecryption = errors.New("o3: Threema Safe backup could not be decrypted")
+
+// SafeServer is a Threema Safe server backups are uploaded to and downloaded from
+type SafeServer struct {
+	// URL is the base URL of the server. If empty, Threema's default server for the
+	// backup is used.
+	URL string
+	// Username and Password are sent using HTTP basic authentication if Username is set
+	Username string
+	Password string
+	// Client is used for all requests, see ThreemaRest.Client
+	Client *http.Client
+	// UserAgent is sent with all requests, "Threema/2.8" if empty
+	UserAgent string
+}
+
+// safeBackup is the JSON document stored in a Threema Safe backup
+type safeBackup struct {
+	Info     safeInfo       `json:"info"`
+	User     safeUser       `json:"user"`
+	Contacts []safeContact  `json:"contacts"`
+	Groups   []safeGroup    `json:"groups"`
+	Settings safeSettings   `json:"settings"`
+	Lists    []safeDistList `json:"distributionlists"`
+}
+
+type safeInfo struct {
+	Version int    `json:"version"`
+	Device  string `json:"device,omitempty"`
+}
+
+type safeUser struct {
+	PrivateKey string `json:"privatekey"`
+	Nickname   string `json:"nickname,omitempty"`
+}
+
+type safeContact struct {
+	Identity     string            `json:"identity"`
+	PublicKey    string            `json:"publickey"`
+	Verification VerificationLevel `json:"verification"`
+	FirstName    string            `json:"firstname,omitempty"`
+	LastName     string            `json:"lastname,omitempty"`
+	Nickname     string            `json:"nickname,omitempty"`
+}
+
+type safeGroup struct {
+	ID        string   `json:"id"`
+	Creator   string   `json:"creator"`
+	GroupName string   `json:"groupname"`
+	Members   []string `json:"members"`
+	Deleted   bool     `json:"deleted"`
+}
+
+type safeSettings struct {
+	BlockedContacts []string `json:"blockedContacts"`
+}
+
+// safeDistList is a distribution list. o3 has none but keeps the field for compatibility.
+type safeDistList struct {
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
+}
+
+// deriveSafeKeys derives the backup ID and encryption key of a Threema Safe backup
+// from the password, using the identity as salt
+func deriveSafeKeys(id IDString, password string) (backupID, key [32]byte, err error) {
+	if password == "" {
+		return backupID, key, errors.New("o3: empty Threema Safe password")
+	}
+	safeKey, err := scrypt.Key([]byte(password), []byte(id.String()), 65536, 8, 1, 64)
+	if err != nil {
+		return backupID, key, err
+	}
+	copy(backupID[:], safeKey[:32])
+	copy(key[:], safeKey[32:])
+	return backupID, key, nil
+}
+
+// SafeBackupID returns the hex encoded ID the backup of id is stored under
+func SafeBackupID(id IDString, password string) (string, error) {
+	backupID, _, err := deriveSafeKeys(id, password)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(backupID[:]), nil
+}
+
+// EncryptSafeBackup builds the Threema Safe backup of thid, containing its secret key,
+// nickname, contacts and groups, and encrypts it with a key derived from password
+func EncryptSafeBackup(thid ThreemaID, password string) ([]byte, error) {
+	_, key, err := deriveSafeKeys(thid.ID, password)
+	if err != nil {
+		return nil, err
+	}
+
+	var plain bytes.Buffer
+	zw := gzip.NewWriter(&plain)
+	if err := json.NewEncoder(zw).Encode(newSafeBackup(thid)); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	var nonce [24]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, err
+	}
+	return secretbox.Seal(nonce[:], plain.Bytes(), &nonce, &key), nil
+}
+
+// DecryptSafeBackup decrypts a Threema Safe backup of id and returns the identity it
+// contains. Contacts and groups are restored to the ThreemaID's Contacts and Groups.
+func DecryptSafeBackup(data []byte, id IDString, password string) (ThreemaID, error) {
+	_, key, err := deriveSafeKeys(id, password)
+	if err != nil {
+		return ThreemaID{}, err
+	}
+	if len(data) < 24+secretbox.Overhead {
+		return ThreemaID{}, ErrSafeDecryption
+	}
+	var nonce [24]byte
+	copy(nonce[:], data[:24])
+	plain, ok := secretbox.Open(nil, data[24:], &nonce, &key)
+	if !ok {
+		return ThreemaID{}, ErrSafeDecryption
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(plain))
+	if err != nil {
+		return ThreemaID{}, fmt.Errorf("o3: invalid Threema Safe backup: %w", err)
+	}
+	var backup safeBackup
+	if err := json.NewDecoder(io.LimitReader(zr, 16*maxSafeBackup)).Decode(&backup); err != nil {
+		return ThreemaID{}, fmt.Errorf("o3: invalid Threema Safe backup: %w", err)
+	}
+	return backup.restore(id)
+}
+
+func newSafeBackup(thid ThreemaID) safeBackup {
+	backup := safeBackup{
+		Info: safeInfo{Version: 1, Device: "o3"},
+		User: safeUser{
+			PrivateKey: base64.StdEncoding.EncodeToString(thid.LSK[:]),
+			Nickname:   thid.Nick.Trimmed()},
+		Contacts: []safeContact{},
+		Groups:   []safeGroup{},
+		Settings: safeSettings{BlockedContacts: []string{}},
+		Lists:    []safeDistList{},
+	}
+	if backup.User.Nickname == thid.ID.String() {
+		backup.User.Nickname = ""
+	}
+
+	for _, contact := range thid.Contacts.List() {
+		if contact.Blocked {
+			backup.Settings.BlockedContacts = append(backup.Settings.BlockedContacts, contact.String())
+		}
+		if !contact.hasKey() {
+			continue
+		}
+		entry := safeContact{
+			Identity:     contact.String(),
+			PublicKey:    base64.StdEncoding.EncodeToString(contact.LPK[:]),
+			Verification: contact.Verification,
+			FirstName:    contact.FirstName,
+			LastName:     contact.LastName,
+			Nickname:     contact.Nickname}
+		// Threema Safe has no separate local name
+		if entry.FirstName == "" && entry.LastName == "" {
+			entry.FirstName = contact.Name
+		}
+		backup.Contacts = append(backup.Contacts, entry)
+	}
+
+	for creator, groups := range thid.Groups {
+		for groupID, group := range groups {
+			sg := safeGroup{
+				ID:        hex.EncodeToString(groupID[:]),
+				Creator:   creator.String(),
+				GroupName: group.Name,
+				Members:   make([]string, len(group.Members))}
+			for i, member := range group.Members {
+				sg.Members[i] = member.String()
+			}
+			backup.Groups = append(backup.Groups, sg)
+		}
+	}
+	sort.Slice(backup.Groups, func(i, j int) bool {
+		if backup.Groups[i].Creator != backup.Groups[j].Creator {
+			return backup.Groups[i].Creator < backup.Groups[j].Creator
+		}
+		return backup.Groups[i].ID < backup.Groups[j].ID
+	})
+	return backup
+}
+
+// restore converts the backup to a ThreemaID for id
+func (backup safeBackup) restore(id IDString) (ThreemaID, error) {
+	if backup.Info.Version != 1 {
+		return ThreemaID{}, fmt.Errorf("o3: unsupported Threema Safe backup version %d", backup.Info.Version)
+	}
+	lsk, err := base64.StdEncoding.DecodeString(backup.User.PrivateKey)
+	if err != nil || len(lsk) != 32 {
+		return ThreemaID{}, errors.New("o3: invalid private key in Threema Safe backup")
+	}
+
+	var key [32]byte
+	copy(key[:], lsk)
+	thid, err := NewThreemaID(id.String(), key, NewAddressBook())
+	if err != nil {
+		return ThreemaID{}, err
+	}
+	thid.Nick = NewPubNick(id.String())
+	if backup.User.Nickname != "" {
+		thid.Nick = NewPubNick(backup.User.Nickname)
+	}
+
+	for _, entry := range backup.Contacts {
+		if !validIDString(entry.Identity) {
+			return ThreemaID{}, fmt.Errorf("o3: invalid contact ID %q in Threema Safe backup", entry.Identity)
+		}
+		pk, err := decodeDirectoryKey(entry.PublicKey)
+		if err != nil {
+			return ThreemaID{}, fmt.Errorf("o3: invalid public key of %s in Threema Safe backup: %w", entry.Identity, err)
+		}
+		thid.Contacts.Add(ThreemaContact{
+			ID:           NewIDString(entry.Identity),
+			LPK:          pk,
+			Verification: entry.Verification,
+			FirstName:    entry.FirstName,
+			LastName:     entry.LastName,
+			Nickname:     entry.Nickname})
+	}
+	for _, blocked := range backup.Settings.BlockedContacts {
+		if !validIDString(blocked) {
+			continue
+		}
+		contact, _ := thid.Contacts.Get(blocked)
+		contact.ID = NewIDString(blocked)
+		contact.Blocked = true
+		thid.Contacts.Add(contact)
+	}
+
+	for _, sg := range backup.Groups {
+		rawID, err := hex.DecodeString(sg.ID)
+		if err != nil || len(rawID) != 8 || !validIDString(sg.Creator) {
+			return ThreemaID{}, fmt.Errorf("o3: invalid group %q in Threema Safe backup", sg.ID)
+		}
+		if sg.Deleted {
+			continue
+		}
+		group := Group{
+			CreatorID: NewIDString(sg.Creator),
+			Name:      sg.GroupName,
+			Members:   make([]IDString, len(sg.Members))}
+		copy(group.GroupID[:], rawID)
+		for i, member := range sg.Members {
+			group.Members[i] = NewIDString(member)
+		}
+		if thid.Groups[group.CreatorID] == nil {
+			thid.Groups[group.CreatorID] = make(map[[8]byte]Group)
+		}
+		thid.Groups[group.CreatorID][group.GroupID] = group
+	}
+	return thid, nil
+}
+
+func (ss SafeServer) client() *http.Client {
+	if ss.Client != nil {
+		return ss.Client
+	}
+	return defaultHTTPClient
+}
+
+// backupURL returns the URL of the backup with the given ID
+func (ss SafeServer) backupURL(backupID [32]byte) string {
+	base := ss.URL
+	if base == "" {
+		base = fmt.Sprintf("https://safe-%02x.threema.ch/", backupID[0])
+	}
+	return strings.TrimSuffix(base, "/") + "/backups/" + hex.EncodeToString(backupID[:])
+}
+
+func (ss SafeServer) do(ctx context.Context, method string, backupID [32]byte, body []byte) (*http.Response, error) {
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, ss.backupURL(backupID), reqBody)
+	if err != nil {
+		return nil, err
+	}
+	userAgent := ss.UserAgent
+	if userAgent == "" {
+		userAgent = "Threema/2.8"
+	}
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Accept", "application/octet-stream")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	if ss.Username != "" {
+		req.SetBasicAuth(ss.Username, ss.Password)
+	}
+	return ss.client().Do(req)
+}
+
+// Upload encrypts the Threema Safe backup of thid with password and stores it on the server
+func (ss SafeServer) Upload(ctx context.Context, thid ThreemaID, password string) error {
+	backupID, _, err := deriveSafeKeys(thid.ID, password)
+	if err != nil {
+		return err
+	}
+	data, err := EncryptSafeBackup(thid, password)
+	if err != nil {
+		return err
+	}
+
+	resp, err := ss.do(ctx, http.MethodPut, backupID, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("o3: Threema Safe upload failed (HTTP %d)", resp.StatusCode)
+	}
+	return nil
+}
+
+// Download fetches the Threema Safe backup of id from the server and decrypts it with password
+func (ss SafeServer) Download(ctx context.Context, id IDString, password string) (ThreemaID, error) {
+	backupID, _, err := deriveSafeKeys(id, password)
+	if err != nil {
+		return ThreemaID{}, err
+	}
+
+	resp, err := ss.do(ctx, http.MethodGet, backupID, nil)
+	if err != nil {
+		return ThreemaID{}, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return ThreemaID{}, ErrSafeBackupNotFound
+	default:
+		return ThreemaID{}, fmt.Errorf("o3: Threema Safe download failed (HTTP %d)", resp.StatusCode)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSafeBackup+1))
+	if err != nil {
+		return ThreemaID{}, err
+	}
+	if len(data) > maxSafeBackup {
+		return ThreemaID{}, errors.New("o3: Threema Safe backup too large")
+	}
+	return DecryptSafeBackup(data, id, password)
+}
@@ -0,0 +1,71 @@
+package o3
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/o3ma/o3/o3test"
+)
+
+func TestSafeBackupRoundTrip(t *testing.T) {
+	fs := o3test.NewFakeSafeServer()
+	defer fs.Close()
+	safe := SafeServer{URL: fs.URL, Client: fs.Client()}
+
+	var lsk [32]byte
+	lsk[0] = 0x42
+	thid, err := NewThreemaID("ECHOECHO", lsk, NewAddressBook())
+	if err != nil {
+		t.Fatal(err)
+	}
+	thid.Nick = NewPubNick("Echo Bot")
+	friend := testContact("FRIEND01", 0x01)
+	friend.Name = ""
+	friend.FirstName, friend.LastName = "Jane", "Doe"
+	friend.Verification = FULLYVERIFIED
+	thid.Contacts.Add(friend)
+	thid.Contacts.Add(ThreemaContact{ID: NewIDString("SPAMMER1"), Blocked: true})
+	groupID := [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	thid.Groups[thid.ID] = map[[8]byte]Group{groupID: {
+		CreatorID: thid.ID,
+		GroupID:   groupID,
+		Name:      "Ops",
+		Members:   []IDString{thid.ID, NewIDString("FRIEND01")}}}
+
+	ctx := context.Background()
+	if err := safe.Upload(ctx, thid, "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	backupID, _ := SafeBackupID(thid.ID, "correct horse")
+	if _, ok := fs.Backup(backupID); !ok {
+		t.Fatal("backup not stored under its backup ID")
+	}
+
+	if _, err := safe.Download(ctx, thid.ID, "wrong horse"); !errors.Is(err, ErrSafeBackupNotFound) {
+		t.Errorf("expected ErrSafeBackupNotFound for wrong password, got %v", err)
+	}
+
+	restored, err := safe.Download(ctx, thid.ID, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.ID != thid.ID || restored.LSK != thid.LSK || restored.Nick.Trimmed() != "Echo Bot" {
+		t.Errorf("identity not restored: %s %q", restored.ID, restored.Nick.Trimmed())
+	}
+	if c, _ := restored.Contacts.Get("FRIEND01"); c != friend {
+		t.Errorf("contact not restored: %#v", c)
+	}
+	if c, ok := restored.Contacts.Get("SPAMMER1"); !ok || !c.Blocked {
+		t.Error("blocked contact not restored")
+	}
+	if g := restored.Groups[thid.ID][groupID]; g.Name != "Ops" || len(g.Members) != 2 {
+		t.Errorf("group not restored: %#v", g)
+	}
+
+	data, _ := EncryptSafeBackup(thid, "correct horse")
+	data[len(data)-1] ^= 0xff
+	if _, err := DecryptSafeBackup(data, thid.ID, "correct horse"); !errors.Is(err, ErrSafeDecryption) {
+		t.Errorf("expected ErrSafeDecryption for tampered backup, got %v", err)
+	}
+}
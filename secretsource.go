@@ -0,0 +1,67 @@
+package o3
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/howeyc/gopass"
+)
+
+// SecretSource provides the password used to unlock an identity. Any function with this
+// signature can be used as a callback source. The returned slice is overwritten once it
+// has been used.
+type SecretSource func() ([]byte, error)
+
+// StaticSecret returns a SecretSource providing a copy of password
+func StaticSecret(password []byte) SecretSource {
+	return func() ([]byte, error) {
+		return append([]byte(nil), password...), nil
+	}
+}
+
+// TTYSecret returns a SecretSource reading the password from the terminal without
+// echoing it. The prompt is written to stderr.
+func TTYSecret(prompt string) SecretSource {
+	return func() ([]byte, error) {
+		fmt.Fprint(os.Stderr, prompt)
+		return gopass.GetPasswd()
+	}
+}
+
+// EnvSecret returns a SecretSource reading the password from the environment variable name.
+// An unset or empty variable is an error.
+func EnvSecret(name string) SecretSource {
+	return func() ([]byte, error) {
+		value, ok := os.LookupEnv(name)
+		if !ok || value == "" {
+			return nil, fmt.Errorf("o3: environment variable %s holding the identity password is not set", name)
+		}
+		return []byte(value), nil
+	}
+}
+
+// FileSecret returns a SecretSource reading the password from a file, e.g. a secret
+// mounted into a container. A single trailing line break is removed.
+func FileSecret(filename string) SecretSource {
+	return func() ([]byte, error) {
+		content, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		password := bytes.TrimSuffix(content, []byte("\n"))
+		password = bytes.TrimSuffix(password, []byte("\r"))
+		if len(password) == 0 {
+			return nil, fmt.Errorf("o3: password file %s is empty", filename)
+		}
+		return password, nil
+	}
+}
+
+// wipe overwrites a secret that is no longer needed
+func wipe(secret []byte) {
+	for i := range secret {
+		secret[i] = 0
+	}
+}
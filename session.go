@@ -3,6 +3,8 @@ package o3
 import (
 	"crypto/rand"
 	"net"
+	"sync"
+	"time"
 
 	"golang.org/x/crypto/nacl/box"
 )
@@ -12,6 +14,50 @@ import (
 // the server
 type SessionContext struct {
 	ID ThreemaID
+	// Contacts is the store used to look up and record the public keys of peers.
+	// If it is nil, ID.Contacts is used.
+	Contacts ContactStore
+	// StrictKeys controls how a changed public key of a known contact is handled. Keys
+	// are pinned on first use; if the directory later reports a different key, a
+	// *KeyMismatchError is passed to ErrorChan. By default the new key replaces the pinned
+	// one of UNVERIFIED contacts. In strict mode, and always for contacts verified at a
+	// higher level, the pinned key is kept and the session refuses to encrypt to or accept
+	// messages from the contact until AcceptKeyChange is called.
+	StrictKeys bool
+	// KeyRecheckInterval is how often the key of a contact is fetched again at most when
+	// a message of the contact cannot be decrypted, DefaultKeyRecheckInterval if zero
+	KeyRecheckInterval time.Duration
+	keyChecks          *keyCheckLimiter
+	// Inbound screens the senders of incoming messages
+	Inbound InboundFilter
+	// Directory is used to fetch the public keys of unknown contacts
+	Directory ThreemaRest
+	// Blobs stores the blobs of media messages. If nil, Threema's blob servers are used.
+	Blobs BlobStore
+	// MediaCache keeps downloaded media. NewSessionContext sets up a MemoryMediaCache of
+	// DefaultMediaCacheSize; if nil, media is downloaded on every access.
+	MediaCache MediaCache
+	// Media inspects the media of received messages before it is handed out
+	Media MediaInspection
+	// ManualAck defers the acknowledgement of received messages to the server until
+	// ReceivedMsg.Ack is called. Messages not acknowledged when the connection ends are
+	// delivered again on the next Run. By default messages are acknowledged on receipt.
+	ManualAck bool
+	// SendQueue and ReceiveQueue limit the messages waiting to be sent and to be read
+	// from the channel returned by Run. They are unbounded by default. Messages dropped
+	// from a full queue are reported as *QueueFullError on ErrorChan.
+	SendQueue    QueueOptions
+	ReceiveQueue QueueOptions
+	// Outbox keeps outgoing messages until the server acknowledges them and resends
+	// them on the next Run. If nil, messages not yet sent are lost with the process.
+	Outbox Outbox
+	// ImageOptions enables the preprocessing of sent images, see ImageOptions. If nil,
+	// images are sent as they are.
+	ImageOptions *ImageOptions
+	// FeatureMaskTTL is how long the feature mask of a contact is cached before it is
+	// fetched from Directory again, DefaultFeatureMaskTTL if zero
+	FeatureMaskTTL time.Duration
+	features       *featureCache
 	//TODO it might make more sense in a lot of places to use pointers here
 	clientSPK   [32]byte //client short-term public key
 	clientSSK   [32]byte //client short-term secret key
@@ -20,6 +66,8 @@ type SessionContext struct {
 	clientNonce nonce
 	serverNonce nonce
 	connection  net.Conn
+	// writeMu serializes the packets written to connection, shared by copies
+	writeMu *sync.Mutex
 	//receiveMsgChan chan ReceivedMsg
 	receiveMsgChan *dynRecvChan
 	//sendMsgChan    chan Message
@@ -44,6 +92,16 @@ func NewSessionContext(ID ThreemaID) SessionContext {
 	copy(sc.clientSPK[:], (*pk)[:])
 	copy(sc.clientSSK[:], (*sk)[:])
 
+	// Make sure copies of the session share one address book
+	if sc.ID.Contacts.book == nil {
+		sc.ID.Contacts.initializeMap(0)
+	}
+
+	sc.features = newFeatureCache()
+	sc.keyChecks = newKeyCheckLimiter()
+	sc.writeMu = &sync.Mutex{}
+	sc.MediaCache = NewMemoryMediaCache(DefaultMediaCacheSize, DefaultMediaCacheTTL)
+
 	sc.receiveMsgChan = newDynRecvChan()
 	sc.sendMsgChan = newDynSendChan()
 	sc.ErrorChan = make(chan error, 100)
@@ -52,3 +110,80 @@ func NewSessionContext(ID ThreemaID) SessionContext {
 
 	return sc
 }
+
+// contacts returns the ContactStore used by the session
+func (sc *SessionContext) contacts() ContactStore {
+	if sc.Contacts != nil {
+		return sc.Contacts
+	}
+	return &sc.ID.Contacts
+}
+
+// lookupContact returns the contact for id from the session's ContactStore. Contacts
+// not yet known are fetched from the directory and saved to the store.
+func (sc *SessionContext) lookupContact(id IDString) (ThreemaContact, error) {
+	return sc.resolveContact(id, true)
+}
+
+// resolveContact returns the contact for id from the session's ContactStore. Contacts
+// not yet known or stored without a key are fetched from the directory and, if save is
+// set, saved to the store.
+func (sc *SessionContext) resolveContact(id IDString, save bool) (ThreemaContact, error) {
+	store := sc.contacts()
+	known, ok := store.Get(id.String())
+	if ok && known.hasKey() {
+		return known, sc.refuseChangedKey(known)
+	}
+
+	contact, err := sc.Directory.GetContactByID(id)
+	if err != nil {
+		return ThreemaContact{}, err
+	}
+	if ok {
+		// Keep everything else we know, e.g. that the contact is blocked
+		known.LPK = contact.LPK
+		known.KeyFetched = contact.KeyFetched
+		contact = known
+	}
+	if !save {
+		return contact, nil
+	}
+	if err := store.Put(contact); err != nil {
+		// The key is still usable for this message, so only report the failure
+		sc.reportError(err)
+	}
+	return contact, nil
+}
+
+// recordNickname stores the public nickname a known contact sent with a message
+func (sc *SessionContext) recordNickname(id IDString, nick PubNick) {
+	store := sc.contacts()
+	contact, ok := store.Get(id.String())
+	name := nick.Trimmed()
+	// Clients without a nickname send their ID instead
+	if !ok || name == "" || name == id.String() || name == contact.Nickname {
+		return
+	}
+
+	contact.Nickname = name
+	if err := store.Put(contact); err != nil {
+		sc.reportError(err)
+	}
+}
+
+// DisplayName returns the name to show for the given ID, see ThreemaContact.DisplayName.
+// IDs not in the session's ContactStore are returned as they are.
+func (sc *SessionContext) DisplayName(id IDString) string {
+	if contact, ok := sc.contacts().Get(id.String()); ok {
+		return contact.DisplayName()
+	}
+	return id.String()
+}
+
+// reportError passes err on to ErrorChan without blocking if nobody is listening
+func (sc *SessionContext) reportError(err error) {
+	select {
+	case sc.ErrorChan <- err:
+	default:
+	}
+}
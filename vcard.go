@@ -0,0 +1,259 @@
+package o3
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// vCard properties carrying Threema specific data
+const (
+	vCardThreemaID           = "X-THREEMA-ID"
+	vCardThreemaPublicKey    = "X-THREEMA-PUBLICKEY"
+	vCardThreemaVerification = "X-THREEMA-VERIFICATION"
+)
+
+// KeyLookup fetches the contact for an ID whose public key is not known, e.g.
+// ThreemaRest.GetContactByID
+type KeyLookup func(IDString) (ThreemaContact, error)
+
+// vCardProperty is a single unfolded content line of a vCard
+type vCardProperty struct {
+	name   string
+	params string
+	value  string
+}
+
+// ImportVCard imports contacts from vCard 3.0 or 4.0 data, replacing the address
+// book's previous content. The Threema ID and public key are taken from the
+// X-THREEMA-ID and X-THREEMA-PUBLICKEY properties. If the key is missing, it is
+// fetched using lookup; a nil lookup makes such cards invalid. Cards without a
+// Threema ID and otherwise invalid cards are reported in an *ImportError; Line is
+// the line of the card's BEGIN property.
+func (a *AddressBook) ImportVCard(r io.Reader, lookup KeyLookup) error {
+	cards, err := parseVCards(r)
+	if err != nil {
+		return err
+	}
+
+	records := make([]contactRecord, 0, len(cards))
+	var rowErrs []RowError
+	for _, card := range cards {
+		rec := card.record()
+		if rec.ID == "" {
+			rowErrs = append(rowErrs, RowError{Line: rec.line, Err: fmt.Errorf("missing %s", vCardThreemaID)})
+			continue
+		}
+		if rec.PublicKey == "" && lookup != nil && validIDString(rec.ID) {
+			fetched, err := lookup(NewIDString(rec.ID))
+			if err != nil {
+				rowErrs = append(rowErrs, RowError{Line: rec.line, ID: rec.ID, Err: err})
+				continue
+			}
+			fetchedRec := newContactRecord(fetched)
+			rec.PublicKey = fetchedRec.PublicKey
+			rec.KeyFetched = fetchedRec.KeyFetched
+		}
+		records = append(records, rec)
+	}
+	return a.importRecords(records, rowErrs)
+}
+
+// WriteVCard writes the AddressBook as a sequence of vCard 3.0 cards
+func (a AddressBook) WriteVCard(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, contact := range a.List() {
+		rec := newContactRecord(contact)
+		lines := []string{
+			"BEGIN:VCARD",
+			"VERSION:3.0",
+			// FN is imported as Name, so it must not carry the nickname or ID shown instead
+			"FN:" + vCardEscape(rec.Name),
+			"N:" + vCardEscape(rec.LastName) + ";" + vCardEscape(rec.FirstName) + ";;;",
+		}
+		if rec.Nickname != "" {
+			lines = append(lines, "NICKNAME:"+vCardEscape(rec.Nickname))
+		}
+		lines = append(lines, vCardThreemaID+":"+rec.ID)
+		if rec.PublicKey != "" {
+			lines = append(lines, vCardThreemaPublicKey+":"+rec.PublicKey)
+		}
+		lines = append(lines,
+			fmt.Sprintf("%s:%d", vCardThreemaVerification, rec.Verification),
+			"END:VCARD")
+
+		for _, line := range lines {
+			if _, err := bw.WriteString(vCardFold(line)); err != nil {
+				return err
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+type vCard struct {
+	line  int
+	props []vCardProperty
+}
+
+// record maps the properties of a card to a contactRecord
+func (card vCard) record() contactRecord {
+	rec := contactRecord{line: card.line}
+	for _, prop := range card.props {
+		switch prop.name {
+		case "FN":
+			rec.Name = vCardUnescape(prop.value)
+		case "N":
+			parts := splitVCardValue(prop.value, ';')
+			if len(parts) > 0 {
+				rec.LastName = vCardUnescape(parts[0])
+			}
+			if len(parts) > 1 {
+				rec.FirstName = vCardUnescape(parts[1])
+			}
+		case "NICKNAME":
+			rec.Nickname = vCardUnescape(splitVCardValue(prop.value, ',')[0])
+		case vCardThreemaID:
+			rec.ID = strings.ToUpper(strings.TrimSpace(prop.value))
+		case vCardThreemaPublicKey:
+			rec.PublicKey = strings.TrimSpace(prop.value)
+		case vCardThreemaVerification:
+			var level VerificationLevel
+			if _, err := fmt.Sscanf(prop.value, "%d", &level); err == nil {
+				rec.Verification = level
+			}
+		}
+	}
+	return rec
+}
+
+// parseVCards splits vCard data into cards of unfolded properties
+func parseVCards(r io.Reader) ([]vCard, error) {
+	var cards []vCard
+	var current *vCard
+
+	lines, err := unfoldVCardLines(r)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range lines {
+		prop, ok := parseVCardLine(l.text)
+		if !ok {
+			continue
+		}
+		switch {
+		case prop.name == "BEGIN" && strings.EqualFold(prop.value, "VCARD"):
+			current = &vCard{line: l.number}
+		case prop.name == "END" && strings.EqualFold(prop.value, "VCARD"):
+			if current != nil {
+				cards = append(cards, *current)
+			}
+			current = nil
+		case current != nil:
+			current.props = append(current.props, prop)
+		}
+	}
+	return cards, nil
+}
+
+type vCardLine struct {
+	number int
+	text   string
+}
+
+// unfoldVCardLines joins continuation lines, which start with a space or tab, to their predecessor
+func unfoldVCardLines(r io.Reader) ([]vCardLine, error) {
+	var lines []vCardLine
+	scanner := bufio.NewScanner(r)
+	number := 0
+	for scanner.Scan() {
+		number++
+		text := strings.TrimRight(scanner.Text(), "\r")
+		if len(text) > 0 && (text[0] == ' ' || text[0] == '\t') && len(lines) > 0 {
+			lines[len(lines)-1].text += text[1:]
+			continue
+		}
+		lines = append(lines, vCardLine{number: number, text: text})
+	}
+	return lines, scanner.Err()
+}
+
+// parseVCardLine splits a content line into name, parameters and value. A group
+// prefix like "item1." is dropped.
+func parseVCardLine(line string) (vCardProperty, bool) {
+	inQuotes := false
+	sep := -1
+	for i, c := range line {
+		if c == '"' {
+			inQuotes = !inQuotes
+		} else if c == ':' && !inQuotes {
+			sep = i
+			break
+		}
+	}
+	if sep < 0 {
+		return vCardProperty{}, false
+	}
+
+	prop := vCardProperty{value: line[sep+1:]}
+	name := line[:sep]
+	if i := strings.IndexByte(name, ';'); i >= 0 {
+		prop.params = name[i+1:]
+		name = name[:i]
+	}
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		name = name[i+1:]
+	}
+	prop.name = strings.ToUpper(strings.TrimSpace(name))
+	return prop, true
+}
+
+// splitVCardValue splits a structured value at unescaped separators
+func splitVCardValue(value string, sep byte) []string {
+	var parts []string
+	start := 0
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' {
+			i++
+			continue
+		}
+		if value[i] == sep {
+			parts = append(parts, value[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, value[start:])
+}
+
+var vCardUnescaper = strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`)
+var vCardEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, ",", `\,`, ";", `\;`)
+
+func vCardUnescape(s string) string {
+	return vCardUnescaper.Replace(s)
+}
+
+func vCardEscape(s string) string {
+	return vCardEscaper.Replace(s)
+}
+
+// vCardFold terminates a content line with CRLF and folds it into lines of at most
+// 75 octets without splitting UTF-8 sequences
+func vCardFold(line string) string {
+	maxLen := 75
+	var b strings.Builder
+	for len(line) > maxLen {
+		cut := maxLen
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		b.WriteString(line[:cut])
+		b.WriteString("\r\n ")
+		line = line[cut:]
+		// the leading space of continuation lines counts as well
+		maxLen = 74
+	}
+	b.WriteString(line)
+	b.WriteString("\r\n")
+	return b.String()
+}
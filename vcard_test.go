@@ -0,0 +1,89 @@
+package o3
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestImportVCard(t *testing.T) {
+	key := strings.Repeat("cd", 32)
+	in := "BEGIN:VCARD\r\n" +
+		"VERSION:4.0\r\n" +
+		"FN:Echo\\, the Bot\r\n" +
+		"N:Echoson;Echo;;;\r\n" +
+		"item1.X-THREEMA-ID;TYPE=work:ECHOECHO\r\n" +
+		"X-THREEMA-PUBLICKEY:" + key[:40] + "\r\n" +
+		" " + key[40:] + "\r\n" +
+		"END:VCARD\r\n" +
+		"BEGIN:VCARD\r\n" +
+		"VERSION:3.0\r\n" +
+		"FN:Oscar\r\n" +
+		"X-THREEMA-ID:oscar123\r\n" +
+		"END:VCARD\r\n" +
+		"BEGIN:VCARD\r\n" +
+		"VERSION:3.0\r\n" +
+		"FN:No Threema\r\n" +
+		"END:VCARD\r\n"
+
+	lookup := func(id IDString) (ThreemaContact, error) {
+		if id.String() != "OSCAR123" {
+			return ThreemaContact{}, errors.New("unexpected lookup")
+		}
+		return testContact("OSCAR123", 0x23), nil
+	}
+
+	var ab AddressBook
+	err := ab.ImportVCard(strings.NewReader(in), lookup)
+	var importErr *ImportError
+	if !errors.As(err, &importErr) || len(importErr.Rows) != 1 || importErr.Rows[0].Line != 14 {
+		t.Fatalf("expected a single row error for the third card, got %v", err)
+	}
+
+	echo, ok := ab.Get("ECHOECHO")
+	if !ok {
+		t.Fatal("ECHOECHO not imported")
+	}
+	if echo.Name != "Echo, the Bot" || echo.FirstName != "Echo" || echo.LastName != "Echoson" {
+		t.Errorf("names not imported: %#v", echo)
+	}
+	if echo.LPK != testContact("ECHOECHO", 0xcd).LPK {
+		t.Errorf("folded public key not imported")
+	}
+	if oscar, ok := ab.Get("OSCAR123"); !ok || oscar.LPK != testContact("OSCAR123", 0x23).LPK {
+		t.Errorf("missing key was not looked up: %#v", oscar)
+	}
+
+	var buf bytes.Buffer
+	if err := ab.WriteVCard(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var reimported AddressBook
+	if err := reimported.ImportVCard(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := reimported.Get("ECHOECHO"); got.Name != echo.Name || got.LPK != echo.LPK {
+		t.Errorf("exported vCard does not round trip: %#v", got)
+	}
+}
+
+func TestVCardRoundTripWithoutName(t *testing.T) {
+	nick := testContact("NICKONLY", 0x01)
+	nick.Name = ""
+	nick.Nickname = "nicky"
+
+	ab := NewAddressBook()
+	ab.Add(nick)
+	var buf bytes.Buffer
+	if err := ab.WriteVCard(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var reimported AddressBook
+	if err := reimported.ImportVCard(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := reimported.Get("NICKONLY"); got.Name != "" || got.Nickname != "nicky" {
+		t.Errorf("nickname moved into the name: %#v", got)
+	}
+}
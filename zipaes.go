@@ -0,0 +1,206 @@
+package o3
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// zipMethodAES is the compression method of ZIP entries encrypted with WinZip AES
+const zipMethodAES = 99
+
+// zipExtraAES is the ID of the extra field describing a WinZip AES entry
+const zipExtraAES = 0x9901
+
+// maxZipEntrySize limits the decompressed size of a single entry of a data backup.
+// Entries are CSV and JSON files that are read into memory as a whole; 8 MiB holds
+// tens of thousands of text messages of a conversation.
+var maxZipEntrySize int64 = 8 << 20
+
+// ErrZipEntryTooLarge is returned if an entry of a data backup exceeds the size limit,
+// which protects against decompression bombs
+var ErrZipEntryTooLarge = errors.New("o3: data backup entry too large")
+
+// ErrDataBackupPassword is returned if a data backup cannot be decrypted with the given password
+var ErrDataBackupPassword = errors.New("o3: wrong data backup password")
+
+// zipAESInfo holds the content of the WinZip AES extra field
+type zipAESInfo struct {
+	version  uint16
+	keyLen   int
+	method   uint16
+	hasExtra bool
+}
+
+func parseZipAESExtra(extra []byte) (info zipAESInfo) {
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+size {
+			return
+		}
+		data := extra[4 : 4+size]
+		extra = extra[4+size:]
+		if id != zipExtraAES || size != 7 || data[2] != 'A' || data[3] != 'E' {
+			continue
+		}
+		info.version = binary.LittleEndian.Uint16(data)
+		switch data[4] {
+		case 1:
+			info.keyLen = 16
+		case 2:
+			info.keyLen = 24
+		case 3:
+			info.keyLen = 32
+		}
+		info.method = binary.LittleEndian.Uint16(data[5:])
+		info.hasExtra = info.keyLen != 0
+	}
+	return
+}
+
+// openZipEntry returns the content of a ZIP entry, decrypting it with password if it is
+// encrypted with WinZip AES. Traditional PKWARE encryption is not supported.
+// The content is limited to maxZipEntrySize; reading more fails with ErrZipEntryTooLarge.
+func openZipEntry(f *zip.File, password []byte) (io.ReadCloser, error) {
+	if f.UncompressedSize64 > uint64(maxZipEntrySize) || f.CompressedSize64 > uint64(maxZipEntrySize) {
+		return nil, fmt.Errorf("%w: %s", ErrZipEntryTooLarge, f.Name)
+	}
+	if f.Method != zipMethodAES {
+		if f.Flags&0x1 != 0 {
+			return nil, fmt.Errorf("o3: %s uses unsupported ZIP encryption", f.Name)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		return &limitedReadCloser{ReadCloser: rc, name: f.Name, remaining: maxZipEntrySize}, nil
+	}
+
+	info := parseZipAESExtra(f.Extra)
+	if !info.hasExtra {
+		return nil, fmt.Errorf("o3: %s has invalid AES encryption header", f.Name)
+	}
+	raw, err := f.OpenRaw()
+	if err != nil {
+		return nil, err
+	}
+	data, err := readAllLimited(raw, f.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	saltLen := info.keyLen / 2
+	if len(data) < saltLen+2+10 {
+		return nil, fmt.Errorf("o3: %s is truncated", f.Name)
+	}
+	salt := data[:saltLen]
+	verifier := data[saltLen : saltLen+2]
+	ciphertext := data[saltLen+2 : len(data)-10]
+	authCode := data[len(data)-10:]
+
+	keys := pbkdf2.Key(password, salt, 1000, 2*info.keyLen+2, sha1.New)
+	encKey, macKey := keys[:info.keyLen], keys[info.keyLen:2*info.keyLen]
+	if subtle.ConstantTimeCompare(keys[2*info.keyLen:], verifier) != 1 {
+		return nil, ErrDataBackupPassword
+	}
+	mac := hmac.New(sha1.New, macKey)
+	mac.Write(ciphertext)
+	if !hmac.Equal(mac.Sum(nil)[:10], authCode) {
+		return nil, fmt.Errorf("o3: authentication of %s failed", f.Name)
+	}
+
+	plain, err := zipAESCrypt(encKey, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	var content []byte
+	switch info.method {
+	case zip.Store:
+		content = plain
+	case zip.Deflate:
+		content, err = readAllLimited(flate.NewReader(bytes.NewReader(plain)), f.Name)
+		if errors.Is(err, ErrZipEntryTooLarge) {
+			return nil, err
+		} else if err != nil {
+			return nil, fmt.Errorf("o3: %s: %w", f.Name, err)
+		}
+	default:
+		return nil, fmt.Errorf("o3: %s uses unsupported compression method %d", f.Name, info.method)
+	}
+	// AE-2 omits the CRC, the authentication code protects the data instead
+	if info.version == 1 && crc32.ChecksumIEEE(content) != f.CRC32 {
+		return nil, fmt.Errorf("o3: checksum of %s does not match", f.Name)
+	}
+	return ioutil.NopCloser(bytes.NewReader(content)), nil
+}
+
+// readAllLimited reads r up to maxZipEntrySize bytes
+func readAllLimited(r io.Reader, name string) ([]byte, error) {
+	return ioutil.ReadAll(&limitedReadCloser{ReadCloser: ioutil.NopCloser(r), name: name, remaining: maxZipEntrySize})
+}
+
+// limitedReadCloser fails with ErrZipEntryTooLarge once more than remaining bytes are read
+type limitedReadCloser struct {
+	io.ReadCloser
+	name      string
+	remaining int64
+}
+
+func (lr *limitedReadCloser) Read(p []byte) (int, error) {
+	if lr.remaining <= 0 {
+		// anything beyond the limit is an error, the end of the entry is not
+		var probe [1]byte
+		if n, err := lr.ReadCloser.Read(probe[:]); n == 0 {
+			return 0, err
+		}
+		return 0, fmt.Errorf("%w: %s", ErrZipEntryTooLarge, lr.name)
+	}
+	if int64(len(p)) > lr.remaining {
+		p = p[:lr.remaining]
+	}
+	n, err := lr.ReadCloser.Read(p)
+	lr.remaining -= int64(n)
+	return n, err
+}
+
+// zipAESCrypt en- or decrypts data with AES in the CTR variant used by WinZip: the
+// counter is a little endian integer starting at 1
+func zipAESCrypt(key, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(data))
+	var counter, keystream [aes.BlockSize]byte
+	for i := 0; i < len(data); i += aes.BlockSize {
+		for j := range counter {
+			counter[j]++
+			if counter[j] != 0 {
+				break
+			}
+		}
+		block.Encrypt(keystream[:], counter[:])
+		end := i + aes.BlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		for j := i; j < end; j++ {
+			out[j] = data[j] ^ keystream[j-i]
+		}
+	}
+	return out, nil
+}